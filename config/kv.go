@@ -30,6 +30,12 @@ func getConfigDir() string {
 	return dir + "/"
 }
 
+// Path returns the absolute path of name within the configuration directory.
+// It's used by packages that keep their own files next to the configuration.
+func Path(name string) string {
+	return getConfigDir() + name
+}
+
 func getConfigFileName(key string) (string, error) {
 	configFile, err := filepath.Abs(getConfigDir() + key + ".gob")
 	if err != nil {
@@ -98,3 +104,17 @@ func Get(key string, val interface{}) error {
 
 	return nil
 }
+
+// Delete removes key. Deleting a key that doesn't exist isn't an error.
+func Delete(key string) error {
+	configFile, err := getConfigFileName(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(configFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
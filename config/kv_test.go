@@ -30,3 +30,22 @@ func TestSetGet(t *testing.T) {
 		t.Errorf("Value mismatch: %q != %q", value, outStr)
 	}
 }
+
+func TestDelete(t *testing.T) {
+	const key = "deleted"
+	if err := config.Set(key, "value"); err != nil {
+		t.Fatalf("Error setting key: %s", err)
+	}
+
+	if err := config.Delete(key); err != nil {
+		t.Fatalf("Error deleting key: %s", err)
+	}
+	var outStr string
+	if err := config.Get(key, &outStr); err != config.ErrDoesNotExist {
+		t.Errorf("Getting a deleted key returned %v, want %v", err, config.ErrDoesNotExist)
+	}
+
+	if err := config.Delete(key); err != nil {
+		t.Errorf("Deleting a missing key returned %s", err)
+	}
+}
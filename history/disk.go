@@ -0,0 +1,343 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package history
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileExtension is the extension of the files that DiskStore keeps history in.
+const fileExtension = ".jsonl"
+
+// DiskStore keeps history in a directory so that it survives restarts. Each
+// target's history is kept in its own file, which holds one JSON-encoded
+// message per line. The ID, time and position of every message are indexed in
+// memory, so that queries only read the messages that they return. It's safe
+// for concurrent use.
+type DiskStore struct {
+	dir string
+
+	mu sync.Mutex
+
+	// indexes holds the index of each target's file. Targets are indexed
+	// when they're first used, and all of them are by the first call to
+	// Targets.
+	indexes map[string]*diskIndex
+
+	// indexed is true once every file in dir has been indexed.
+	indexed bool
+}
+
+// diskIndex records where each message in a target's file is.
+type diskIndex struct {
+	// messages holds the ID and time of each message in the file, which is
+	// all that Query needs to find the messages that it selects.
+	messages []Message
+
+	// offsets holds the offset of each message in the file, followed by the
+	// offset of the end of the last one.
+	offsets []int64
+}
+
+// add records that m was written to the end of the file as length bytes.
+func (idx *diskIndex) add(m Message, length int) {
+	idx.messages = append(idx.messages, Message{ID: m.ID, Time: m.Time})
+	idx.offsets = append(idx.offsets, idx.end()+int64(length))
+}
+
+// end returns the offset of the end of the last message in the file.
+func (idx *diskIndex) end() int64 {
+	return idx.offsets[len(idx.offsets)-1]
+}
+
+// NewDiskStore creates a DiskStore that keeps its history in dir, creating dir
+// if it doesn't exist. Any history already in dir is kept.
+func NewDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	return &DiskStore{
+		dir:     dir,
+		indexes: make(map[string]*diskIndex),
+	}, nil
+}
+
+// fileName returns the name of the file that holds the history of target.
+// Target names may contain characters that aren't allowed in file names, so
+// they're hex-encoded.
+func (s *DiskStore) fileName(target string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(target))+fileExtension)
+}
+
+// index returns the index of target's file, reading the file if it hasn't
+// been indexed yet.
+func (s *DiskStore) index(target string) (*diskIndex, error) {
+	if idx, ok := s.indexes[target]; ok {
+		return idx, nil
+	}
+
+	idx, err := readIndex(s.fileName(target))
+	if err != nil {
+		return nil, err
+	}
+
+	s.indexes[target] = idx
+	return idx, nil
+}
+
+// Add appends m to the history of target. Messages that retention no longer
+// allows to be kept are discarded once the file holds twice as many messages as
+// it's allowed to, so that most messages only need to be appended.
+func (s *DiskStore) Add(target string, m Message, retention Retention) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fileName := s.fileName(target)
+
+	if retention.Length <= 0 {
+		delete(s.indexes, target)
+		if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	idx, err := s.index(target)
+	if err != nil {
+		return err
+	}
+
+	line, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	// The message is written at the end of the last complete one, so that a
+	// line that was only partly written before a crash is overwritten.
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(line, idx.end())
+	if err == nil {
+		err = f.Truncate(idx.end() + int64(len(line)))
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		delete(s.indexes, target)
+		return err
+	}
+	idx.add(m, len(line))
+
+	if len(idx.messages) >= 2*retention.Length {
+		idx, err = s.compact(fileName, m.Time, retention)
+		if err != nil {
+			delete(s.indexes, target)
+			return err
+		}
+		s.indexes[target] = idx
+	}
+
+	return nil
+}
+
+// compact rewrites fileName so that it only holds the messages that retention
+// allows to be kept at now. It returns the index of the new file.
+func (s *DiskStore) compact(fileName string, now time.Time, retention Retention) (*diskIndex, error) {
+	messages, err := readMessages(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(messages) > retention.Length {
+		messages = messages[len(messages)-retention.Length:]
+	}
+	if retention.Age > 0 {
+		messages = Query{Since: now.Add(-retention.Age), Limit: len(messages)}.Apply(messages)
+	}
+
+	// The new file is written next to the old one and then moved over it, so
+	// that history isn't lost if writing fails.
+	tmpName := fileName + ".tmp"
+	f, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &diskIndex{offsets: []int64{0}}
+	buf := bufio.NewWriter(f)
+	for _, m := range messages {
+		var line []byte
+		if line, err = json.Marshal(m); err != nil {
+			break
+		}
+		line = append(line, '\n')
+		if _, err = buf.Write(line); err != nil {
+			break
+		}
+		idx.add(m, len(line))
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, fileName)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return nil, err
+	}
+
+	return idx, nil
+}
+
+// Query returns the messages in the history of target that match q. Only the
+// selected messages are read from the file.
+func (s *DiskStore) Query(target string, q Query) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx, err := s.index(target)
+	if err != nil {
+		return nil, err
+	}
+
+	lo, hi := q.span(idx.messages)
+	if lo >= hi {
+		return nil, nil
+	}
+
+	f, err := os.Open(s.fileName(target))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	start := idx.offsets[lo]
+	buf := make([]byte, idx.offsets[hi]-start)
+	if _, err := f.ReadAt(buf, start); err != nil {
+		return nil, err
+	}
+
+	messages := make([]Message, hi-lo)
+	for i := range messages {
+		line := buf[idx.offsets[lo+i]-start : idx.offsets[lo+i+1]-start]
+		if err := json.Unmarshal(line, &messages[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return messages, nil
+}
+
+// Targets returns the targets whose latest message was sent between start and
+// end, from the least to the most recently active.
+func (s *DiskStore) Targets(start, end time.Time) ([]Target, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.indexed {
+		fileNames, err := filepath.Glob(filepath.Join(s.dir, "*"+fileExtension))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, fileName := range fileNames {
+			name, err := hex.DecodeString(strings.TrimSuffix(filepath.Base(fileName), fileExtension))
+			if err != nil {
+				// Not one of ours.
+				continue
+			}
+
+			if _, err := s.index(string(name)); err != nil {
+				return nil, err
+			}
+		}
+		s.indexed = true
+	}
+
+	var targets []Target
+	for name, idx := range s.indexes {
+		if target, ok := latest(name, idx.messages, start, end); ok {
+			targets = append(targets, target)
+		}
+	}
+	sortTargets(targets)
+
+	return targets, nil
+}
+
+// readIndex indexes the messages in fileName. If the file doesn't exist, the
+// index is empty. A last line without a newline is a message that was only
+// partly written, so it's left out.
+func readIndex(fileName string) (*diskIndex, error) {
+	idx := &diskIndex{offsets: []int64{0}}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return idx, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return idx, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		var m Message
+		if err := json.Unmarshal(line, &m); err != nil {
+			return nil, err
+		}
+		idx.add(m, len(line))
+	}
+}
+
+// readMessages reads every message in fileName. If the file doesn't exist, no
+// messages are returned.
+func readMessages(fileName string) ([]Message, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var messages []Message
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var m Message
+		if err := dec.Decode(&m); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+
+	return messages, nil
+}
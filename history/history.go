@@ -0,0 +1,225 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+// Package history stores the messages that are sent to channels and users so
+// that they can be played back later.
+package history
+
+import (
+	"sort"
+	"time"
+
+	"github.com/nightexcessive/excessiveircd/protocol"
+)
+
+// Message is a message that's been stored in history.
+type Message struct {
+	// ID is the message's msgid tag.
+	ID   string
+	Time time.Time
+
+	// Source is the prefix of the client that sent the message, in the form
+	// nick!user@host.
+	Source string
+
+	// Account is the account that the sender was logged into, if any.
+	Account string
+
+	Command string
+	Target  string
+	Text    string
+
+	// Tags holds the client-only tags that were sent with the message.
+	Tags protocol.Tags
+}
+
+// Retention limits how much history is kept for a target.
+type Retention struct {
+	// Length is the maximum number of messages that are kept. If it's 0, no
+	// history is kept.
+	Length int
+
+	// Age is how long messages are kept. If it's 0, messages are kept until
+	// there are more than Length of them.
+	Age time.Duration
+}
+
+// Target is a target that has history.
+type Target struct {
+	Name string
+
+	// Latest is the time of the most recent message sent to the target.
+	Latest time.Time
+}
+
+// Bound identifies a point in a target's history, either by the ID of a message
+// or by a time. The zero Bound doesn't identify anything.
+type Bound struct {
+	ID   string
+	Time time.Time
+}
+
+// IsZero checks if b is the zero Bound.
+func (b Bound) IsZero() bool {
+	return len(b.ID) == 0 && b.Time.IsZero()
+}
+
+// after returns the index of the first message in messages that's after b. If
+// b is the ID of a message that isn't in messages, len(messages) is returned.
+func (b Bound) after(messages []Message) int {
+	if len(b.ID) > 0 {
+		i, ok := b.find(messages)
+		if !ok {
+			return len(messages)
+		}
+		return i + 1
+	}
+
+	return sort.Search(len(messages), func(i int) bool {
+		return messages[i].Time.After(b.Time)
+	})
+}
+
+// before returns the index of the first message in messages that isn't before
+// b. If b is the ID of a message that isn't in messages, 0 is returned.
+func (b Bound) before(messages []Message) int {
+	if len(b.ID) > 0 {
+		i, _ := b.find(messages)
+		return i
+	}
+
+	return sort.Search(len(messages), func(i int) bool {
+		return !messages[i].Time.Before(b.Time)
+	})
+}
+
+// find returns the index of the message in messages that b identifies. If b is
+// a time, that's the first message that isn't before it.
+func (b Bound) find(messages []Message) (int, bool) {
+	if len(b.ID) == 0 {
+		i := b.before(messages)
+		return i, i < len(messages)
+	}
+
+	// Recent messages are the most likely to be asked about.
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].ID == b.ID {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// Query selects messages from a target's history.
+type Query struct {
+	// Start and End limit the selected messages to the ones between them.
+	// Both are exclusive and the zero Bound doesn't limit anything. If Start
+	// is after End, they're swapped and the newest messages are selected.
+	Start, End Bound
+
+	// Around, if it isn't zero, selects the messages surrounding it, including
+	// the message that it identifies. Start and End are ignored.
+	Around Bound
+
+	// Since excludes messages from before it and Retained, if it's positive,
+	// excludes all but the newest Retained messages. They're used to enforce
+	// a Retention, which stores may only apply to what they keep lazily.
+	Since    time.Time
+	Retained int
+
+	// Limit is the maximum number of messages that are selected.
+	Limit int
+
+	// Latest selects the newest messages that match instead of the oldest.
+	Latest bool
+}
+
+// Apply returns the messages from messages, which must be in chronological
+// order, that match q. The result is also in chronological order and shares
+// its storage with messages.
+func (q Query) Apply(messages []Message) []Message {
+	lo, hi := q.span(messages)
+	if lo >= hi {
+		return nil
+	}
+
+	return messages[lo:hi]
+}
+
+// span returns the range of messages, which must be in chronological order,
+// that match q. Only the IDs and times of messages are used. If nothing
+// matches, lo isn't before hi.
+func (q Query) span(messages []Message) (lo, hi int) {
+	if q.Limit <= 0 {
+		return 0, 0
+	}
+
+	lo = Bound{Time: q.Since}.before(messages)
+	hi = len(messages)
+	if q.Retained > 0 && hi-q.Retained > lo {
+		lo = hi - q.Retained
+	}
+
+	if !q.Around.IsZero() {
+		i, ok := q.Around.find(messages)
+		if !ok || i < lo {
+			return 0, 0
+		}
+
+		start := max(lo, i-q.Limit/2)
+		end := min(hi, start+q.Limit)
+		start = max(lo, end-q.Limit)
+
+		return start, end
+	}
+
+	if !q.Start.IsZero() && !q.End.IsZero() && q.Start.after(messages) > q.End.before(messages) {
+		q.Start, q.End, q.Latest = q.End, q.Start, true
+	}
+
+	if !q.Start.IsZero() {
+		lo = max(lo, q.Start.after(messages))
+	}
+	if !q.End.IsZero() {
+		hi = min(hi, q.End.before(messages))
+	}
+
+	if lo >= hi {
+		return 0, 0
+	}
+
+	if hi-lo > q.Limit {
+		if q.Latest {
+			lo = hi - q.Limit
+		} else {
+			hi = lo + q.Limit
+		}
+	}
+
+	return lo, hi
+}
+
+// latest returns the Target for the named target with the given messages if
+// its latest message is between start and end, which are exclusive.
+func latest(name string, messages []Message, start, end time.Time) (Target, bool) {
+	if len(messages) == 0 {
+		return Target{}, false
+	}
+
+	t := messages[len(messages)-1].Time
+	if !t.After(start) || !t.Before(end) {
+		return Target{}, false
+	}
+
+	return Target{name, t}, true
+}
+
+// sortTargets sorts targets from the least to the most recently active.
+func sortTargets(targets []Target) {
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].Latest.Before(targets[j].Latest)
+	})
+}
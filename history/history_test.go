@@ -0,0 +1,220 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package history_test
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nightexcessive/excessiveircd/history"
+)
+
+var epoch = time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// testMessages returns n messages with the IDs "0" to n-1, sent a second apart.
+func testMessages(n int) []history.Message {
+	messages := make([]history.Message, n)
+	for i := range messages {
+		messages[i] = history.Message{
+			ID:   strconv.Itoa(i),
+			Time: epoch.Add(time.Duration(i) * time.Second),
+			Text: "message " + strconv.Itoa(i),
+		}
+	}
+
+	return messages
+}
+
+// ids returns the IDs of messages.
+func ids(messages []history.Message) []string {
+	ids := make([]string, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+
+	return ids
+}
+
+func TestQuery_Apply(t *testing.T) {
+	messages := testMessages(10)
+	at := func(i int) history.Bound {
+		return history.Bound{Time: epoch.Add(time.Duration(i) * time.Second)}
+	}
+
+	tests := []struct {
+		name     string
+		query    history.Query
+		expected []string
+	}{
+		{"latest", history.Query{Limit: 3, Latest: true}, []string{"7", "8", "9"}},
+		{"after id", history.Query{Start: history.Bound{ID: "6"}, Limit: 2}, []string{"7", "8"}},
+		{"before time", history.Query{End: at(3), Limit: 5, Latest: true}, []string{"0", "1", "2"}},
+		{"between", history.Query{Start: at(2), End: history.Bound{ID: "6"}, Limit: 10}, []string{"3", "4", "5"}},
+		{"between reversed", history.Query{Start: history.Bound{ID: "8"}, End: at(1), Limit: 2}, []string{"6", "7"}},
+		{"around", history.Query{Around: history.Bound{ID: "5"}, Limit: 3}, []string{"4", "5", "6"}},
+		{"around end", history.Query{Around: history.Bound{ID: "9"}, Limit: 4}, []string{"6", "7", "8", "9"}},
+		{"since", history.Query{Since: at(8).Time, Limit: 5}, []string{"8", "9"}},
+		{"retained", history.Query{Retained: 3, Limit: 5}, []string{"7", "8", "9"}},
+		{"unknown id", history.Query{Start: history.Bound{ID: "x"}, Limit: 5}, []string{}},
+	}
+
+	for _, test := range tests {
+		if actual := ids(test.query.Apply(messages)); !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, actual)
+		}
+	}
+}
+
+// testStore checks the behaviour that every store must share.
+func testStore(t *testing.T, store interface {
+	Add(string, history.Message, history.Retention) error
+	Query(string, history.Query) ([]history.Message, error)
+	Targets(time.Time, time.Time) ([]history.Target, error)
+}) {
+	retention := history.Retention{Length: 4}
+	for _, m := range testMessages(10) {
+		if err := store.Add("#chan", m, retention); err != nil {
+			t.Fatalf("Error adding message: %s", err)
+		}
+	}
+	if err := store.Add("other", testMessages(1)[0], retention); err != nil {
+		t.Fatalf("Error adding message: %s", err)
+	}
+
+	messages, err := store.Query("#chan", history.Query{Limit: 10, Latest: true, Retained: retention.Length})
+	if err != nil {
+		t.Fatalf("Error querying: %s", err)
+	}
+	if actual, expected := ids(messages), []string{"6", "7", "8", "9"}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected the newest messages %v to be kept, got %v", expected, actual)
+	}
+	if messages[3].Text != "message 9" {
+		t.Errorf("Message wasn't stored correctly: %#v", messages[3])
+	}
+
+	targets, err := store.Targets(epoch.Add(-time.Second), epoch.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Error listing targets: %s", err)
+	}
+	expected := []history.Target{{"other", epoch}, {"#chan", epoch.Add(9 * time.Second)}}
+	if len(targets) != 2 || targets[0].Name != expected[0].Name || targets[1].Name != expected[1].Name ||
+		!targets[0].Latest.Equal(expected[0].Latest) || !targets[1].Latest.Equal(expected[1].Latest) {
+		t.Errorf("Expected targets %v, got %v", expected, targets)
+	}
+
+	if err := store.Add("#chan", testMessages(1)[0], history.Retention{}); err != nil {
+		t.Fatalf("Error adding message: %s", err)
+	}
+	if messages, _ := store.Query("#chan", history.Query{Limit: 10}); len(messages) != 0 {
+		t.Errorf("Expected history to be discarded when the retention length is 0, got %v", ids(messages))
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, history.NewMemoryStore())
+}
+
+func TestMemoryStore_Age(t *testing.T) {
+	store := history.NewMemoryStore()
+	for _, m := range testMessages(10) {
+		store.Add("#chan", m, history.Retention{Length: 10, Age: 2 * time.Second})
+	}
+
+	messages, _ := store.Query("#chan", history.Query{Limit: 10})
+	if actual, expected := ids(messages), []string{"7", "8", "9"}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestDiskStore(t *testing.T) {
+	store, err := history.NewDiskStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creating store: %s", err)
+	}
+
+	testStore(t, store)
+}
+
+func TestDiskStore_Reopen(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := history.NewDiskStore(dir)
+	if err != nil {
+		t.Fatalf("Error creating store: %s", err)
+	}
+	for _, m := range testMessages(3) {
+		store.Add("#chan", m, history.Retention{Length: 10})
+	}
+
+	store, err = history.NewDiskStore(dir)
+	if err != nil {
+		t.Fatalf("Error reopening store: %s", err)
+	}
+	messages, err := store.Query("#chan", history.Query{Limit: 10})
+	if err != nil {
+		t.Fatalf("Error querying: %s", err)
+	}
+	if actual, expected := ids(messages), []string{"0", "1", "2"}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v, got %v", expected, actual)
+	}
+}
+
+func TestDiskStore_PartialLine(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := history.NewDiskStore(dir)
+	if err != nil {
+		t.Fatalf("Error creating store: %s", err)
+	}
+	messages := testMessages(4)
+	for _, m := range messages[:3] {
+		store.Add("#chan", m, history.Retention{Length: 10})
+	}
+
+	// Simulate a crash while the fourth message was being written.
+	fileName := filepath.Join(dir, hex.EncodeToString([]byte("#chan"))+".jsonl")
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatalf("Error opening history file: %s", err)
+	}
+	f.WriteString(`{"ID":"3","Ti`)
+	f.Close()
+
+	store, err = history.NewDiskStore(dir)
+	if err != nil {
+		t.Fatalf("Error reopening store: %s", err)
+	}
+	if err := store.Add("#chan", messages[3], history.Retention{Length: 10}); err != nil {
+		t.Fatalf("Error adding message: %s", err)
+	}
+
+	for _, store := range []*history.DiskStore{store, reopenDiskStore(t, dir)} {
+		messages, err := store.Query("#chan", history.Query{Limit: 10})
+		if err != nil {
+			t.Fatalf("Error querying: %s", err)
+		}
+		if actual, expected := ids(messages), []string{"0", "1", "2", "3"}; !reflect.DeepEqual(actual, expected) {
+			t.Errorf("Expected %v, got %v", expected, actual)
+		}
+		if messages[3].Text != "message 3" {
+			t.Errorf("Expected the last message's text to be read, got %q", messages[3].Text)
+		}
+	}
+}
+
+func reopenDiskStore(t *testing.T, dir string) *history.DiskStore {
+	store, err := history.NewDiskStore(dir)
+	if err != nil {
+		t.Fatalf("Error reopening store: %s", err)
+	}
+
+	return store
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package history
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps history in memory, in a ring buffer for each target. Its
+// history is lost when the server restarts. It's safe for concurrent use.
+type MemoryStore struct {
+	mu      sync.Mutex
+	targets map[string]*ring
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{targets: make(map[string]*ring)}
+}
+
+// Add adds m to the history of target, discarding any messages that retention
+// no longer allows to be kept.
+func (s *MemoryStore) Add(target string, m Message, retention Retention) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if retention.Length <= 0 {
+		delete(s.targets, target)
+		return nil
+	}
+
+	r, ok := s.targets[target]
+	if !ok {
+		r = new(ring)
+		s.targets[target] = r
+	}
+	if len(r.buf) != retention.Length {
+		r.resize(retention.Length)
+	}
+
+	r.push(m)
+
+	if retention.Age > 0 {
+		oldest := m.Time.Add(-retention.Age)
+		for r.n > 0 && r.buf[r.start].Time.Before(oldest) {
+			r.pop()
+		}
+	}
+
+	return nil
+}
+
+// Query returns the messages in the history of target that match q.
+func (s *MemoryStore) Query(target string, q Query) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.targets[target]
+	if !ok {
+		return nil, nil
+	}
+
+	return q.Apply(r.messages()), nil
+}
+
+// Targets returns the targets whose latest message was sent between start and
+// end, from the least to the most recently active.
+func (s *MemoryStore) Targets(start, end time.Time) ([]Target, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var targets []Target
+	for name, r := range s.targets {
+		if r.n == 0 {
+			continue
+		}
+
+		last := r.buf[(r.start+r.n-1)%len(r.buf)]
+		if target, ok := latest(name, []Message{last}, start, end); ok {
+			targets = append(targets, target)
+		}
+	}
+	sortTargets(targets)
+
+	return targets, nil
+}
+
+// ring is a fixed-size buffer that holds the newest messages that were pushed
+// into it.
+type ring struct {
+	buf []Message
+
+	// start is the index of the oldest message in buf and n is the number of
+	// messages in buf.
+	start, n int
+}
+
+func (r *ring) push(m Message) {
+	if r.n < len(r.buf) {
+		r.buf[(r.start+r.n)%len(r.buf)] = m
+		r.n++
+		return
+	}
+
+	r.buf[r.start] = m
+	r.start = (r.start + 1) % len(r.buf)
+}
+
+// pop discards the oldest message.
+func (r *ring) pop() {
+	r.buf[r.start] = Message{}
+	r.start = (r.start + 1) % len(r.buf)
+	r.n--
+}
+
+// messages returns a copy of the messages in r, in the order that they were
+// pushed.
+func (r *ring) messages() []Message {
+	messages := make([]Message, r.n)
+	for i := range messages {
+		messages[i] = r.buf[(r.start+i)%len(r.buf)]
+	}
+
+	return messages
+}
+
+// resize changes the number of messages that r can hold, keeping the newest
+// ones.
+func (r *ring) resize(length int) {
+	messages := r.messages()
+	if len(messages) > length {
+		messages = messages[len(messages)-length:]
+	}
+
+	r.buf = make([]Message, length)
+	r.start = 0
+	r.n = copy(r.buf, messages)
+}
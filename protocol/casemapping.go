@@ -0,0 +1,75 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package protocol
+
+// FoldFunc folds a name so that names that are equal under a casemapping fold
+// to the same string.
+type FoldFunc func(name string) string
+
+// Casemappings holds the casemappings that a server may use, keyed by the name
+// that's advertised in the CASEMAPPING RPL_ISUPPORT token.
+var Casemappings = map[string]FoldFunc{
+	"ascii":          FoldASCII,
+	"rfc1459":        FoldRFC1459,
+	"strict-rfc1459": FoldStrictRFC1459,
+	"rfc8265":        FoldPRECIS,
+}
+
+// foldBytes returns name with every byte that upper holds a lowercase form for
+// replaced by it.
+func foldBytes(name string, upper *[256]byte) string {
+	var folded []byte
+	for i := 0; i < len(name); i++ {
+		lower := upper[name[i]]
+		if lower == 0 {
+			continue
+		}
+
+		if folded == nil {
+			folded = []byte(name)
+		}
+		folded[i] = lower
+	}
+
+	if folded == nil {
+		return name
+	}
+	return string(folded)
+}
+
+var asciiUpper, rfc1459Upper, strictRFC1459Upper [256]byte
+
+func init() {
+	for b := 'A'; b <= 'Z'; b++ {
+		asciiUpper[b] = byte(b - 'A' + 'a')
+	}
+
+	strictRFC1459Upper = asciiUpper
+	strictRFC1459Upper['['] = '{'
+	strictRFC1459Upper[']'] = '}'
+	strictRFC1459Upper['\\'] = '|'
+
+	rfc1459Upper = strictRFC1459Upper
+	rfc1459Upper['^'] = '~'
+}
+
+// FoldASCII folds name with the ascii casemapping, in which only the letters A
+// to Z have lowercase forms.
+func FoldASCII(name string) string {
+	return foldBytes(name, &asciiUpper)
+}
+
+// FoldRFC1459 folds name with the rfc1459 casemapping, in which "[", "]", "\"
+// and "^" are also the uppercase forms of "{", "}", "|" and "~".
+func FoldRFC1459(name string) string {
+	return foldBytes(name, &rfc1459Upper)
+}
+
+// FoldStrictRFC1459 folds name with the strict-rfc1459 casemapping, which is
+// the rfc1459 casemapping without "~" and "^".
+func FoldStrictRFC1459(name string) string {
+	return foldBytes(name, &strictRFC1459Upper)
+}
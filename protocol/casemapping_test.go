@@ -0,0 +1,44 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package protocol_test
+
+import (
+	"testing"
+
+	"github.com/nightexcessive/excessiveircd/protocol"
+)
+
+func TestCasemappings(t *testing.T) {
+	tests := []struct {
+		casemapping, name, expected string
+	}{
+		{"ascii", `Nick[A]\~`, `nick[a]\~`},
+		{"ascii", "ÀLICE", "Àlice"},
+		{"rfc1459", `Nick[A]\~`, "nick{a}|~"},
+		{"rfc1459", `A[]\^`, "a{}|~"},
+		{"rfc1459", "nick", "nick"},
+		{"strict-rfc1459", `Nick[A]\~`, "nick{a}|~"},
+		{"rfc8265", "ÀLICE", "àlice"},
+		{"rfc8265", "ΣΊΣΥΦΟΣ", "σίσυφοσ"},
+		{"rfc8265", "σίσυφος", "σίσυφος"},
+		{"rfc8265", "JOSE\u0301", "jos\u00e9"},
+		{"rfc8265", "ＮＩＣＫ", "nick"},
+		{"rfc8265", "#test1", "#test1"},
+		{"rfc8265", "#€URO", "#€uro"},
+		{"rfc8265", "аdmin", "аdmin"},
+	}
+
+	for _, test := range tests {
+		fold, ok := protocol.Casemappings[test.casemapping]
+		if !ok {
+			t.Fatalf("Missing casemapping %q", test.casemapping)
+		}
+
+		if folded := fold(test.name); folded != test.expected {
+			t.Errorf("%s: expected %q to fold to %q, got %q", test.casemapping, test.name, test.expected, folded)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+//go:build ignore
+
+// This program generates confusables_table.go from the Unicode confusables data
+// (UTS #39). Run it with "go run gen_confusables.go" in this directory.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	url    = flag.String("url", "https://www.unicode.org/Public/security/latest/confusables.txt", "URL to download confusables.txt from")
+	input  = flag.String("input", "", "File to read confusables.txt from instead of downloading it")
+	output = flag.String("output", "confusables_table.go", "File to write the table to")
+)
+
+func main() {
+	flag.Parse()
+
+	var r io.Reader
+	if len(*input) > 0 {
+		f, err := os.Open(*input)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		r = f
+	} else {
+		resp, err := http.Get(*url)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			log.Fatalf("Downloading %s: %s", *url, resp.Status)
+		}
+		r = resp.Body
+	}
+
+	version, prototypes, err := parse(r)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	keys := make([]rune, 0, len(prototypes))
+	for r := range prototypes {
+		keys = append(keys, r)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+
+	var b bytes.Buffer
+	b.WriteString("// Code generated by gen_confusables.go; DO NOT EDIT.\n\n")
+	b.WriteString("package protocol\n\n")
+	b.WriteString("// confusablesVersion is the version of the Unicode confusables data that\n")
+	b.WriteString("// confusables was generated from.\n")
+	fmt.Fprintf(&b, "const confusablesVersion = %q\n\n", version)
+	b.WriteString("// confusables maps every character that's confusable with another to its\n")
+	b.WriteString("// prototype, as the Unicode confusables data (UTS #39) does.\n")
+	b.WriteString("var confusables = map[rune]string{\n")
+	for _, r := range keys {
+		fmt.Fprintf(&b, "\t0x%04X: %s,\n", r, strconv.QuoteToASCII(prototypes[r]))
+	}
+	b.WriteString("}\n")
+
+	source, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(*output, source, 0666); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parse reads confusables.txt. It returns the version from its header and the
+// prototype of every character that it lists.
+func parse(r io.Reader) (string, map[rune]string, error) {
+	var version string
+	prototypes := make(map[rune]string)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimPrefix(scanner.Text(), "\ufeff")
+		if strings.HasPrefix(line, "# Version:") {
+			version = strings.TrimSpace(strings.TrimPrefix(line, "# Version:"))
+		}
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		fields := strings.Split(line, ";")
+		if len(fields) < 2 {
+			return "", nil, fmt.Errorf("invalid line %q", scanner.Text())
+		}
+
+		source, err := parseCodePoints(fields[0])
+		if err != nil || len(source) != 1 {
+			return "", nil, fmt.Errorf("invalid source in %q", scanner.Text())
+		}
+		prototype, err := parseCodePoints(fields[1])
+		if err != nil || len(prototype) == 0 {
+			return "", nil, fmt.Errorf("invalid prototype in %q", scanner.Text())
+		}
+
+		prototypes[source[0]] = string(prototype)
+	}
+	if err := scanner.Err(); err != nil {
+		return "", nil, err
+	}
+	if len(version) == 0 {
+		return "", nil, fmt.Errorf("no version in the header")
+	}
+
+	return version, prototypes, nil
+}
+
+// parseCodePoints parses a space-separated list of hexadecimal code points.
+func parseCodePoints(s string) ([]rune, error) {
+	var runes []rune
+	for _, field := range strings.Fields(s) {
+		r, err := strconv.ParseUint(field, 16, 32)
+		if err != nil {
+			return nil, err
+		}
+		runes = append(runes, rune(r))
+	}
+
+	return runes, nil
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package protocol
+
+import "strings"
+
+// Match checks if s matches pattern, in which "*" matches any number of
+// characters and "?" matches exactly one. Matching is case-sensitive, so both
+// should be folded first if case shouldn't matter.
+func Match(pattern, s string) bool {
+	// star is the index in pattern just after the last "*" that was seen, and
+	// next is the index in s that it'll try to match from if the rest of the
+	// pattern doesn't match.
+	star, next := -1, 0
+
+	p, i := 0, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			p++
+			star, next = p, i
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case star >= 0:
+			// Let the last "*" swallow one more character and try again.
+			next++
+			p, i = star, next
+		default:
+			return false
+		}
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
+
+// CompleteMask fills in the missing parts of a partial hostmask. A bare
+// nickname becomes nick!*@*, user@host becomes *!user@host and nick!user
+// becomes nick!user@*. Anything containing a "." or ":" but no "!" or "@" is
+// taken to be a host.
+func CompleteMask(mask string) string {
+	bang := strings.IndexByte(mask, '!')
+	at := strings.IndexByte(mask, '@')
+
+	switch {
+	case bang < 0 && at < 0:
+		if strings.ContainsAny(mask, ".:") {
+			return "*!*@" + mask
+		}
+		return mask + "!*@*"
+	case bang < 0:
+		return "*!" + mask
+	case at < 0:
+		return mask + "@*"
+	}
+
+	return mask
+}
+
+// MatchHostmask checks if mask, a wildcard pattern in the form nick!user@host,
+// matches any of hostmasks. Both are folded with fold first, so that matching
+// follows the server's casemapping.
+func MatchHostmask(mask string, fold FoldFunc, hostmasks ...string) bool {
+	mask = fold(mask)
+	for _, hostmask := range hostmasks {
+		if Match(mask, fold(hostmask)) {
+			return true
+		}
+	}
+
+	return false
+}
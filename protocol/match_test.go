@@ -0,0 +1,77 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package protocol_test
+
+import (
+	"testing"
+
+	"github.com/nightexcessive/excessiveircd/protocol"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		expected   bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"nick", "nick", true},
+		{"nick", "nickname", false},
+		{"n?ck", "nick", true},
+		{"n?ck", "nck", false},
+		{"*!*@*.example.com", "nick!user@host.example.com", true},
+		{"*!*@*.example.com", "nick!user@example.com", false},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+		{"**a", "bba", true},
+		{"", "", true},
+		{"", "a", false},
+	}
+
+	for _, test := range tests {
+		if actual := protocol.Match(test.pattern, test.s); actual != test.expected {
+			t.Errorf("Match(%q, %q): expected %v, got %v", test.pattern, test.s, test.expected, actual)
+		}
+	}
+}
+
+func TestCompleteMask(t *testing.T) {
+	tests := map[string]string{
+		"nick":             "nick!*@*",
+		"user@host":        "*!user@host",
+		"nick!user":        "nick!user@*",
+		"host.example.com": "*!*@host.example.com",
+		"2001:db8::1":      "*!*@2001:db8::1",
+		"n!u@h":            "n!u@h",
+	}
+
+	for mask, expected := range tests {
+		if actual := protocol.CompleteMask(mask); actual != expected {
+			t.Errorf("CompleteMask(%q): expected %q, got %q", mask, expected, actual)
+		}
+	}
+}
+
+func TestMatchHostmask(t *testing.T) {
+	hostmasks := []string{"Nick[1]!~user@host.example.com", "Nick[1]!~user@192.0.2.1"}
+
+	tests := []struct {
+		mask     string
+		expected bool
+	}{
+		{"nick{1}!*@*", true},
+		{"*!*@*.EXAMPLE.com", true},
+		{"*!*@192.0.2.*", true},
+		{"*!*@198.51.100.*", false},
+		{"other!*@*", false},
+	}
+
+	for _, test := range tests {
+		if actual := protocol.MatchHostmask(test.mask, protocol.FoldRFC1459, hostmasks...); actual != test.expected {
+			t.Errorf("MatchHostmask(%q): expected %v, got %v", test.mask, test.expected, actual)
+		}
+	}
+}
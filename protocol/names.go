@@ -5,6 +5,8 @@
 
 package protocol
 
+import "strings"
+
 // CheckFunc checks if a given r at index i is within its specification.
 type CheckFunc func(i int, r rune) (valid bool)
 
@@ -47,7 +49,7 @@ func Letter(i int, r rune) bool {
 
 // Special checks if r is a valid special character, as according to RFC 2812.
 func Special(i int, r rune) bool {
-	return (r >= ']' && r <= '`') || (r >= '{' && r <= '}') // "[", "]", "\", "`", "_", "^", "{", "|", "}"
+	return (r >= '[' && r <= '`') || (r >= '{' && r <= '}') // "[", "]", "\", "`", "_", "^", "{", "|", "}"
 }
 
 // Digit checks if r is a valid digit, as according to RFC 2812.
@@ -81,6 +83,31 @@ func Nickname(i int, r rune) bool {
 	return true
 }
 
+// MaximumChannelLen specifies the maximum length that a channel name may be,
+// including its prefix.
+const MaximumChannelLen = 50
+
+// ChannelTypes lists the characters that a channel name may begin with.
+const ChannelTypes = "#"
+
+// Channel checks if r at index i is a valid channel name character, as
+// according to RFC 2812.
+func Channel(i int, r rune) bool {
+	if i >= MaximumChannelLen {
+		return false
+	}
+	if i == 0 {
+		return strings.ContainsRune(ChannelTypes, r)
+	}
+
+	switch r {
+	case 0x00, 0x07, '\r', '\n', ' ', ',', ':': // NUL, BELL, CR, LF, " ", "," and ":"
+		return false
+	}
+
+	return true
+}
+
 // Username checks if r at index i is a valid nickname character, as according
 // to RFC 2812.
 func Username(i int, r rune) bool {
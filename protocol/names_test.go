@@ -6,6 +6,7 @@
 package protocol_test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/nightexcessive/excessiveircd/protocol"
@@ -20,3 +21,35 @@ func TestIsValid_AlwaysTrue(t *testing.T) {
 		t.Error("false value given, expected true")
 	}
 }
+
+func TestIsValid_Channel(t *testing.T) {
+	valid := []string{"#go", "#go-nuts", "#[]{}", "#" + strings.Repeat("a", protocol.MaximumChannelLen-1)}
+	for _, name := range valid {
+		if !protocol.IsValid(name, protocol.Channel) {
+			t.Errorf("%q should be a valid channel name", name)
+		}
+	}
+
+	invalid := []string{"go", "&go", "#go nuts", "#go,#nuts", "#go:nuts", "#go\x07", "#" + strings.Repeat("a", protocol.MaximumChannelLen)}
+	for _, name := range invalid {
+		if protocol.IsValid(name, protocol.Channel) {
+			t.Errorf("%q should be an invalid channel name", name)
+		}
+	}
+}
+
+func TestIsValid_Nickname(t *testing.T) {
+	valid := []string{"nick", "Nick[1]", `[\]^_{|}`, "a-1", strings.Repeat("a", protocol.MaximumNickLen)}
+	for _, name := range valid {
+		if !protocol.IsValid(name, protocol.Nickname) {
+			t.Errorf("%q should be a valid nickname", name)
+		}
+	}
+
+	invalid := []string{"1nick", "-nick", "ni ck", "nick!", strings.Repeat("a", protocol.MaximumNickLen+1)}
+	for _, name := range invalid {
+		if protocol.IsValid(name, protocol.Nickname) {
+			t.Errorf("%q should be an invalid nickname", name)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package protocol
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/secure/precis"
+	"golang.org/x/text/unicode/norm"
+)
+
+// The CheckFuncs and FoldFuncs in this file allow nicknames and channel names
+// to contain characters outside of ASCII. Names are folded with the PRECIS
+// UsernameCaseMapped profile (RFC 8265), and nicknames must be allowed by it.
+// Combining marks aren't allowed in either, since they make it easy for two
+// names to look the same.
+
+// UnicodeNickname checks if r at index i is a valid nickname character when
+// nicknames may contain Unicode letters and digits. ASCII characters are
+// checked with Nickname, and the length limit applies to the encoded bytes.
+func UnicodeNickname(i int, r rune) bool {
+	if i+utf8.RuneLen(r) > MaximumNickLen {
+		return false
+	}
+	if r < utf8.RuneSelf {
+		return Nickname(i, r)
+	}
+
+	if i == 0 {
+		return unicode.IsLetter(r)
+	}
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// UnicodeChannel checks if r at index i is a valid channel name character when
+// channel names may contain Unicode. Besides the characters that Channel
+// allows, letters, numbers, punctuation and symbols are allowed. Marks, spaces,
+// control and formatting characters, which could be used to make two names
+// look the same, aren't.
+func UnicodeChannel(i int, r rune) bool {
+	if i+utf8.RuneLen(r) > MaximumChannelLen {
+		return false
+	}
+	if i == 0 || r < utf8.RuneSelf {
+		return Channel(i, r)
+	}
+
+	// Invalid UTF-8 is decoded as RuneError, which is a symbol.
+	return r != utf8.RuneError && unicode.In(r, unicode.L, unicode.N, unicode.P, unicode.S)
+}
+
+// foldProfile folds names that UsernameCaseMapped doesn't allow with the same
+// width mapping, case mapping and normalization rules.
+var foldProfile = precis.NewFreeform(precis.FoldWidth, precis.LowerCase(), precis.Norm(norm.NFC))
+
+// IsPRECIS checks if name is allowed by the PRECIS UsernameCaseMapped profile.
+func IsPRECIS(name string) bool {
+	_, err := precis.UsernameCaseMapped.String(name)
+	return err == nil
+}
+
+// FoldPRECIS folds name with the PRECIS UsernameCaseMapped profile, which is the
+// rfc8265 casemapping. Names that the profile doesn't allow, such as channel
+// names with symbols in them, are folded with its width mapping, case mapping
+// and normalization rules alone.
+func FoldPRECIS(name string) string {
+	if folded, err := precis.UsernameCaseMapped.String(name); err == nil {
+		return folded
+	}
+	if folded, err := foldProfile.String(name); err == nil {
+		return folded
+	}
+
+	return name
+}
+
+// Skeleton returns the skeleton of name, as defined by UTS #39: every character
+// is replaced by its prototype from the Unicode confusables data. Names that
+// look alike have the same skeleton.
+func Skeleton(name string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(name) {
+		if prototype, ok := confusables[r]; ok {
+			b.WriteString(prototype)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+
+	return norm.NFD.String(b.String())
+}
+
+// FoldSkeleton folds name with FoldPRECIS and then takes its skeleton, so that
+// names that only differ by case or by confusable characters fold to the same
+// string. It's much stricter than any casemapping, so it's only suitable for
+// refusing names that look like one that's in use, not for telling names apart.
+func FoldSkeleton(name string) string {
+	return Skeleton(FoldPRECIS(name))
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package protocol_test
+
+import (
+	"testing"
+
+	"github.com/nightexcessive/excessiveircd/protocol"
+)
+
+func TestIsValid_UnicodeNickname(t *testing.T) {
+	valid := []string{"nick", "Nick[1]", "Ελένη", "josé", "李小龍", "ｎｉｃｋ"}
+	for _, name := range valid {
+		if !protocol.IsValid(name, protocol.UnicodeNickname) {
+			t.Errorf("%q should be a valid nickname", name)
+		}
+	}
+
+	invalid := []string{
+		"1nick",
+		"\u0663nick", // Arabic-Indic digit three
+		"jose\u0301", // Combining acute accent
+		"ni\u200bck", // Zero width space
+		"nick\xff",   // Invalid UTF-8
+		"ééééééééé",  // Longer than MaximumNickLen bytes
+	}
+	for _, name := range invalid {
+		if protocol.IsValid(name, protocol.UnicodeNickname) {
+			t.Errorf("%q should be an invalid nickname", name)
+		}
+	}
+}
+
+func TestIsValid_UnicodeChannel(t *testing.T) {
+	valid := []string{"#go", "#café", "#日本語", "#€"}
+	for _, name := range valid {
+		if !protocol.IsValid(name, protocol.UnicodeChannel) {
+			t.Errorf("%q should be a valid channel name", name)
+		}
+	}
+
+	invalid := []string{"café", "#go nuts", "#a b", "#a\u202eb", "#\xff"}
+	for _, name := range invalid {
+		if protocol.IsValid(name, protocol.UnicodeChannel) {
+			t.Errorf("%q should be an invalid channel name", name)
+		}
+	}
+}
+
+func TestIsPRECIS(t *testing.T) {
+	valid := []string{"nick", "Nick[1]", "Ελένη", "josé", "ｎｉｃｋ"}
+	for _, name := range valid {
+		if !protocol.IsPRECIS(name) {
+			t.Errorf("%q should be allowed", name)
+		}
+	}
+
+	invalid := []string{"ni ck", "nick\u2605", "\u05d0nick"}
+	for _, name := range invalid {
+		if protocol.IsPRECIS(name) {
+			t.Errorf("%q shouldn't be allowed", name)
+		}
+	}
+}
+
+func TestFoldSkeleton(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		equal bool
+	}{
+		{"admin", "ADMIN", true},
+		{"admin", "\u0430dmin", true}, // Cyrillic a
+		{"admin", "\u0391DMIN", true}, // Greek capital alpha
+		{"admin", "ａｄｍｉｎ", true},
+		{"paypal", "\u0440\u0430\u0443pal", true}, // Cyrillic er, a and u
+		{"bob1", "bobl", true},                    // The data maps 1 to l.
+		{"mike", "rnike", true},
+		{"jos\u00e9", "jose\u0301", true},
+		{"admin", "admins", false},
+		{"josé", "jose", false},
+	}
+
+	for _, test := range tests {
+		a, b := protocol.FoldSkeleton(test.a), protocol.FoldSkeleton(test.b)
+		if (a == b) != test.equal {
+			t.Errorf("%q and %q fold to %q and %q", test.a, test.b, a, b)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package protocol
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+const (
+	// MaximumClientTagsLen specifies the maximum length of the tags that a
+	// client may send, not including the leading "@" and trailing space.
+	MaximumClientTagsLen = 4094
+
+	// MaximumTagsLen specifies the maximum length of a message's tags,
+	// including the leading "@" and trailing space.
+	MaximumTagsLen = 8191
+)
+
+// ClientOnlyTagPrefix is the prefix of tags that are only meaningful to
+// clients. Servers relay them without interpreting them.
+const ClientOnlyTagPrefix = "+"
+
+var (
+	// ErrTagsTooLong is returned when a message's tags are longer than they're
+	// allowed to be.
+	ErrTagsTooLong = errors.New("message tags too long")
+
+	// ErrInvalidTag is returned when a tag's key isn't valid.
+	ErrInvalidTag = errors.New("invalid message tag")
+)
+
+// Tags holds the IRCv3 tags of a message. Tags without a value are stored with
+// an empty value.
+type Tags map[string]string
+
+// SplitTags splits line into its tags and the rest of the message. If line
+// doesn't have tags, tags is nil and rest is line. The tags may be at most
+// maxLength bytes long, not including the leading "@" and trailing space.
+func SplitTags(line string, maxLength int) (tags Tags, rest string, err error) {
+	if !strings.HasPrefix(line, "@") {
+		return nil, line, nil
+	}
+
+	end := strings.IndexByte(line, ' ')
+	if end < 0 {
+		end = len(line)
+	}
+	if end-1 > maxLength {
+		return nil, "", ErrTagsTooLong
+	}
+
+	tags, err = ParseTags(line[1:end])
+	if err != nil {
+		return nil, "", err
+	}
+
+	return tags, strings.TrimLeft(line[end:], " "), nil
+}
+
+// ParseTags parses raw, which must not include the leading "@". If a key is
+// given more than once, the last value is used.
+func ParseTags(raw string) (Tags, error) {
+	tags := make(Tags)
+	for _, tag := range strings.Split(raw, ";") {
+		if len(tag) == 0 {
+			continue
+		}
+
+		key, value := tag, ""
+		if i := strings.IndexByte(tag, '='); i >= 0 {
+			key, value = tag[:i], UnescapeTagValue(tag[i+1:])
+		}
+
+		if !IsValidTagKey(key) {
+			return nil, ErrInvalidTag
+		}
+
+		tags[key] = value
+	}
+
+	return tags, nil
+}
+
+// IsValidTagKey checks if key is a valid tag key. Keys consist of an optional
+// client-only prefix, an optional vendor followed by a "/", and a name made up
+// of letters, digits and "-".
+func IsValidTagKey(key string) bool {
+	key = strings.TrimPrefix(key, ClientOnlyTagPrefix)
+
+	if i := strings.LastIndexByte(key, '/'); i >= 0 {
+		vendor := key[:i]
+		key = key[i+1:]
+
+		if len(vendor) == 0 || !IsValid(vendor, hostname) {
+			return false
+		}
+	}
+
+	return len(key) > 0 && IsValid(key, tagName)
+}
+
+// tagName checks if r is valid in the name part of a tag key.
+func tagName(i int, r rune) bool {
+	return Letter(i, r) || Digit(i, r) || r == '-'
+}
+
+// hostname checks if r is valid in a hostname.
+func hostname(i int, r rune) bool {
+	return Letter(i, r) || Digit(i, r) || r == '-' || r == '.'
+}
+
+// IsClientOnlyTag checks if key is a client-only tag.
+func IsClientOnlyTag(key string) bool {
+	return strings.HasPrefix(key, ClientOnlyTagPrefix)
+}
+
+// ClientOnly returns the client-only tags in t. If there are none, nil is
+// returned.
+func (t Tags) ClientOnly() Tags {
+	var clientOnly Tags
+	for key, value := range t {
+		if !IsClientOnlyTag(key) {
+			continue
+		}
+
+		if clientOnly == nil {
+			clientOnly = make(Tags)
+		}
+		clientOnly[key] = value
+	}
+
+	return clientOnly
+}
+
+// String returns the tags as they're sent on the wire, without the leading
+// "@". Tags are sorted by key.
+func (t Tags) String() string {
+	keys := make([]string, 0, len(t))
+	for key := range t {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	tags := make([]string, len(keys))
+	for i, key := range keys {
+		if value := t[key]; len(value) > 0 {
+			tags[i] = key + "=" + EscapeTagValue(value)
+		} else {
+			tags[i] = key
+		}
+	}
+
+	return strings.Join(tags, ";")
+}
+
+var tagValueEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\:`,
+	" ", `\s`,
+	"\r", `\r`,
+	"\n", `\n`,
+)
+
+// EscapeTagValue escapes value so that it may be sent as a tag value.
+func EscapeTagValue(value string) string {
+	return tagValueEscaper.Replace(value)
+}
+
+// UnescapeTagValue reverses EscapeTagValue. Unknown escape sequences are
+// replaced by the escaped character and a trailing "\" is dropped.
+func UnescapeTagValue(value string) string {
+	if strings.IndexByte(value, '\\') < 0 {
+		return value
+	}
+
+	var unescaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			unescaped.WriteByte(value[i])
+			continue
+		}
+
+		i++
+		if i >= len(value) {
+			break
+		}
+
+		switch value[i] {
+		case ':':
+			unescaped.WriteByte(';')
+		case 's':
+			unescaped.WriteByte(' ')
+		case 'r':
+			unescaped.WriteByte('\r')
+		case 'n':
+			unescaped.WriteByte('\n')
+		default:
+			unescaped.WriteByte(value[i])
+		}
+	}
+
+	return unescaped.String()
+}
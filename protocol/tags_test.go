@@ -0,0 +1,73 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package protocol_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nightexcessive/excessiveircd/protocol"
+)
+
+func TestSplitTags(t *testing.T) {
+	tags, rest, err := protocol.SplitTags(`@+example.com/foo=a\sb\:c;msgid;+bar=1;+bar=2 PRIVMSG #chan :hi`, protocol.MaximumClientTagsLen)
+	if err != nil {
+		t.Fatalf("Error splitting tags: %s", err)
+	}
+
+	expected := protocol.Tags{"+example.com/foo": "a b;c", "msgid": "", "+bar": "2"}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Errorf("Expected tags %v, got %v", expected, tags)
+	}
+	if rest != "PRIVMSG #chan :hi" {
+		t.Errorf("Unexpected rest of message: %q", rest)
+	}
+}
+
+func TestSplitTags_Untagged(t *testing.T) {
+	tags, rest, err := protocol.SplitTags("PRIVMSG #chan :hi", protocol.MaximumClientTagsLen)
+	if err != nil || tags != nil || rest != "PRIVMSG #chan :hi" {
+		t.Errorf("Expected the line to be returned unchanged, got %v, %q, %v", tags, rest, err)
+	}
+}
+
+func TestSplitTags_TooLong(t *testing.T) {
+	line := "@+a=" + strings.Repeat("x", protocol.MaximumClientTagsLen) + " TAGMSG #chan"
+	if _, _, err := protocol.SplitTags(line, protocol.MaximumClientTagsLen); err != protocol.ErrTagsTooLong {
+		t.Errorf("Expected ErrTagsTooLong, got %v", err)
+	}
+}
+
+func TestParseTags_InvalidKey(t *testing.T) {
+	for _, raw := range []string{"a b", "+", "/foo", "vendor/", "a_b"} {
+		if _, err := protocol.ParseTags(raw); err != protocol.ErrInvalidTag {
+			t.Errorf("Expected ErrInvalidTag for %q, got %v", raw, err)
+		}
+	}
+}
+
+func TestUnescapeTagValue(t *testing.T) {
+	tests := map[string]string{
+		`a\sb`:     "a b",
+		`\:\\\r\n`: ";\\\r\n",
+		`\b`:       "b",
+		`trail\`:   "trail",
+	}
+
+	for escaped, expected := range tests {
+		if actual := protocol.UnescapeTagValue(escaped); actual != expected {
+			t.Errorf("UnescapeTagValue(%q): expected %q, got %q", escaped, expected, actual)
+		}
+	}
+}
+
+func TestTags_String(t *testing.T) {
+	tags := protocol.Tags{"b": "x y;z", "a": "", "+c": `\`}
+	if expected, actual := `+c=\\;a;b=x\sy\:z`, tags.String(); actual != expected {
+		t.Errorf("Expected %q, got %q", expected, actual)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/nightexcessive/excessiveircd/config"
+	"github.com/nightexcessive/excessiveircd/protocol"
+)
+
+const (
+	// passwordIterations is the number of PBKDF2 iterations used for new
+	// password hashes. Existing hashes keep the count that they were made
+	// with, so it can be raised without invalidating them.
+	passwordIterations = 600000
+
+	passwordSaltLength = 16
+	passwordHashLength = sha256.Size
+)
+
+// dummyAccount is checked instead when someone tries to log into an account
+// that doesn't exist or has no password, so that it takes as long as logging
+// into one that does. Otherwise the time taken would reveal which accounts
+// exist.
+var dummyAccount = &Account{
+	PasswordHash:       make([]byte, passwordHashLength),
+	PasswordSalt:       make([]byte, passwordSaltLength),
+	PasswordIterations: passwordIterations,
+}
+
+// Account represents a user account. Accounts are stored in the configuration
+// under "accounts/<name>".
+type Account struct {
+	Name string
+
+	// PasswordHash is the PBKDF2-SHA256 hash of the account's password,
+	// derived using PasswordSalt and PasswordIterations. If it's empty, the
+	// account can't be logged into with a password.
+	PasswordHash       []byte
+	PasswordSalt       []byte
+	PasswordIterations int
+
+	// CertFingerprints holds the hex-encoded SHA-256 fingerprints of the TLS
+	// client certificates that may be used to log into the account.
+	CertFingerprints []string
+}
+
+// ErrInvalidAccountName is returned when an account name can't be used as a
+// configuration key.
+var ErrInvalidAccountName = errors.New("invalid account name")
+
+func accountKey(name string) string {
+	return "accounts/" + strings.ToLower(name)
+}
+
+func certFingerprintKey(fingerprint string) string {
+	return "certfps/" + fingerprint
+}
+
+// LoadAccount loads the named account from the configuration. If the account
+// doesn't exist, config.ErrDoesNotExist is returned.
+func LoadAccount(name string) (*Account, error) {
+	if len(name) == 0 || !protocol.IsValid(name, protocol.Nickname) {
+		return nil, ErrInvalidAccountName
+	}
+
+	account := new(Account)
+	if err := config.Get(accountKey(name), account); err != nil {
+		return nil, err
+	}
+
+	return account, nil
+}
+
+// LoadAccountByCertFingerprint loads the account that the given TLS client
+// certificate fingerprint belongs to. If there is none,
+// config.ErrDoesNotExist is returned.
+func LoadAccountByCertFingerprint(fingerprint string) (*Account, error) {
+	if _, err := hex.DecodeString(fingerprint); err != nil || len(fingerprint) == 0 {
+		return nil, config.ErrDoesNotExist
+	}
+
+	var name string
+	if err := config.Get(certFingerprintKey(fingerprint), &name); err != nil {
+		return nil, err
+	}
+
+	return LoadAccount(name)
+}
+
+// SaveAccount saves account to the configuration, along with an index of its
+// certificate fingerprints. Fingerprints that the saved account no longer has
+// are removed from the index.
+func SaveAccount(account *Account) error {
+	if len(account.Name) == 0 || !protocol.IsValid(account.Name, protocol.Nickname) {
+		return ErrInvalidAccountName
+	}
+
+	previous := new(Account)
+	if err := config.Get(accountKey(account.Name), previous); err != nil && err != config.ErrDoesNotExist {
+		return err
+	}
+
+	for i, fingerprint := range account.CertFingerprints {
+		fingerprint = strings.ToLower(fingerprint)
+		if _, err := hex.DecodeString(fingerprint); err != nil {
+			return err
+		}
+		account.CertFingerprints[i] = fingerprint
+
+		if err := config.Set(certFingerprintKey(fingerprint), account.Name); err != nil {
+			return err
+		}
+	}
+
+	for _, fingerprint := range previous.CertFingerprints {
+		if account.HasCertFingerprint(fingerprint) {
+			continue
+		}
+
+		// The fingerprint may have been given to another account since.
+		var name string
+		if err := config.Get(certFingerprintKey(fingerprint), &name); err == nil && strings.EqualFold(name, account.Name) {
+			if err := config.Delete(certFingerprintKey(fingerprint)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return config.Set(accountKey(account.Name), account)
+}
+
+// SetPassword sets the account's password. It doesn't save the account.
+func (a *Account) SetPassword(password string) error {
+	salt := make([]byte, passwordSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	hash, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, passwordHashLength)
+	if err != nil {
+		return err
+	}
+
+	a.PasswordHash = hash
+	a.PasswordSalt = salt
+	a.PasswordIterations = passwordIterations
+	return nil
+}
+
+// CheckPassword checks if password is the account's password.
+func (a *Account) CheckPassword(password string) bool {
+	if len(a.PasswordHash) == 0 || a.PasswordIterations <= 0 {
+		dummyAccount.CheckPassword(password)
+		return false
+	}
+
+	hash, err := pbkdf2.Key(sha256.New, password, a.PasswordSalt, a.PasswordIterations, len(a.PasswordHash))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(hash, a.PasswordHash) == 1
+}
+
+// HasCertFingerprint checks if the account may be logged into with the TLS
+// client certificate that has the given fingerprint.
+func (a *Account) HasCertFingerprint(fingerprint string) bool {
+	for _, f := range a.CertFingerprints {
+		if f == fingerprint {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CertFingerprint returns the hex-encoded SHA-256 fingerprint of the client's
+// TLS certificate. If the client isn't using TLS or didn't present a
+// certificate, an empty string is returned.
+func (c *Client) CertFingerprint() string {
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	certificates := tlsConn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256(certificates[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"flag"
+	"testing"
+
+	"github.com/nightexcessive/excessiveircd/config"
+)
+
+// useTestConfig points the configuration at a temporary directory for the
+// duration of the test.
+func useTestConfig(t *testing.T) {
+	dir := flag.Lookup("config.directory")
+	previous := dir.Value.String()
+	if err := flag.Set("config.directory", t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flag.Set("config.directory", previous) })
+}
+
+func TestAccount_Password(t *testing.T) {
+	a := &Account{Name: "alice"}
+	if a.CheckPassword("") {
+		t.Error("An account without a password accepted an empty one")
+	}
+
+	if err := a.SetPassword("hunter2"); err != nil {
+		t.Fatalf("Error setting password: %s", err)
+	}
+	if !a.CheckPassword("hunter2") {
+		t.Error("The correct password was rejected")
+	}
+	if a.CheckPassword("hunter3") {
+		t.Error("An incorrect password was accepted")
+	}
+
+	b := &Account{Name: "bob"}
+	if err := b.SetPassword("hunter2"); err != nil {
+		t.Fatalf("Error setting password: %s", err)
+	}
+	if bytes.Equal(a.PasswordSalt, b.PasswordSalt) || bytes.Equal(a.PasswordHash, b.PasswordHash) {
+		t.Error("Two accounts with the same password have the same salt or hash")
+	}
+}
+
+func TestAccount_SaveLoad(t *testing.T) {
+	useTestConfig(t)
+
+	const fingerprint = "0123456789abcdef"
+
+	account := &Account{Name: "Alice", CertFingerprints: []string{"0123456789ABCDEF"}}
+	if err := account.SetPassword("hunter2"); err != nil {
+		t.Fatalf("Error setting password: %s", err)
+	}
+	if err := SaveAccount(account); err != nil {
+		t.Fatalf("Error saving account: %s", err)
+	}
+
+	loaded, err := LoadAccount("alice")
+	if err != nil {
+		t.Fatalf("Error loading account: %s", err)
+	}
+	if loaded.Name != "Alice" {
+		t.Errorf("Loaded account is named %q, want %q", loaded.Name, "Alice")
+	}
+	if !loaded.CheckPassword("hunter2") {
+		t.Error("The loaded account rejected its password")
+	}
+	if !loaded.HasCertFingerprint(fingerprint) {
+		t.Errorf("The loaded account doesn't have fingerprint %s", fingerprint)
+	}
+
+	loaded, err = LoadAccountByCertFingerprint(fingerprint)
+	if err != nil {
+		t.Fatalf("Error loading account by fingerprint: %s", err)
+	}
+	if loaded.Name != "Alice" {
+		t.Errorf("Fingerprint loaded account %q, want %q", loaded.Name, "Alice")
+	}
+
+	loaded.CertFingerprints = []string{"fedcba9876543210"}
+	if err := SaveAccount(loaded); err != nil {
+		t.Fatalf("Error saving account: %s", err)
+	}
+	if _, err := LoadAccountByCertFingerprint(fingerprint); err != config.ErrDoesNotExist {
+		t.Errorf("Loading by a removed fingerprint returned %v, want %v", err, config.ErrDoesNotExist)
+	}
+	if loaded, err = LoadAccountByCertFingerprint("fedcba9876543210"); err != nil || loaded.Name != "Alice" {
+		t.Errorf("Loading by the new fingerprint returned %v, %v", loaded, err)
+	}
+
+	if _, err := LoadAccount("bob"); err != config.ErrDoesNotExist {
+		t.Errorf("Loading a missing account returned %v, want %v", err, config.ErrDoesNotExist)
+	}
+	if _, err := LoadAccount("../alice"); err != ErrInvalidAccountName {
+		t.Errorf("Loading an invalid account name returned %v, want %v", err, ErrInvalidAccountName)
+	}
+	if err := SaveAccount(&Account{Name: "a/b"}); err != ErrInvalidAccountName {
+		t.Errorf("Saving an invalid account name returned %v, want %v", err, ErrInvalidAccountName)
+	}
+}
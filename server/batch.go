@@ -0,0 +1,121 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/nightexcessive/excessiveircd/protocol"
+)
+
+const (
+	capBatch = "batch"
+
+	// batchTag is the tag that marks a message as part of a batch.
+	batchTag = "batch"
+)
+
+// Batch types that the server sends.
+const (
+	batchLabeledResponse    = "labeled-response"
+	batchChatHistory        = "chathistory"
+	batchChatHistoryTargets = "draft/chathistory-targets"
+)
+
+func init() {
+	registerCapability(&Capability{Name: capBatch})
+
+	registerTag(batchTag, capBatch)
+}
+
+// Batch is a group of replies that's being sent to a client. Batches are
+// opened with startBatch and must be closed with End.
+type Batch struct {
+	client *Client
+
+	// Ref is the batch's reference tag. It's empty if the client can't
+	// receive batches, in which case the replies are sent as they are.
+	Ref string
+}
+
+// startBatch opens a batch of the given type with params. Until End is called,
+// every reply to the client's current command is part of the batch. A batch
+// that's opened while another is open is nested inside it.
+//
+// Only replies that are written with writeLine join the batch. Lines that other
+// clients cause, such as relayed messages and MONITOR notifications, are
+// written outside of it even if they're sent while it's open.
+func (c *Client) startBatch(kind string, params ...string) *Batch {
+	b := &Batch{client: c}
+	if !c.HasCapability(capBatch) {
+		return b
+	}
+
+	b.Ref = c.newBatchRef()
+
+	line := ":" + c.Server.FriendlyName() + " " + BATCH + " +" + b.Ref + " " + kind
+	if len(params) > 0 {
+		line += " " + strings.Join(params, " ")
+	}
+	c.writeLine(nil, line)
+
+	c.Lock()
+	c.batches = append(c.batches, b.Ref)
+	c.Unlock()
+
+	return b
+}
+
+// End closes the batch and any batches that were nested inside it and left
+// open.
+func (b *Batch) End() {
+	if len(b.Ref) == 0 {
+		return
+	}
+
+	c := b.client
+
+	c.Lock()
+	var closing []string
+	for i := len(c.batches) - 1; i >= 0; i-- {
+		if c.batches[i] == b.Ref {
+			closing = c.batches[i:]
+			c.batches = c.batches[:i]
+			break
+		}
+	}
+	c.Unlock()
+
+	// Each end line must be part of the batch that encloses the one it ends,
+	// so they're written after the batches have been removed.
+	for i := len(closing) - 1; i >= 0; i-- {
+		var tags protocol.Tags
+		if i > 0 {
+			tags = protocol.Tags{batchTag: closing[i-1]}
+		}
+		c.writeLine(tags, ":"+c.Server.FriendlyName()+" "+BATCH+" -"+closing[i])
+	}
+}
+
+// currentBatch returns the reference tag of the innermost open batch, or an
+// empty string if no batch is open.
+func (c *Client) currentBatch() string {
+	c.RLock()
+	defer c.RUnlock()
+
+	if len(c.batches) == 0 {
+		return ""
+	}
+
+	return c.batches[len(c.batches)-1]
+}
+
+// newBatchRef returns a batch reference tag that's unique to the client.
+func (c *Client) newBatchRef() string {
+	return strconv.FormatUint(atomic.AddUint64(&c.lastBatchRef, 1), 36)
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+// newBatchTestClient returns a client that queues its output without being
+// connected to anything.
+func newBatchTestClient(capabilities ...string) *Client {
+	c := &Client{
+		Server:       &Server{Name: "irc.test"},
+		Capabilities: make(map[string]bool),
+		sendQ:        make(chan string, sendQLength),
+		RWMutex:      new(sync.RWMutex),
+	}
+	for _, name := range capabilities {
+		c.Capabilities[name] = true
+	}
+
+	return c
+}
+
+// queued returns the lines that have been queued for c.
+func queued(c *Client) []string {
+	var lines []string
+	for {
+		select {
+		case line := <-c.sendQ:
+			lines = append(lines, line)
+		default:
+			return lines
+		}
+	}
+}
+
+func TestBatch_Nested(t *testing.T) {
+	c := newBatchTestClient(capBatch)
+
+	outer := c.startBatch("netjoin", "a", "b")
+	c.writeLine(nil, "one")
+	inner := c.startBatch("example")
+	c.writeLine(nil, "two")
+	inner.End()
+	c.writeLine(nil, "three")
+	outer.End()
+	c.writeLine(nil, "four")
+
+	expected := []string{
+		":irc.test BATCH +1 netjoin a b",
+		"@batch=1 one",
+		"@batch=1 :irc.test BATCH +2 example",
+		"@batch=2 two",
+		"@batch=1 :irc.test BATCH -2",
+		"@batch=1 three",
+		":irc.test BATCH -1",
+		"four",
+	}
+	if lines := queued(c); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+}
+
+func TestBatch_EndClosesNested(t *testing.T) {
+	c := newBatchTestClient(capBatch)
+
+	outer := c.startBatch("a")
+	c.startBatch("b")
+	outer.End()
+
+	expected := []string{
+		":irc.test BATCH +1 a",
+		"@batch=1 :irc.test BATCH +2 b",
+		"@batch=1 :irc.test BATCH -2",
+		":irc.test BATCH -1",
+	}
+	if lines := queued(c); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+}
+
+func TestBatch_WithoutCapability(t *testing.T) {
+	c := newBatchTestClient()
+
+	b := c.startBatch("netjoin")
+	c.writeLine(nil, "one")
+	b.End()
+
+	if lines, expected := queued(c), []string{"one"}; !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+}
+
+func TestBatch_Unsolicited(t *testing.T) {
+	c := newBatchTestClient(capBatch)
+	c.Info.Prefix = &irc.Prefix{Name: "alice"}
+
+	b := c.startBatch("example")
+	c.unsolicitedNumeric(RPL_MONOFFLINE, "bob")
+	c.writeLine(nil, "one")
+	b.End()
+
+	expected := []string{
+		":irc.test BATCH +1 example",
+		":irc.test " + RPL_MONOFFLINE + " alice :bob",
+		"@batch=1 one",
+		":irc.test BATCH -1",
+	}
+	if lines := queued(c); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+}
+
+func TestResponse_Unsolicited(t *testing.T) {
+	c := newBatchTestClient(capBatch, capLabeledResponse)
+	c.Info.Prefix = &irc.Prefix{Name: "alice"}
+
+	c.startResponse("abc")
+	c.numeric(RPL_ENDOFMONLIST, "End of MONITOR list")
+	c.unsolicitedNumeric(RPL_MONONLINE, "bob!bob@localhost")
+	c.finishResponse()
+
+	expected := []string{
+		":irc.test " + RPL_MONONLINE + " alice :bob!bob@localhost",
+		"@label=abc :irc.test " + RPL_ENDOFMONLIST + " alice :End of MONITOR list",
+	}
+	if lines := queued(c); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+}
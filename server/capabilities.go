@@ -0,0 +1,220 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sorcix/irc"
+)
+
+// Capability represents an IRCv3 capability that clients may enable with CAP
+// REQ.
+type Capability struct {
+	Name string
+
+	// Value returns the capability's value, which is only advertised to
+	// clients that use CAP version 302 or later. If Value is nil or returns an
+	// empty string, the capability is advertised without a value.
+	Value func(s *Server) string
+}
+
+var capabilities = make(map[string]*Capability)
+
+// registerCapability registers a capability. Each feature registers the
+// capabilities that it implements from its init function.
+func registerCapability(capability *Capability) {
+	if _, ok := capabilities[capability.Name]; ok {
+		panic("server: capability registered twice: " + capability.Name)
+	}
+
+	capabilities[capability.Name] = capability
+}
+
+const capNotify = "cap-notify"
+
+func init() {
+	registerCapability(&Capability{Name: capNotify})
+}
+
+// HasCapability checks if c has enabled the named capability.
+func (c *Client) HasCapability(name string) bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.Capabilities[name]
+}
+
+// capabilityList returns the advertisement of every registered capability,
+// sorted by name. Values are only included for CAP version 302 or later.
+func (s *Server) capabilityList(version int) []string {
+	names := make([]string, 0, len(capabilities))
+	for name := range capabilities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]string, 0, len(names))
+	for _, name := range names {
+		capability := capabilities[name]
+		if version >= 302 && capability.Value != nil {
+			if value := capability.Value(s); len(value) > 0 {
+				name += "=" + value
+			}
+		}
+		list = append(list, name)
+	}
+
+	return list
+}
+
+// sendCapList sends list to c as the given CAP subcommand. Clients that use
+// CAP version 302 or later have long lists split over multiple lines.
+func (c *Client) sendCapList(subcommand string, list []string) {
+	// :server CAP nick subcommand * :list
+	maxLength := 510 - len(fmt.Sprintf(":%s %s %s %s * :", c.Server.FriendlyName(), CAP, c.Info.Name, subcommand))
+
+	var lines []string
+	line := ""
+	for _, item := range list {
+		if c.CapVersion >= 302 && len(line) > 0 && len(line)+1+len(item) > maxLength {
+			lines = append(lines, line)
+			line = ""
+		}
+
+		if len(line) > 0 {
+			line += " "
+		}
+		line += item
+	}
+	lines = append(lines, line)
+
+	for i, line := range lines {
+		params := []string{c.Info.Name, subcommand}
+		if i < len(lines)-1 {
+			params = append(params, "*")
+		}
+		params = append(params, line)
+
+		c.writeMessage(&irc.Message{
+			Prefix:  &irc.Prefix{Name: c.Server.FriendlyName()},
+			Command: CAP,
+			Params:  params,
+		})
+	}
+}
+
+func cmdCap(c *Client, m *Message) *CommandError {
+	subcommand := strings.ToUpper(m.Params[0])
+
+	switch subcommand {
+	case "LS":
+		if !c.Registered {
+			c.capNegotiating = true
+		}
+
+		if len(m.Params) > 1 {
+			if version, err := strconv.Atoi(m.Params[1]); err == nil && version > c.CapVersion {
+				c.CapVersion = version
+			}
+		}
+		if c.CapVersion >= 302 {
+			// Version 302 implicitly enables cap-notify.
+			c.Lock()
+			c.Capabilities[capNotify] = true
+			c.Unlock()
+		}
+
+		c.sendCapList(subcommand, c.Server.capabilityList(c.CapVersion))
+	case "LIST":
+		var enabled []string
+		c.RLock()
+		for name := range c.Capabilities {
+			enabled = append(enabled, name)
+		}
+		c.RUnlock()
+		sort.Strings(enabled)
+
+		c.sendCapList(subcommand, enabled)
+	case "REQ":
+		if !c.Registered {
+			c.capNegotiating = true
+		}
+
+		var requested string
+		if len(m.Params) > 1 {
+			requested = m.Params[1]
+		}
+
+		reply := "ACK"
+		if !c.requestCapabilities(strings.Fields(requested)) {
+			reply = "NAK"
+		}
+
+		c.writeMessage(&irc.Message{
+			Prefix:  &irc.Prefix{Name: c.Server.FriendlyName()},
+			Command: CAP,
+			Params:  []string{c.Info.Name, reply, requested},
+		})
+	case "END":
+		if c.Registered || !c.capNegotiating {
+			return nil
+		}
+
+		c.capNegotiating = false
+		return c.register()
+	default:
+		return &CommandError{ERR_INVALIDCAPCMD, []string{m.Params[0], "Invalid CAP command"}}
+	}
+
+	return nil
+}
+
+// requestCapabilities enables or disables the requested capabilities. A
+// capability prefixed with "-" is disabled. If any of the requests can't be
+// fulfilled, none of them are applied and false is returned.
+func (c *Client) requestCapabilities(requested []string) bool {
+	if len(requested) == 0 {
+		return false
+	}
+
+	changes := make(map[string]bool, len(requested))
+	for _, name := range requested {
+		enable := true
+		if strings.HasPrefix(name, "-") {
+			name = name[1:]
+			enable = false
+		}
+
+		if _, ok := capabilities[name]; !ok {
+			return false
+		}
+
+		if name == capNotify && !enable && c.CapVersion >= 302 {
+			// cap-notify can't be disabled by clients that enabled it
+			// implicitly.
+			return false
+		}
+
+		changes[name] = enable
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	for name, enable := range changes {
+		if enable {
+			c.Capabilities[name] = true
+		} else {
+			delete(c.Capabilities, name)
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"unicode/utf8"
+
+	"github.com/nightexcessive/excessiveircd/protocol"
+)
+
+// DefaultCasemapping is the casemapping that's used if one isn't set in the
+// configuration. DefaultUTF8Casemapping is used instead if the server allows
+// UTF-8 nicknames and channel names.
+const (
+	DefaultCasemapping     = "rfc1459"
+	DefaultUTF8Casemapping = "rfc8265"
+)
+
+func init() {
+	registerISupport("CASEMAPPING", func(s *Server) (string, bool) {
+		return s.Casemapping, len(s.Casemapping) > 0
+	})
+	registerISupport("UTF8ONLY", func(s *Server) (string, bool) {
+		return "", s.UTF8
+	})
+}
+
+// isNickname checks if name is a valid nickname on the server.
+func (s *Server) isNickname(name string) bool {
+	if s.UTF8 {
+		return protocol.IsValid(name, protocol.UnicodeNickname) && protocol.IsPRECIS(name)
+	}
+
+	return protocol.IsValid(name, protocol.Nickname)
+}
+
+// isChannelName checks if name is a valid channel name on the server.
+func (s *Server) isChannelName(name string) bool {
+	if len(name) < 2 {
+		return false
+	}
+	if s.UTF8 {
+		return protocol.IsValid(name, protocol.UnicodeChannel)
+	}
+
+	return protocol.IsValid(name, protocol.Channel)
+}
+
+// fold folds name with the server's casemapping. The maps of clients, channels
+// and monitored nicknames are keyed by folded names.
+func (s *Server) fold(name string) string {
+	return protocol.Casemappings[s.Casemapping](name)
+}
+
+// nickInUse checks if c can't take nick because another client is using it. If
+// the server allows UTF-8 nicknames, nicknames that look like one that's in use
+// are refused too, so that nobody can impersonate anyone with homoglyphs. Two
+// ASCII nicknames are never refused for looking alike, since IRC has always
+// allowed ones like bob1 and bobl.
+func (s *Server) nickInUse(c *Client, nick string) bool {
+	folded := s.fold(nick)
+	if other, ok := s.Clients[folded]; ok && other != c {
+		return true
+	}
+	if !s.UTF8 {
+		return false
+	}
+
+	skeleton := protocol.Skeleton(folded)
+	ascii := isASCII(folded)
+	for key, other := range s.Clients {
+		if other == c || (ascii && isASCII(key)) {
+			continue
+		}
+		if protocol.Skeleton(key) == skeleton {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isASCII checks if name only contains ASCII characters.
+func isASCII(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
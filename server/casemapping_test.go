@@ -0,0 +1,73 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+// newUTF8TestServer returns a server that allows UTF-8 nicknames and channel
+// names.
+func newUTF8TestServer() *Server {
+	s := newLinkTestServer("irc.test")
+	s.UTF8 = true
+	s.Casemapping = DefaultUTF8Casemapping
+
+	return s
+}
+
+func TestNickInUse_Confusables(t *testing.T) {
+	s := newUTF8TestServer()
+	admin := newLinkTestClient(t, s, "admin")
+
+	for _, nick := range []string{"ADMIN", "аdmin", "ａｄｍｉｎ"} {
+		c := &Client{Server: s}
+		c.Info.Prefix = &irc.Prefix{Name: nick}
+
+		reply := make(chan bool)
+		s.Events <- &SRegisterClient{c, reply}
+		if <-reply {
+			t.Errorf("%q was registered while admin was in use", nick)
+		}
+	}
+
+	// ASCII nicknames may look alike.
+	newLinkTestClient(t, s, "bobl")
+	newLinkTestClient(t, s, "bob1")
+	c := &Client{Server: s}
+	c.Info.Prefix = &irc.Prefix{Name: "b\u043ebl"} // Cyrillic o
+	reply := make(chan bool)
+	s.Events <- &SRegisterClient{c, reply}
+	if <-reply {
+		t.Error("b\u043ebl was registered while bobl was in use")
+	}
+
+	// Clients may change their own nicknames to ones that look the same.
+	s.Events <- &SChangeNick{"аdmin", admin, reply}
+	if !<-reply {
+		t.Error("admin couldn't change to a confusable nickname")
+	}
+}
+
+func TestCasemapping_ConfusableChannels(t *testing.T) {
+	s := newUTF8TestServer()
+	alice := newLinkTestClient(t, s, "alice")
+	bob := newLinkTestClient(t, s, "bob")
+
+	if err := linkTestCommand(alice, irc.JOIN, "#test1"); err != nil {
+		t.Fatalf("Couldn't join: %s", err)
+	}
+	if err := linkTestCommand(bob, irc.JOIN, "#testl"); err != nil {
+		t.Fatalf("Couldn't join: %s", err)
+	}
+
+	if names := expectLine(t, bob, " "+irc.RPL_NAMREPLY+" "); strings.Contains(names, "alice") {
+		t.Errorf("#test1 and #testl are the same channel: %q", names)
+	}
+}
@@ -0,0 +1,404 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nightexcessive/excessiveircd/protocol"
+	"github.com/sorcix/irc"
+)
+
+// MaximumTopicLen specifies the maximum length that a channel topic may be.
+// Longer topics are truncated.
+const MaximumTopicLen = 390
+
+// MaximumKickLen specifies the maximum length that a kick reason may be.
+// Longer reasons are truncated.
+const MaximumKickLen = 255
+
+func init() {
+	registerISupport("CHANTYPES", isupportValue(protocol.ChannelTypes))
+	registerISupport("CHANNELLEN", isupportValue(strconv.Itoa(protocol.MaximumChannelLen)))
+	registerISupport("TOPICLEN", isupportValue(strconv.Itoa(MaximumTopicLen)))
+	registerISupport("KICKLEN", isupportValue(strconv.Itoa(MaximumKickLen)))
+}
+
+// Channel represents a channel. Channels are owned by the Server's event loop
+// and must only be accessed from it.
+type Channel struct {
+	Name string
+
+	Topic struct {
+		Text string
+
+		// The nickname of the client that set the topic and the time at which
+		// it was set.
+		SetBy   string
+		SetTime time.Time
+	}
+
+	// The time at which the channel was created.
+	CreateTime time.Time
+
+	// Modes holds the flag modes that are set on the channel.
+	Modes map[byte]bool
+
+	// Lists holds the entries in each of the channel's list modes, such as its
+	// bans.
+	Lists map[byte][]ListEntry
+
+	// LastKnock is the time at which someone last used KNOCK on the channel.
+	LastKnock time.Time
+
+	// Key is the key that must be given to join the channel, and Limit is the
+	// maximum number of members that it may have. They're unset if they're
+	// empty or 0.
+	Key   string
+	Limit int
+
+	Members map[*Client]*Member
+}
+
+// Member represents a client's membership in a channel.
+type Member struct {
+	Client *Client
+
+	// The time at which the client joined the channel.
+	JoinTime time.Time
+
+	// Privileges holds the member's privileges in the channel.
+	Privileges Privilege
+}
+
+func newChannel(name string) *Channel {
+	channel := &Channel{
+		Name:       name,
+		CreateTime: time.Now(),
+		Modes:      make(map[byte]bool),
+		Lists:      make(map[byte][]ListEntry),
+		Members:    make(map[*Client]*Member),
+	}
+	for i := 0; i < len(defaultChannelModes); i++ {
+		channel.Modes[defaultChannelModes[i]] = true
+	}
+
+	return channel
+}
+
+// send sends m with tags, which was sent by from, to every member of the
+// channel except for except, which may be nil.
+func (ch *Channel) send(from *Client, tags protocol.Tags, m *irc.Message, except *Client) {
+	for member := range ch.Members {
+		if member == except {
+			continue
+		}
+		member.relay(from, tags, m)
+	}
+}
+
+// peers returns every client that shares at least one channel with c, not
+// including c itself. It must only be called from the Server's event loop.
+func (c *Client) peers() map[*Client]struct{} {
+	peers := make(map[*Client]struct{})
+	for _, channel := range c.Channels {
+		for member := range channel.Members {
+			if member != c {
+				peers[member] = struct{}{}
+			}
+		}
+	}
+
+	return peers
+}
+
+// joinChannel adds c to the named channel, creating it if it doesn't exist. key
+// is the key that c gave, if any.
+func (s *Server) joinChannel(c *Client, name, key string) *CommandError {
+	channel, ok := s.Channels[s.fold(name)]
+	created := !ok
+	if created {
+		channel = newChannel(name)
+		s.Channels[s.fold(name)] = channel
+	}
+
+	if _, ok := channel.Members[c]; ok {
+		return nil
+	}
+
+	if err := s.checkJoin(c, channel, key); err != nil {
+		return err
+	}
+
+	member := &Member{
+		Client:   c,
+		JoinTime: time.Now(),
+	}
+	if len(channel.Members) == 0 {
+		// Whoever creates a channel is its operator.
+		member.Privileges = Operator
+	}
+	channel.Members[c] = member
+	c.Channels[s.fold(name)] = channel
+	delete(c.Invited, channel)
+
+	channel.send(c, c.relayTags(nil), &irc.Message{
+		Prefix:  c.Info.Prefix,
+		Command: irc.JOIN,
+		Params:  []string{channel.Name},
+	}, nil)
+
+	// Other servers only need the channel's modes if it's new.
+	modes := []string{"+"}
+	if created {
+		modes = channel.modeString(true)
+	}
+	s.propagate(nil, s.sjoinLine(channel, modes, []string{member.Privileges.Prefixes(true) + c.ID.String()}))
+
+	if len(channel.Topic.Text) > 0 {
+		s.sendTopic(c, channel)
+	}
+	s.sendNames(c, channel.Name)
+
+	return nil
+}
+
+// kick removes target from the channel named name on c's behalf.
+func (s *Server) kick(c *Client, name, nick, reason string) *CommandError {
+	channel, ok := s.Channels[s.fold(name)]
+	if !ok {
+		return &CommandError{irc.ERR_NOSUCHCHANNEL, []string{name, "No such channel"}}
+	}
+
+	if _, ok := channel.Members[c]; !ok {
+		return &CommandError{irc.ERR_NOTONCHANNEL, []string{name, "You're not on that channel"}}
+	}
+
+	target, ok := s.Clients[s.fold(nick)]
+	if !ok {
+		return &CommandError{irc.ERR_NOSUCHNICK, []string{nick, "No such nick/channel"}}
+	}
+	if _, ok := channel.Members[target]; !ok {
+		return &CommandError{irc.ERR_USERNOTINCHANNEL, []string{nick, name, "They aren't on that channel"}}
+	}
+
+	if !channel.canKick(c, target) {
+		return &CommandError{irc.ERR_CHANOPRIVSNEEDED, []string{name, "You're not channel operator"}}
+	}
+
+	s.kickMember(c, channel, target, reason)
+	return nil
+}
+
+// kickMember removes target from channel on c's behalf and tells everyone
+// about it, without checking that c may.
+func (s *Server) kickMember(c *Client, channel *Channel, target *Client, reason string) {
+	if len(reason) == 0 {
+		reason = c.Info.Name
+	}
+	if len(reason) > MaximumKickLen {
+		reason = reason[:MaximumKickLen]
+	}
+
+	channel.send(c, c.relayTags(nil), &irc.Message{
+		Prefix:  c.Info.Prefix,
+		Command: irc.KICK,
+		Params:  []string{channel.Name, target.Info.Name, reason},
+	}, nil)
+	s.propagate(c.link(), linkLine(c.ID.String(), irc.KICK, channel.Name, target.ID.String(), reason))
+
+	s.removeMember(channel, target)
+}
+
+// checkJoin checks that the modes of ch allow c to join it with key. Members of
+// the invite exception list may join invite-only channels, and clients that
+// have been invited may join past the invite-only, key and limit modes.
+func (s *Server) checkJoin(c *Client, ch *Channel, key string) *CommandError {
+	if s.isBanned(ch, c, false) {
+		return &CommandError{irc.ERR_BANNEDFROMCHAN, []string{ch.Name, "Cannot join channel (+b)"}}
+	}
+	if c.isInvited(ch) {
+		return nil
+	}
+	if ch.Modes['i'] && !s.matchesList(ch, 'I', c, false) {
+		return &CommandError{irc.ERR_INVITEONLYCHAN, []string{ch.Name, "Cannot join channel (+i)"}}
+	}
+	if len(ch.Key) > 0 && key != ch.Key {
+		return &CommandError{irc.ERR_BADCHANNELKEY, []string{ch.Name, "Cannot join channel (+k)"}}
+	}
+	if ch.Limit > 0 && len(ch.Members) >= ch.Limit {
+		return &CommandError{irc.ERR_CHANNELISFULL, []string{ch.Name, "Cannot join channel (+l)"}}
+	}
+
+	return nil
+}
+
+func (s *Server) partChannel(c *Client, name, reason string) *CommandError {
+	channel, ok := s.Channels[s.fold(name)]
+	if !ok {
+		return &CommandError{irc.ERR_NOSUCHCHANNEL, []string{name, "No such channel"}}
+	}
+
+	if _, ok := channel.Members[c]; !ok {
+		return &CommandError{irc.ERR_NOTONCHANNEL, []string{name, "You're not on that channel"}}
+	}
+
+	params := []string{channel.Name}
+	if len(reason) > 0 {
+		params = append(params, reason)
+	}
+	channel.send(c, c.relayTags(nil), &irc.Message{
+		Prefix:  c.Info.Prefix,
+		Command: irc.PART,
+		Params:  params,
+	}, nil)
+	s.propagate(c.link(), linkLine(c.ID.String(), irc.PART, params...))
+
+	s.removeMember(channel, c)
+
+	return nil
+}
+
+// removeMember removes c from channel without informing anyone. If channel is
+// left empty, it's removed from the server.
+func (s *Server) removeMember(channel *Channel, c *Client) {
+	delete(channel.Members, c)
+	delete(c.Channels, s.fold(channel.Name))
+
+	if len(channel.Members) == 0 {
+		delete(s.Channels, s.fold(channel.Name))
+	}
+}
+
+// sendNames sends the names list of the named channel to c. If the channel
+// doesn't exist or c can't see it, only the end of the list is sent.
+func (s *Server) sendNames(c *Client, name string) {
+	defer c.numeric(irc.RPL_ENDOFNAMES, name, "End of /NAMES list")
+
+	channel, ok := s.Channels[s.fold(name)]
+	if !ok || !channel.isVisibleTo(c) {
+		return
+	}
+
+	// :server 353 nick = #channel :name name name
+	maxLength := 510 - len(":  353  =  :") - len(s.FriendlyName()) - len(c.Info.Name) - len(channel.Name)
+
+	// The symbol tells clients whether the channel is public, secret (+s) or
+	// private (+p).
+	symbol := "="
+	if channel.Modes['s'] {
+		symbol = "@"
+	} else if channel.Modes['p'] {
+		symbol = "*"
+	}
+
+	userhost := c.HasCapability(capUserhostInNames)
+
+	var names []string
+	length := 0
+	for member := range channel.Members {
+		name := member.Info.Name
+		if userhost {
+			name = member.Info.Prefix.String()
+		}
+		name = channel.prefixes(member, c) + name
+
+		if length+len(name) > maxLength && len(names) > 0 {
+			c.numeric(irc.RPL_NAMREPLY, symbol, channel.Name, strings.Join(names, " "))
+			names, length = names[:0], 0
+		}
+
+		names = append(names, name)
+		length += len(name) + 1
+	}
+
+	if len(names) > 0 {
+		c.numeric(irc.RPL_NAMREPLY, symbol, channel.Name, strings.Join(names, " "))
+	}
+}
+
+// sendTopic sends the topic of channel to c.
+func (s *Server) sendTopic(c *Client, channel *Channel) {
+	if len(channel.Topic.Text) == 0 {
+		c.numeric(irc.RPL_NOTOPIC, channel.Name, "No topic is set")
+		return
+	}
+
+	c.numeric(irc.RPL_TOPIC, channel.Name, channel.Topic.Text)
+	c.numeric(RPL_TOPICWHOTIME, channel.Name, channel.Topic.SetBy, strconv.FormatInt(channel.Topic.SetTime.Unix(), 10))
+}
+
+func (s *Server) topic(c *Client, name, topic string, set bool) *CommandError {
+	channel, ok := s.Channels[s.fold(name)]
+	if !ok {
+		return &CommandError{irc.ERR_NOSUCHCHANNEL, []string{name, "No such channel"}}
+	}
+
+	if _, ok := channel.Members[c]; !ok {
+		return &CommandError{irc.ERR_NOTONCHANNEL, []string{name, "You're not on that channel"}}
+	}
+
+	if !set {
+		s.sendTopic(c, channel)
+		return nil
+	}
+
+	if channel.Modes['t'] && channel.privilege(c) < Halfop {
+		return &CommandError{irc.ERR_CHANOPRIVSNEEDED, []string{name, "You're not channel operator"}}
+	}
+
+	s.setTopic(c, channel, topic)
+	return nil
+}
+
+// setTopic sets the channel's topic on c's behalf and tells everyone about it,
+// without checking that c may.
+func (s *Server) setTopic(c *Client, channel *Channel, topic string) {
+	if len(topic) > MaximumTopicLen {
+		topic = topic[:MaximumTopicLen]
+	}
+
+	channel.Topic.Text = topic
+	channel.Topic.SetBy = c.Info.Name
+	channel.Topic.SetTime = time.Now()
+
+	channel.send(c, c.relayTags(nil), &irc.Message{
+		Prefix:  c.Info.Prefix,
+		Command: irc.TOPIC,
+		Params:  []string{channel.Name, topic},
+	}, nil)
+	s.propagate(c.link(), linkLine(c.ID.String(), irc.TOPIC, channel.Name, topic))
+}
+
+// list sends c the channels that it can see. If names isn't empty, only those
+// channels are listed.
+func (s *Server) list(c *Client, names []string) {
+	c.numeric(irc.RPL_LISTSTART, "Channel", "Users  Name")
+	defer c.numeric(irc.RPL_LISTEND, "End of /LIST")
+
+	var channels []*Channel
+	if len(names) > 0 {
+		for _, name := range names {
+			if channel, ok := s.Channels[s.fold(name)]; ok {
+				channels = append(channels, channel)
+			}
+		}
+	} else {
+		for _, channel := range s.Channels {
+			channels = append(channels, channel)
+		}
+	}
+
+	for _, channel := range channels {
+		if !channel.isVisibleTo(c) {
+			continue
+		}
+
+		c.numeric(irc.RPL_LIST, channel.Name, strconv.Itoa(len(channel.Members)), channel.Topic.Text)
+	}
+}
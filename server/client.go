@@ -7,6 +7,8 @@ package server
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -15,9 +17,12 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/sorcix/irc"
+	"github.com/nightexcessive/excessiveircd/protocol"
 	"github.com/pborman/uuid"
 )
 
@@ -27,6 +32,11 @@ type Client struct {
 	Server *Server
 	Logger *log.Logger
 
+	// Origin is the server that the client is connected to if it's another
+	// server's client, or nil if it's one of ours. Other servers' clients
+	// have no connection, so nothing is written to them.
+	Origin *RemoteServer
+
 	Info struct {
 		*irc.Prefix
 
@@ -36,24 +46,100 @@ type Client struct {
 		// The time at which the client began owning this nickname. This is
 		// primarily used for collision resolution.
 		ChangeTime time.Time
+
+		// The name of the account that the client is logged into, or an
+		// empty string if it isn't logged in.
+		Account string
 	}
 
 	// The time at which this client finished registration.
 	ConnectTime time.Time
 
+	// lastActive is the time, in Unix nanoseconds, of the last command that the
+	// client sent other than PING and PONG. It's accessed atomically.
+	lastActive int64
+
 	Registered bool
 	Closed     bool
 
+	// Capabilities holds the IRCv3 capabilities that the client has enabled.
+	// It's protected by the client's mutex, so HasCapability should be used to
+	// check it.
+	Capabilities map[string]bool
+
+	// CapVersion is the version given in the client's CAP LS, or 0 if it
+	// didn't give one.
+	CapVersion int
+
+	// capNegotiating is true while the client is negotiating capabilities
+	// before registration. Registration is paused until it sends CAP END.
+	capNegotiating bool
+
+	// response collects the replies to the current command if it's labeled.
+	// It's protected by the client's mutex.
+	response *response
+
+	// batches holds the reference tags of the batches that are open, with the
+	// innermost last. It's protected by the client's mutex.
+	batches []string
+
+	// lastBatchRef is the last batch reference tag number that was used. It's
+	// accessed atomically.
+	lastBatchRef uint64
+
+	// sasl holds the state of a SASL exchange that's in progress.
+	sasl struct {
+		mechanism string
+
+		// buffer holds the base64-encoded response chunks that have been
+		// received so far.
+		buffer string
+	}
+
 	IP net.IP
 
+	// Channels that the client is a member of, keyed by folded channel name.
+	// This is owned by the Server's event loop and must only be accessed from
+	// it.
+	Channels map[string]*Channel
+
+	// Monitoring holds the nicknames that the client is monitoring, keyed by
+	// their folded forms. It's owned by the Server's event loop.
+	Monitoring map[string]string
+
+	// Invited holds the channels that the client has been invited to and when
+	// each invitation expires. It's owned by the Server's event loop.
+	Invited map[*Channel]time.Time
+
 	Events chan interface{}
 
 	conn net.Conn
 	buf  *bufio.Reader
 
+	// partial holds the start of a line whose read was interrupted by the read
+	// deadline. It's only used by the read loop.
+	partial []byte
+
+	// sendQ holds lines that are waiting to be written to conn by writeLoop.
+	sendQ chan string
+
+	// done is closed when the client begins closing. It's used to stop the
+	// client's goroutines.
+	done chan struct{}
+
 	*sync.RWMutex
 }
 
+const (
+	// sendQLength is the number of lines that may be waiting to be written to a
+	// client before it's disconnected.
+	sendQLength = 512
+
+	// flushTimeout is how long we'll wait for queued lines to be written once
+	// a client begins closing.
+	flushTimeout = 5 * time.Second
+)
+
 // NewClient creates and initializes a new Client. Once done initializing, it
 // registers the new client with the given Server.
 func NewClient(conn net.Conn, server *Server) *Client {
@@ -67,6 +153,7 @@ func NewClient(conn net.Conn, server *Server) *Client {
 			*irc.Prefix
 			Real       string
 			ChangeTime time.Time
+			Account    string
 		}{
 			Prefix: &irc.Prefix{
 				Name: "*",
@@ -77,19 +164,36 @@ func NewClient(conn net.Conn, server *Server) *Client {
 			ChangeTime: time.Now(),
 		},
 
+		Capabilities: make(map[string]bool),
+
+		Channels:   make(map[string]*Channel),
+		Monitoring: make(map[string]string),
+		Invited:    make(map[*Channel]time.Time),
+
 		Events: make(chan interface{}),
 
 		conn: conn,
 		buf:  bufio.NewReaderSize(conn, 512), // 512 byte buffer as per RFC1459
 
+		sendQ: make(chan string, sendQLength),
+		done:  make(chan struct{}),
+
 		RWMutex: new(sync.RWMutex),
 	}
 
+	server.connections.Add(1)
+	server.Events <- &SNewClient{client}
+
 	go client.eventLoop()
 	go client.readLoop()
+	go client.writeLoop()
 
 	client.Events <- new(CInitialize)
 
+	time.AfterFunc(server.Timeouts.RegistrationTimeout, func() {
+		client.sendEvent(new(CRegistrationTimeout))
+	})
+
 	return client
 }
 
@@ -131,127 +235,237 @@ func (c *Client) lookupHostname() {
 	c.serverNotice(c.Server, "*** Could not find your hostname.")
 }
 
-var errMaximumLineLengthExceeded = errors.New("maximum line length exceeded")
+var (
+	errMaximumLineLengthExceeded = errors.New("maximum line length exceeded")
+
+	// errInvalidUTF8 is returned by readLine if the server only allows UTF-8
+	// and the line isn't valid UTF-8. The client may carry on after it.
+	errInvalidUTF8 = errors.New("line is not valid UTF-8")
+)
 
 func (c *Client) readLine() (s string, err error) {
 	const (
-		// Maximum IRC line length is 512, including the \r\n. Since
-		// ReadLine doesn't return the \r\n, we assume a maximum length of
-		// 510 and silently discard the rest.
+		// Maximum IRC line length is 512, including the \r\n. Since we
+		// strip the \r\n, we assume a maximum length of 510 and silently
+		// discard the rest. Tags don't count towards this.
 		softLengthLimit = 510
 
 		// We make a hard limit of 32KB per line and return an error after that.
 		hardLengthLimit = 32 * 1024
 	)
 
-	var (
-		n        int
-		b        []byte
-		isPrefix bool
-	)
-
-	emptyBuf := false
-
 	for {
-		b, isPrefix, err = c.buf.ReadLine()
-		n += len(b)
-		if err != nil {
-			if isPrefix {
-				emptyBuf = true
-			}
-			break
+		b, err := c.buf.ReadSlice('\n')
+		if len(c.partial)+len(b) > hardLengthLimit {
+			c.partial = nil
+			return "", errMaximumLineLengthExceeded
 		}
 
-		if bLen, sLen := len(b), len(s); bLen+sLen > softLengthLimit {
-			s += string(b[:510-sLen])
-			if isPrefix {
-				emptyBuf = true
-			}
-			break
-		} else {
-			s += string(b)
+		c.partial = append(c.partial, b...)
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err != nil {
+			// What we've read is kept, so a line that's interrupted by the
+			// read deadline is finished by the next call.
+			return "", err
 		}
+		break
+	}
 
-		if !isPrefix {
-			break
+	line := bytes.TrimSuffix(c.partial[:len(c.partial)-1], []byte{'\r'})
+	c.partial = nil
+
+	// The tags and the rest of the message are limited separately. Tags that
+	// are too long are left for SplitTags to reject.
+	var tags []byte
+	if len(line) > 0 && line[0] == '@' {
+		end := bytes.IndexByte(line, ' ') + 1
+		if end == 0 {
+			end = len(line)
 		}
+		tags, line = line[:end], line[end:]
 	}
 
-	if emptyBuf {
-		for {
-			// Ignore the rest of this line.
-			b, isPrefix, err = c.buf.ReadLine()
-			n += len(b)
-			if err != nil {
-				break
-			}
-			if !isPrefix {
-				break
-			}
-			if n > hardLengthLimit {
-				err = errMaximumLineLengthExceeded
-				return
+	if len(line) > softLengthLimit {
+		line = line[:softLengthLimit]
+		if c.Server.UTF8 {
+			// Don't let the truncation split a character.
+			for i := len(line) - 1; i >= 0 && i >= len(line)-utf8.UTFMax; i-- {
+				if utf8.RuneStart(line[i]) {
+					if !utf8.FullRune(line[i:]) {
+						line = line[:i]
+					}
+					break
+				}
 			}
 		}
 	}
 
+	s = string(tags) + string(line)
+	if c.Server.UTF8 && !utf8.ValidString(s) {
+		err = errInvalidUTF8
+	}
+
 	return
 }
 
 func (c *Client) readLoop() {
 	c.Logger.Print("Started read loop")
 	defer c.Logger.Print("Ended read loop")
+	// pingSent is true if the client has been idle long enough to be sent a
+	// PING and hasn't sent anything since.
+	pingSent := false
+
 	for {
+		if pingSent {
+			c.conn.SetReadDeadline(time.Now().Add(c.Server.Timeouts.PingTimeout))
+		} else {
+			c.conn.SetReadDeadline(time.Now().Add(c.Server.Timeouts.PingInterval))
+		}
+
 		line, err := c.readLine()
-		if netErr, ok := err.(net.Error); ok {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			if pingSent {
+				c.sendEvent(&CClose{fmt.Sprintf("Ping timeout: %d seconds", int(c.Server.Timeouts.PingTimeout.Seconds()))})
+				return
+			}
+
+			c.writeString("PING :" + c.Server.FriendlyName())
+			pingSent = true
+			continue
+		} else if ok {
 			if !netErr.Temporary() {
 				c.Logger.Printf("Read error (net.Error, non-temporary): %s", err)
-				c.Events <- &CClose{"Read error: " + err.Error()}
+				c.sendEvent(&CClose{"Read error: " + err.Error()})
 				return
 			}
 			c.Logger.Printf("Read error (net.Error, temporary): %s", err)
+		} else if err == errInvalidUTF8 {
+			c.writeString(c.failLine("*", "INVALID_UTF8", "Message rejected because it contained invalid UTF-8"))
+			pingSent = false
+			continue
 		} else if err == io.EOF || (err != nil && strings.HasSuffix(err.Error(), "use of closed network connection")) {
-			c.Events <- &CClose{"Connection reset by peer"}
+			c.sendEvent(&CClose{"Connection reset by peer"})
 			return
 		} else if err != nil {
 			c.Logger.Printf("Read error: %s", err)
-			c.Events <- &CClose{"Read error: " + err.Error()}
+			c.sendEvent(&CClose{"Read error: " + err.Error()})
 			return
 		}
 
-		c.handleLine(line)
+		pingSent = false
+		if !c.handleLine(line) {
+			return
+		}
+	}
+}
+
+func (c *Client) writeLoop() {
+	c.Logger.Print("Started write loop")
+	defer c.Logger.Print("Ended write loop")
+	for {
+		select {
+		case line := <-c.sendQ:
+			if _, err := io.WriteString(c.conn, line+"\r\n"); err != nil {
+				c.Logger.Printf("Write error: %s", err)
+				c.sendEvent(&CClose{"Write error: " + err.Error()})
+				<-c.done
+				c.conn.Close()
+				return
+			}
+		case <-c.done:
+			c.flush()
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// flush writes any lines that are still queued. It gives up after
+// flushTimeout.
+func (c *Client) flush() {
+	c.conn.SetWriteDeadline(time.Now().Add(flushTimeout))
+	for {
+		select {
+		case line := <-c.sendQ:
+			if _, err := io.WriteString(c.conn, line+"\r\n"); err != nil {
+				return
+			}
+		default:
+			return
+		}
 	}
 }
 
 func (c *Client) eventLoop() {
 	c.Logger.Print("Started event loop")
 	defer c.Logger.Print("Ended event loop")
-	for event := range c.Events {
+	for {
+		var event interface{}
+		select {
+		case event = <-c.Events:
+		case <-c.done:
+			return
+		}
+
 		c.Logger.Printf("Event: %T", event)
 		switch ev := event.(type) {
 		case *CInitialize:
 			c.lookupHostname()
 		case *CMessage:
 			c.handleMessage(ev.Message)
+		case *CRegistrationTimeout:
+			if !c.Registered {
+				c.close("Registration timed out")
+			}
 		case *CClose:
 			c.close(ev.Reason)
 		default:
 			c.Logger.Printf("Unexpected event of type %T: %#v", ev, ev)
 		}
+
+		if c.Closed {
+			return
+		}
 	}
 }
 
-func (c *Client) handleLine(line string) {
+// sendEvent sends event to the client's event loop. It returns false if the
+// client closed before the event could be delivered.
+func (c *Client) sendEvent(event interface{}) bool {
+	select {
+	case c.Events <- event:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+func (c *Client) handleLine(line string) bool {
+	tags, line, err := protocol.SplitTags(line, protocol.MaximumClientTagsLen)
+	if err == protocol.ErrTagsTooLong {
+		c.unsolicitedNumeric(ERR_INPUTTOOLONG, "Input line was too long")
+		return true
+	} else if err != nil {
+		c.Logger.Printf("Error in parsing tags of %q: %s", line, err)
+		return true
+	}
+
 	message := irc.ParseMessage(line)
 	if message == nil {
 		c.Logger.Printf("Error in parsing %q", line)
-		return
+		return true
 	}
 
-	c.Events <- &CMessage{message}
+	return c.sendEvent(&CMessage{&Message{message, tags}})
 }
 
-func (c *Client) handleMessage(m *irc.Message) {
+func (c *Client) handleMessage(m *Message) {
+	if label := m.Tags["label"]; len(label) > 0 && c.HasCapability(capLabeledResponse) {
+		c.startResponse(label)
+		defer c.finishResponse()
+	}
+
 	// Always make the command uppercase. It's canonical and our constants are
 	// also uppercase.
 	m.Command = strings.ToUpper(m.Command)
@@ -282,11 +496,29 @@ func (c *Client) handleMessage(m *irc.Message) {
 		return
 	}
 
-	err := commandEntry.Func(c, m)
-	if err == nil {
-		return
+	if m.Command != irc.PING && m.Command != irc.PONG {
+		atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
 	}
 
+	if err := commandEntry.Func(c, m); err != nil {
+		c.sendError(err)
+	}
+}
+
+// IdleTime returns how long it's been since the client last did anything other
+// than answer pings.
+func (c *Client) IdleTime() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
+}
+
+// IsSecure checks if the client is connected over TLS.
+func (c *Client) IsSecure() bool {
+	_, ok := c.conn.(*tls.Conn)
+	return ok
+}
+
+// sendError sends err to the client.
+func (c *Client) sendError(err *CommandError) {
 	if err.Numeric == "" {
 		c.serverNotice(c.Server, err.Params[0])
 		return
@@ -295,28 +527,123 @@ func (c *Client) handleMessage(m *irc.Message) {
 	c.numeric(err.Numeric, err.Params...)
 }
 
+var errSendQExceeded = errors.New("send queue exceeded")
+
+// writeString queues line to be written to the client. It never blocks, so it
+// may be called from any goroutine. If the client isn't reading quickly enough
+// to keep up, it's disconnected.
 func (c *Client) writeString(line string) (int, error) {
-	return io.WriteString(c.conn, line+"\r\n")
+	if c.Origin != nil {
+		// Its own server tells it about everything.
+		return len(line) + 2, nil
+	}
+
+	select {
+	case c.sendQ <- line:
+		return len(line) + 2, nil
+	default:
+		go c.sendEvent(&CClose{"SendQ exceeded"})
+		return 0, errSendQExceeded
+	}
 }
 
 func (c *Client) writeMessage(m *irc.Message) (int, error) {
+	return c.writeTaggedMessage(nil, m)
+}
+
+// writeTaggedMessage writes m with the tags that the client has enabled the
+// capabilities to receive.
+func (c *Client) writeTaggedMessage(tags protocol.Tags, m *irc.Message) (int, error) {
+	return c.writeLine(c.allowedTags(tags), formatMessage(m))
+}
+
+// writeLine writes a reply to the client's current command with tags, which
+// must already have been filtered with allowedTags. If a batch is open, the
+// line is made part of it. If the client is waiting for a labeled response, the
+// line is held until the current command finishes. Lines that aren't replies to
+// the client's own command must be written with writeString or
+// unsolicitedNumeric instead, so that they don't end up in the wrong response.
+func (c *Client) writeLine(tags protocol.Tags, line string) (int, error) {
+	if _, ok := tags[batchTag]; !ok {
+		if ref := c.currentBatch(); len(ref) > 0 {
+			tags = withTag(tags, batchTag, ref)
+		}
+	}
+
+	if c.collectResponse(tags, line) {
+		return len(line) + 2, nil
+	}
+
+	return c.writeString(prefixTags(tags, line))
+}
+
+// relay writes a message that was sent by from. Messages that the client sent
+// itself are part of the response to its current command. Anything else is
+// written immediately.
+func (c *Client) relay(from *Client, tags protocol.Tags, m *irc.Message) (int, error) {
+	if from == c {
+		return c.writeTaggedMessage(tags, m)
+	}
+
+	return c.writeString(prefixTags(c.allowedTags(tags), formatMessage(m)))
+}
+
+// prefixTags adds tags to the beginning of line. If the tags would be longer
+// than protocol.MaximumTagsLen, the client-only tags are left out, since
+// they're the only ones that can grow that long.
+func prefixTags(tags protocol.Tags, line string) string {
+	if len(tags) == 0 {
+		return line
+	}
+
+	raw := tags.String()
+	if len(raw)+2 > protocol.MaximumTagsLen {
+		serverTags := make(protocol.Tags)
+		for key, value := range tags {
+			if !protocol.IsClientOnlyTag(key) {
+				serverTags[key] = value
+			}
+		}
+
+		raw = serverTags.String()
+		if len(serverTags) == 0 || len(raw)+2 > protocol.MaximumTagsLen {
+			return line
+		}
+	}
+
+	return "@" + raw + " " + line
+}
+
+// formatMessage converts m into a line, without the trailing \r\n. m is not
+// modified, so it may be formatted more than once.
+func formatMessage(m *irc.Message) string {
 	if len(m.Trailing) == 0 && len(m.Params) > 0 {
 		// We handle trailing parameters different from this IRC library, so we
 		// convert it back to the library's behavior here.
-		m.Trailing = m.Params[len(m.Params)-1]
-		m.Params = m.Params[:len(m.Params)-1]
+		converted := *m
+		converted.Trailing = m.Params[len(m.Params)-1]
+		converted.Params = m.Params[:len(m.Params)-1]
+		m = &converted
 	}
-	return io.WriteString(c.conn, m.String()+"\r\n")
+	return m.String()
 }
 
 func (c *Client) close(reason string) {
-	close(c.Events)
+	if c.Closed {
+		return
+	}
+	c.Closed = true
+
 	c.error("Closing link " + c.Info.Name + ": " + reason)
-	c.conn.Close()
+	// Closing done causes writeLoop to flush the error and close the
+	// connection, which in turn stops readLoop.
+	close(c.done)
 
 	reply := make(chan struct{})
-	c.Server.Events <- &SDeregisterClient{c, reply}
+	c.Server.Events <- &SDeregisterClient{c, reason, reply}
 	<-reply
+
+	c.Server.connections.Done()
 }
 
 func (c *Client) error(text string) {
@@ -324,19 +651,77 @@ func (c *Client) error(text string) {
 }
 
 func (c *Client) serverNotice(s *Server, text string) {
-	c.writeString(":" + s.FriendlyName() + " NOTICE " + c.Info.Name + " :" + text)
+	c.writeLine(nil, ":"+s.FriendlyName()+" NOTICE "+c.Info.Name+" :"+text)
 }
 
 func (c *Client) numeric(numeric string, args ...string) {
+	c.writeLine(nil, c.numericLine(numeric, args...))
+}
+
+// unsolicitedNumeric sends a numeric that isn't a reply to the client's own
+// command, such as one that's caused by another client. It's written straight
+// away, outside of any labeled response or batch that's open.
+func (c *Client) unsolicitedNumeric(numeric string, args ...string) {
+	c.writeString(c.numericLine(numeric, args...))
+}
+
+func (c *Client) numericLine(numeric string, args ...string) string {
 	if len(args) > 0 {
 		lastNum := len(args) - 1
 		lastArg := args[lastNum]
 		args[lastNum] = ":" + lastArg
 	}
 
-	c.rawNumeric(numeric, args...)
+	return c.rawNumericLine(numeric, args...)
+}
+
+// maxListLineLen is the maximum length of the list that's sent in one numeric by
+// sendList. It leaves room for the prefix, numeric, nickname and a parameter or
+// two.
+const maxListLineLen = 400
+
+// sendList sends items to c as a list separated by sep, in as few of the given
+// numeric as possible. Each numeric has params before the list. Nothing is sent
+// if items is empty.
+func sendList(c *Client, numeric, sep string, items []string, params ...string) {
+	var line []string
+	length := 0
+	send := func() {
+		c.numeric(numeric, append(params[:len(params):len(params)], strings.Join(line, sep))...)
+	}
+
+	for _, item := range items {
+		if length+len(item) > maxListLineLen && len(line) > 0 {
+			send()
+			line, length = line[:0], 0
+		}
+
+		line = append(line, item)
+		length += len(item) + len(sep)
+	}
+
+	if len(line) > 0 {
+		send()
+	}
+}
+
+// fail sends a FAIL standard reply to c. The last of params is the description
+// of the failure.
+func (c *Client) fail(command, code string, params ...string) {
+	c.writeLine(nil, c.failLine(command, code, params...))
+}
+
+func (c *Client) failLine(command, code string, params ...string) string {
+	params = append([]string{command, code}, params...)
+	params[len(params)-1] = ":" + params[len(params)-1]
+
+	return ":" + c.Server.FriendlyName() + " " + FAIL + " " + strings.Join(params, " ")
 }
 
 func (c *Client) rawNumeric(numeric string, args ...string) {
-	c.writeString(fmt.Sprintf(":%s %s %s %s", c.Server.FriendlyName(), numeric, c.Info.Name, strings.Join(args, " ")))
+	c.writeLine(nil, c.rawNumericLine(numeric, args...))
+}
+
+func (c *Client) rawNumericLine(numeric string, args ...string) string {
+	return fmt.Sprintf(":%s %s %s %s", c.Server.FriendlyName(), numeric, c.Info.Name, strings.Join(args, " "))
 }
@@ -0,0 +1,103 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nightexcessive/excessiveircd/protocol"
+)
+
+// readTestLine reads one line from input as a client would.
+func readTestLine(t *testing.T, input string) string {
+	t.Helper()
+
+	c := &Client{
+		Server: &Server{},
+		buf:    bufio.NewReader(strings.NewReader(input + "\r\n")),
+	}
+	line, err := c.readLine()
+	if err != nil {
+		t.Fatalf("Error reading line: %s", err)
+	}
+
+	return line
+}
+
+func TestReadLine_BodyLimit(t *testing.T) {
+	body := "PRIVMSG #test :" + strings.Repeat("a", 600)
+
+	if line := readTestLine(t, body); line != body[:510] {
+		t.Errorf("Untagged line is %d bytes, want 510", len(line))
+	}
+
+	tags := "@+draft/reply=" + strings.Repeat("b", 1000) + " "
+	line := readTestLine(t, tags+body)
+	if !strings.HasPrefix(line, tags) {
+		t.Fatal("Tags were truncated")
+	}
+	if rest := line[len(tags):]; rest != body[:510] {
+		t.Errorf("Tagged line's body is %d bytes, want 510", len(rest))
+	}
+}
+
+func TestReadLine_TagsLimit(t *testing.T) {
+	tags := "@+draft/reply=" + strings.Repeat("b", protocol.MaximumClientTagsLen) + " "
+	line := readTestLine(t, tags+"TAGMSG #test")
+
+	if _, _, err := protocol.SplitTags(line, protocol.MaximumClientTagsLen); err != protocol.ErrTagsTooLong {
+		t.Errorf("Too many tags gave %v, want %v", err, protocol.ErrTagsTooLong)
+	}
+}
+
+func TestPrefixTags_Limit(t *testing.T) {
+	tags := protocol.Tags{
+		"time":    "2014-01-01T00:00:00.000Z",
+		"+client": strings.Repeat("a", protocol.MaximumTagsLen),
+	}
+
+	line := prefixTags(tags, "PRIVMSG #test :hi")
+	if line != "@time=2014-01-01T00:00:00.000Z PRIVMSG #test :hi" {
+		t.Errorf("Got %q", line)
+	}
+
+	tags["+client"] = "a"
+	line = prefixTags(tags, "PRIVMSG #test :hi")
+	if line != "@+client=a;time=2014-01-01T00:00:00.000Z PRIVMSG #test :hi" {
+		t.Errorf("Got %q", line)
+	}
+}
+
+func TestReadLine_Deadline(t *testing.T) {
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+
+	c := &Client{
+		Server: &Server{},
+		buf:    bufio.NewReader(conn),
+	}
+
+	go other.Write([]byte("PRIVMSG #a :hel"))
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if line, err := c.readLine(); err == nil {
+		t.Fatalf("Read %q before the line was finished", line)
+	} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("Got %v, want a timeout", err)
+	}
+
+	go other.Write([]byte("lo\r\nPING :x\r\n"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range []string{"PRIVMSG #a :hello", "PING :x"} {
+		if line, err := c.readLine(); err != nil || line != want {
+			t.Errorf("Got %q, %v, want %q", line, err, want)
+		}
+	}
+}
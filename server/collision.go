@@ -0,0 +1,48 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import "time"
+
+// Collision is the outcome of a nickname collision.
+type Collision int
+
+const (
+	// CollisionKeepExisting means that the client that already had the
+	// nickname keeps it and the other client loses it.
+	CollisionKeepExisting Collision = iota
+
+	// CollisionKeepIncoming means that the client that's claiming the
+	// nickname takes it and the client that had it loses it.
+	CollisionKeepIncoming
+
+	// CollisionKeepNeither means that both clients lose the nickname.
+	CollisionKeepNeither
+)
+
+// ResolveCollision decides which of two clients that claim the same nickname
+// keeps it, given the times at which each of them took it. Following the TS
+// rules, the client that took the nickname first keeps it, and if both took it
+// in the same second, neither does. Times are compared to the second because
+// that's the precision that servers exchange them with.
+//
+// Only the linking path uses it, through resolveNickCollision. Our own clients
+// are refused a nickname that's in use instead (see nickInUse), since the
+// event loop already knows which of them took it first, and a tie would
+// otherwise cost a client its nickname for registering in the same second as
+// someone else.
+func ResolveCollision(existing, incoming time.Time) Collision {
+	existingTS, incomingTS := existing.Unix(), incoming.Unix()
+
+	switch {
+	case existingTS < incomingTS:
+		return CollisionKeepExisting
+	case incomingTS < existingTS:
+		return CollisionKeepIncoming
+	}
+
+	return CollisionKeepNeither
+}
@@ -0,0 +1,31 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResolveCollision(t *testing.T) {
+	now := time.Unix(1400000000, 0)
+
+	tests := []struct {
+		existing, incoming time.Time
+		expected           Collision
+	}{
+		{now, now.Add(time.Second), CollisionKeepExisting},
+		{now.Add(time.Hour), now, CollisionKeepIncoming},
+		{now, now, CollisionKeepNeither},
+		{now, now.Add(500 * time.Millisecond), CollisionKeepNeither},
+	}
+
+	for _, test := range tests {
+		if actual := ResolveCollision(test.existing, test.incoming); actual != test.expected {
+			t.Errorf("ResolveCollision(%v, %v): expected %d, got %d", test.existing, test.incoming, test.expected, actual)
+		}
+	}
+}
@@ -6,6 +6,8 @@
 package server
 
 import (
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/nightexcessive/excessiveircd/protocol"
@@ -24,7 +26,7 @@ type CommandError struct {
 
 // Command represents a command specification.
 type Command struct {
-	Func func(client *Client, message *irc.Message) *CommandError
+	Func func(client *Client, message *Message) *CommandError
 
 	MinimumParams int
 
@@ -36,32 +38,64 @@ var commands = map[string]*Command{
 	//irc.PASS: {cmdRegistration, 1, false, true},
 	irc.NICK: {cmdRegistration, 1, true, true},
 	irc.USER: {cmdRegistration, 4, false, true},
+	CAP:      {cmdCap, 1, true, true},
+
+	AUTHENTICATE: {cmdAuthenticate, 1, false, true},
+
+	irc.JOIN:   {cmdJoin, 1, true, false},
+	irc.PART:   {cmdPart, 1, true, false},
+	irc.NAMES:  {cmdNames, 0, true, false},
+	irc.TOPIC:  {cmdTopic, 1, true, false},
+	irc.MODE:   {cmdMode, 1, true, false},
+	irc.KICK:   {cmdKick, 2, true, false},
+	irc.INVITE: {cmdInvite, 2, true, false},
+	KNOCK:      {cmdKnock, 1, true, false},
+	irc.LIST:   {cmdList, 0, true, false},
+
+	irc.PING: {cmdPing, 0, true, true},
+	irc.PONG: {cmdPong, 0, true, true},
+
+	irc.QUIT: {cmdQuit, 0, true, true},
+
+	irc.LUSERS:  {cmdLusers, 0, true, false},
+	irc.MOTD:    {cmdMOTD, 0, true, false},
+	irc.VERSION: {cmdVersion, 0, true, false},
+	irc.TIME:    {cmdTime, 0, true, false},
+	irc.ADMIN:   {cmdAdmin, 0, true, false},
+
+	irc.WHOIS:  {cmdWhois, 1, true, false},
+	irc.WHOWAS: {cmdWhowas, 1, true, false},
+	irc.WHO:    {cmdWho, 0, true, false},
+
+	irc.PRIVMSG: {cmdPrivmsg, 0, true, false},
+	irc.NOTICE:  {cmdPrivmsg, 0, true, false},
+	TAGMSG:      {cmdPrivmsg, 0, true, false},
+
+	CHATHISTORY: {cmdChatHistory, 1, true, false},
+	MONITOR:     {cmdMonitor, 1, true, false},
+}
+
+func init() {
+	registerISupport("NICKLEN", isupportValue(strconv.Itoa(protocol.MaximumNickLen)))
 }
 
 // cmdChangeNick is called when an already registered user uses the NICK command.
-func cmdChangeNick(c *Client, m *irc.Message, nick string) *CommandError {
+func cmdChangeNick(c *Client, m *Message, nick string) *CommandError {
 	reply := make(chan bool)
 	c.Server.Events <- &SChangeNick{nick, c, reply}
 	if !<-reply {
 		return &CommandError{irc.ERR_NICKNAMEINUSE, []string{nick, "Nickname is already in use"}}
 	}
-	c.writeMessage(&irc.Message{
-		Prefix:   c.Info.Prefix,
-		Command:  irc.NICK,
-		Params:   nil,
-		Trailing: nick,
-	})
-	c.Info.Name = nick
-	c.Info.ChangeTime = time.Now()
+	// The server informs everyone, including us, of the change.
 	return nil
 }
 
-func cmdRegistration(c *Client, m *irc.Message) *CommandError {
+func cmdRegistration(c *Client, m *Message) *CommandError {
 	switch m.Command {
 	case irc.NICK:
 		nick := m.Params[0]
 
-		if !protocol.IsValid(nick, protocol.Nickname) {
+		if !c.Server.isNickname(nick) {
 			return &CommandError{irc.ERR_ERRONEUSNICKNAME, []string{nick, "Erroneous nickname"}}
 		}
 
@@ -79,6 +113,7 @@ func cmdRegistration(c *Client, m *irc.Message) *CommandError {
 		}
 
 		c.Info.User = "~" + user
+		c.Info.Real = m.Params[3]
 	default:
 		c.Logger.Printf("Unexpected registration command: %q", m.Command)
 		return nil
@@ -86,20 +121,295 @@ func cmdRegistration(c *Client, m *irc.Message) *CommandError {
 
 	// Registered connections should never reach this section.
 
-	if c.Info.Name != "*" && c.Info.User != "*" {
-		reply := make(chan bool)
-		c.Server.Events <- &SRegisterClient{c, reply}
+	return c.register()
+}
+
+// register registers c if it has sent all of its registration information and
+// isn't negotiating capabilities.
+func (c *Client) register() *CommandError {
+	if c.Info.Name == "*" || c.Info.User == "*" || c.capNegotiating {
+		return nil
+	}
+
+	// The event loop reads these as soon as c is registered, so they must be
+	// set first.
+	c.ConnectTime = time.Now()
+	c.Info.ChangeTime = c.ConnectTime
+
+	reply := make(chan bool)
+	c.Server.Events <- &SRegisterClient{c, reply}
+
+	if !<-reply {
+		return &CommandError{irc.ERR_NICKNAMEINUSE, []string{c.Info.Name, "Nickname is already in use"}}
+	}
+
+	c.Registered = true
+
+	c.sendWelcome()
+
+	return nil
+}
+
+func cmdJoin(c *Client, m *Message) *CommandError {
+	if m.Params[0] == "0" {
+		reply := make(chan struct{})
+		c.Server.Events <- &SPartAllChannels{c, reply}
+		<-reply
+		return nil
+	}
+
+	var keys []string
+	if len(m.Params) > 1 {
+		keys = strings.Split(m.Params[1], ",")
+	}
+
+	for i, name := range strings.Split(m.Params[0], ",") {
+		if !c.Server.isChannelName(name) {
+			c.numeric(irc.ERR_NOSUCHCHANNEL, name, "No such channel")
+			continue
+		}
+
+		var key string
+		if i < len(keys) {
+			key = keys[i]
+		}
+
+		reply := make(chan *CommandError)
+		c.Server.Events <- &SJoinChannel{c, name, key, reply}
+		if err := <-reply; err != nil {
+			c.sendError(err)
+		}
+	}
+
+	return nil
+}
+
+func cmdPart(c *Client, m *Message) *CommandError {
+	var reason string
+	if len(m.Params) > 1 {
+		reason = m.Params[1]
+	}
+
+	for _, name := range strings.Split(m.Params[0], ",") {
+		reply := make(chan *CommandError)
+		c.Server.Events <- &SPartChannel{c, name, reason, reply}
+		if err := <-reply; err != nil {
+			c.sendError(err)
+		}
+	}
+
+	return nil
+}
+
+func cmdNames(c *Client, m *Message) *CommandError {
+	if len(m.Params) == 0 {
+		c.numeric(irc.RPL_ENDOFNAMES, "*", "End of /NAMES list")
+		return nil
+	}
+
+	for _, name := range strings.Split(m.Params[0], ",") {
+		reply := make(chan struct{})
+		c.Server.Events <- &SNames{c, name, reply}
+		<-reply
+	}
+
+	return nil
+}
+
+func cmdTopic(c *Client, m *Message) *CommandError {
+	event := &STopic{
+		Client: c,
+		Name:   m.Params[0],
+		Reply:  make(chan *CommandError),
+	}
+	if len(m.Params) > 1 {
+		event.Topic = m.Params[1]
+		event.Set = true
+	}
+
+	c.Server.Events <- event
+	return <-event.Reply
+}
+
+// cmdKick handles KICK. Several clients may be kicked from one channel at
+// once, or from as many channels, which are then paired with them in order.
+func cmdKick(c *Client, m *Message) *CommandError {
+	var reason string
+	if len(m.Params) > 2 {
+		reason = m.Params[2]
+	}
+
+	channels := strings.Split(m.Params[0], ",")
+	nicks := strings.Split(m.Params[1], ",")
+	if len(channels) != 1 && len(channels) != len(nicks) {
+		return &CommandError{irc.ERR_NEEDMOREPARAMS, []string{m.Command, "Not enough parameters"}}
+	}
+
+	for i, nick := range nicks {
+		name := channels[0]
+		if len(channels) > 1 {
+			name = channels[i]
+		}
+
+		reply := make(chan *CommandError)
+		c.Server.Events <- &SKick{c, name, nick, reason, reply}
+		if err := <-reply; err != nil {
+			c.sendError(err)
+		}
+	}
+
+	return nil
+}
+
+func cmdInvite(c *Client, m *Message) *CommandError {
+	reply := make(chan *CommandError)
+	c.Server.Events <- &SInvite{c, m.Params[0], m.Params[1], reply}
+	return <-reply
+}
+
+func cmdKnock(c *Client, m *Message) *CommandError {
+	reply := make(chan *CommandError)
+	c.Server.Events <- &SKnock{c, m.Params[0], reply}
+	return <-reply
+}
+
+func cmdList(c *Client, m *Message) *CommandError {
+	event := &SList{Client: c, Reply: make(chan struct{})}
+	if len(m.Params) > 0 && len(m.Params[0]) > 0 {
+		event.Names = strings.Split(m.Params[0], ",")
+	}
 
-		if !<-reply {
-			return &CommandError{irc.ERR_NICKNAMEINUSE, []string{c.Info.Name, "Nickname is already in use"}}
+	c.Server.Events <- event
+	<-event.Reply
+	return nil
+}
+
+// cmdPrivmsg handles PRIVMSG, NOTICE and TAGMSG. NOTICE never generates an
+// error reply, so that automated clients can't be made to loop on each other.
+func cmdPrivmsg(c *Client, m *Message) *CommandError {
+	err := sendPrivmsg(c, m)
+	if m.Command == irc.NOTICE {
+		return nil
+	}
+	return err
+}
+
+func sendPrivmsg(c *Client, m *Message) *CommandError {
+	if len(m.Params) == 0 {
+		return &CommandError{irc.ERR_NORECIPIENT, []string{"No recipient given (" + m.Command + ")"}}
+	}
+
+	var text string
+	if m.Command != TAGMSG {
+		if len(m.Params) < 2 || len(m.Params[1]) == 0 {
+			return &CommandError{irc.ERR_NOTEXTTOSEND, []string{"No text to send"}}
 		}
+		text = m.Params[1]
+	}
+
+	targets := strings.Split(m.Params[0], ",")
+	if len(targets) > c.Server.Limits.MaxTargets {
+		return &CommandError{irc.ERR_TOOMANYTARGETS, []string{m.Params[0], "Too many targets. The maximum is " + strconv.Itoa(c.Server.Limits.MaxTargets) + "."}}
+	}
+
+	for _, target := range targets {
+		reply := make(chan *CommandError)
+		c.Server.Events <- &SPrivmsg{c, m.Command, target, text, m.Tags, reply}
+		if err := <-reply; err != nil && m.Command != irc.NOTICE {
+			c.sendError(err)
+		}
+	}
 
-		c.Registered = true
-		c.ConnectTime = time.Now()
-		c.Info.ChangeTime = time.Now()
+	return nil
+}
+
+func cmdPing(c *Client, m *Message) *CommandError {
+	if len(m.Params) == 0 {
+		return &CommandError{irc.ERR_NOORIGIN, []string{"No origin specified"}}
+	}
+
+	c.writeMessage(&irc.Message{
+		Prefix:  &irc.Prefix{Name: c.Server.FriendlyName()},
+		Command: irc.PONG,
+		Params:  []string{c.Server.FriendlyName(), m.Params[0]},
+	})
+	return nil
+}
+
+// cmdPong does nothing. The read loop treats any line as proof that the client
+// is still alive.
+func cmdPong(c *Client, m *Message) *CommandError {
+	return nil
+}
+
+func cmdLusers(c *Client, m *Message) *CommandError {
+	c.sendLusers()
+	return nil
+}
+
+// checkServerTarget checks that the optional target server parameter at index
+// i of m, if given, is this server.
+func checkServerTarget(c *Client, m *Message, i int) *CommandError {
+	if len(m.Params) > i && m.Params[i] != c.Server.FriendlyName() {
+		return &CommandError{irc.ERR_NOSUCHSERVER, []string{m.Params[i], "No such server"}}
+	}
+
+	return nil
+}
+
+func cmdMOTD(c *Client, m *Message) *CommandError {
+	if err := checkServerTarget(c, m, 0); err != nil {
+		return err
+	}
+
+	c.sendMOTD()
+	return nil
+}
+
+func cmdVersion(c *Client, m *Message) *CommandError {
+	if err := checkServerTarget(c, m, 0); err != nil {
+		return err
+	}
+
+	c.numeric(irc.RPL_VERSION, SoftwareName+"-"+SoftwareVersion+".", c.Server.FriendlyName(), "")
+	c.sendISupport()
+	return nil
+}
+
+func cmdTime(c *Client, m *Message) *CommandError {
+	if err := checkServerTarget(c, m, 0); err != nil {
+		return err
+	}
+
+	c.numeric(irc.RPL_TIME, c.Server.FriendlyName(), time.Now().Format(time.RFC1123))
+	return nil
+}
+
+func cmdAdmin(c *Client, m *Message) *CommandError {
+	if err := checkServerTarget(c, m, 0); err != nil {
+		return err
+	}
+
+	admin := c.Server.Admin
+	if admin == (AdminInfo{}) {
+		return &CommandError{irc.ERR_NOADMININFO, []string{c.Server.FriendlyName(), "No administrative info available"}}
+	}
+
+	c.numeric(irc.RPL_ADMINME, c.Server.FriendlyName(), "Administrative info")
+	c.numeric(irc.RPL_ADMINLOC1, admin.Location1)
+	c.numeric(irc.RPL_ADMINLOC2, admin.Location2)
+	c.numeric(irc.RPL_ADMINEMAIL, admin.Email)
+	return nil
+}
 
-		c.numeric(irc.RPL_WELCOME, "Welcome to the Internet Relay Network "+c.Info.String())
+func cmdQuit(c *Client, m *Message) *CommandError {
+	reason := "Client Quit"
+	if len(m.Params) > 0 && len(m.Params[0]) > 0 {
+		// Prefixing the reason stops clients from pretending that they were
+		// disconnected by the server.
+		reason = "Quit: " + m.Params[0]
 	}
 
+	c.close(reason)
 	return nil
 }
@@ -5,10 +5,19 @@
 
 package server
 
-import "github.com/sorcix/irc"
+import (
+	"github.com/nightexcessive/excessiveircd/history"
+	"github.com/nightexcessive/excessiveircd/protocol"
+)
 
 // Server events
 
+// SNewClient is used to inform the server of a new connection. The client
+// isn't registered until it's sent all of its registration information.
+type SNewClient struct {
+	Client *Client
+}
+
 // SRegisterClient is used to inform the server that a client has sent all
 // registration information and is ready to be registered. A boolean is sent on
 // the reply channel stating whether or not this registration was successful.
@@ -26,12 +35,211 @@ type SChangeNick struct {
 }
 
 // SDeregisterClient is used to inform the server that a client has disconnected
-// and registration information needs to be discarded.
+// and registration information needs to be discarded. Reason is sent in the
+// QUIT message to everyone who shares a channel with the client.
 type SDeregisterClient struct {
 	Client *Client
+	Reason string
+	Reply  chan struct{}
+}
+
+// SListClients is used to request a list of every connected client, including
+// clients that haven't registered yet.
+type SListClients struct {
+	Reply chan []*Client
+}
+
+// SJoinChannel is used to add a client to a channel, creating the channel if it
+// doesn't exist. The reply channel receives nil if the client joined
+// successfully, or the error to send to the client.
+type SJoinChannel struct {
+	Client *Client
+	Name   string
+	Key    string
+	Reply  chan *CommandError
+}
+
+// SPartChannel is used to remove a client from a channel. The reply channel
+// receives nil if the client left successfully, or the error to send to the
+// client.
+type SPartChannel struct {
+	Client *Client
+	Name   string
+	Reason string
+	Reply  chan *CommandError
+}
+
+// SPartAllChannels is used to remove a client from every channel that it's a
+// member of.
+type SPartAllChannels struct {
+	Client *Client
+	Reply  chan struct{}
+}
+
+// SNames is used to request that the names list of a channel be sent to a
+// client.
+type SNames struct {
+	Client *Client
+	Name   string
+	Reply  chan struct{}
+}
+
+// STopic is used to query or set the topic of a channel. If Set is false, the
+// current topic is sent to the client and Topic is ignored. The reply channel
+// receives nil on success, or the error to send to the client.
+type STopic struct {
+	Client *Client
+	Name   string
+	Topic  string
+	Set    bool
+	Reply  chan *CommandError
+}
+
+// SPrivmsg is used to deliver a PRIVMSG, NOTICE or TAGMSG to a client or
+// channel. Command is irc.PRIVMSG, irc.NOTICE or TAGMSG. Text is ignored for
+// TAGMSG. The client-only tags in Tags are relayed to recipients that can
+// receive them. The reply channel receives nil if the message was delivered,
+// or the error to send to the client.
+type SPrivmsg struct {
+	Client  *Client
+	Command string
+	Target  string
+	Text    string
+	Tags    protocol.Tags
+	Reply   chan *CommandError
+}
+
+// SLusers is used to request that user statistics be sent to a client.
+type SLusers struct {
+	Client *Client
+	Reply  chan struct{}
+}
+
+// SChatHistory is used to request history for a client. The server sends it to
+// the client itself. For the TARGETS subcommand, Target is empty and the bounds
+// of Query are the times to list targets between.
+type SChatHistory struct {
+	Client     *Client
+	Subcommand string
+	Target     string
+	Query      history.Query
+	Reply      chan struct{}
+}
+
+// SMonitor is used to handle a MONITOR subcommand. Targets is only set for the
+// + and - subcommands.
+type SMonitor struct {
+	Client     *Client
+	Subcommand string
+	Targets    []string
+	Reply      chan *CommandError
+}
+
+// SWhois is used to look up a client for WHOIS. The server sends the replies to
+// Client itself.
+type SWhois struct {
+	Client *Client
+	Nick   string
+	Reply  chan struct{}
+}
+
+// SWhowas is used to look up the history of a nickname for WHOWAS. At most
+// Count entries are sent, or all of them if Count isn't positive.
+type SWhowas struct {
+	Client *Client
+	Nick   string
+	Count  int
+	Reply  chan struct{}
+}
+
+// SWho is used to list the clients that match a mask for WHO. WHOX is nil
+// unless specific fields were requested.
+type SWho struct {
+	Client *Client
+	Mask   string
+	WHOX   *whoxQuery
+	Reply  chan struct{}
+}
+
+// SKick is used to remove a client from a channel on another client's behalf.
+type SKick struct {
+	Client *Client
+	Name   string
+	Nick   string
+	Reason string
+	Reply  chan *CommandError
+}
+
+// SInvite is used to invite the client named Nick to the channel named Name on
+// Client's behalf.
+type SInvite struct {
+	Client *Client
+	Nick   string
+	Name   string
+	Reply  chan *CommandError
+}
+
+// SKnock is used to ask the members of the channel named Name to invite
+// Client.
+type SKnock struct {
+	Client *Client
+	Name   string
+	Reply  chan *CommandError
+}
+
+// SChannelMode is used to query the modes of a channel or, if Set is true, to
+// change them.
+type SChannelMode struct {
+	Client  *Client
+	Name    string
+	Changes []ModeChange
+	Set     bool
+	Reply   chan *CommandError
+}
+
+// SList is used to list channels. If Names is empty, every channel that the
+// client can see is listed.
+type SList struct {
+	Client *Client
+	Names  []string
 	Reply  chan struct{}
 }
 
+// SNewLink is used to inform the server of a new connection to another server.
+// The link isn't established until the other server has authenticated.
+type SNewLink struct {
+	Link *Link
+}
+
+// SLinkEstablished is used to inform the server that the server on the other
+// side of a link, identified by ID and Name, has authenticated. The reply
+// channel receives nil if the server joined the network, or the reason that
+// the link must be closed.
+type SLinkEstablished struct {
+	Link  *Link
+	ID    string
+	Name  string
+	Reply chan error
+}
+
+// SLinkMessage is used to handle a message from a linked server.
+type SLinkMessage struct {
+	Link    *Link
+	Message *Message
+}
+
+// SLinkClosed is used to inform the server that a link has closed. Everything
+// that was reached through it is removed.
+type SLinkClosed struct {
+	Link *Link
+}
+
+// SListLinks is used to request a list of every link to another server,
+// including links that haven't been established yet.
+type SListLinks struct {
+	Reply chan []*Link
+}
+
 // Client events
 
 // CInitialize is used to inform the Client that it needs to initialize. These
@@ -42,7 +250,7 @@ type CInitialize struct{}
 // CMessage is used to inform the Client of an incoming message that has been
 // parsed and is ready to be acted upon.
 type CMessage struct {
-	Message *irc.Message
+	Message *Message
 }
 
 // CClose is used to inform the Client that it must immediately close the
@@ -51,3 +259,8 @@ type CMessage struct {
 type CClose struct {
 	Reason string
 }
+
+// CRegistrationTimeout is used to inform the Client that its registration
+// deadline has passed. If it hasn't registered yet, it must close the
+// connection.
+type CRegistrationTimeout struct{}
@@ -0,0 +1,229 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/nightexcessive/excessiveircd/protocol"
+)
+
+// ExtBanPrefix begins every extended ban mask.
+const ExtBanPrefix = '$'
+
+// ExtBan is a type of extended ban. Extended bans match clients by something
+// other than their hostmask and may be used in any of a channel's lists. They're
+// written as $type:arg, or $~type:arg to match the clients that $type:arg
+// doesn't. The argument is optional for some types.
+type ExtBan interface {
+	// Normalize checks that arg, which may be empty, is a valid argument and
+	// returns the form of it that's stored in the list.
+	Normalize(s *Server, arg string) (string, bool)
+
+	// Match checks if c matches the ban with the given argument. It's called
+	// from the Server's event loop.
+	Match(s *Server, c *Client, arg string) bool
+}
+
+// QuietExtBan is implemented by extended bans that only stop the clients that
+// they match from speaking in the channel, rather than from joining it.
+type QuietExtBan interface {
+	ExtBan
+
+	Quiet() bool
+}
+
+var extBans = make(map[byte]ExtBan)
+
+// registerExtBan registers an extended ban type.
+func registerExtBan(name byte, ban ExtBan) {
+	if _, ok := extBans[name]; ok {
+		panic("server: extended ban registered twice: " + string(name))
+	}
+
+	extBans[name] = ban
+}
+
+func init() {
+	registerExtBan('a', accountBan{})
+	registerExtBan('r', realnameBan{})
+	registerExtBan('c', channelBan{})
+	registerExtBan('q', quietBan{})
+
+	registerISupport("EXTBAN", func(*Server) (string, bool) {
+		names := make([]byte, 0, len(extBans))
+		for name := range extBans {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+
+		return string(ExtBanPrefix) + "," + string(names), true
+	})
+}
+
+// extBanMask is a parsed extended ban mask.
+type extBanMask struct {
+	Type   byte
+	Negate bool
+	Arg    string
+}
+
+// parseExtBan parses mask as an extended ban. It returns false if mask isn't
+// one.
+func parseExtBan(mask string) (extBanMask, bool) {
+	if len(mask) < 2 || mask[0] != ExtBanPrefix {
+		return extBanMask{}, false
+	}
+	mask = mask[1:]
+
+	var ext extBanMask
+	if mask[0] == '~' {
+		ext.Negate = true
+		mask = mask[1:]
+	}
+	if len(mask) == 0 {
+		return extBanMask{}, false
+	}
+
+	ext.Type = mask[0]
+	switch {
+	case len(mask) == 1:
+	case mask[1] == ':':
+		ext.Arg = mask[2:]
+	default:
+		return extBanMask{}, false
+	}
+
+	return ext, true
+}
+
+func (ext extBanMask) String() string {
+	mask := string(ExtBanPrefix)
+	if ext.Negate {
+		mask += "~"
+	}
+	mask += string(ext.Type)
+	if len(ext.Arg) > 0 {
+		mask += ":" + ext.Arg
+	}
+
+	return mask
+}
+
+// normalizeMask returns the form of mask that's stored in a channel's list.
+// Hostmasks are completed and extended bans are checked and normalized by
+// their type. It returns false if mask is an invalid extended ban.
+func (s *Server) normalizeMask(mask string) (string, bool) {
+	if len(mask) == 0 || mask[0] != ExtBanPrefix {
+		return protocol.CompleteMask(mask), true
+	}
+
+	ext, ok := parseExtBan(mask)
+	if !ok {
+		return "", false
+	}
+
+	ban, ok := extBans[ext.Type]
+	if !ok {
+		return "", false
+	}
+
+	if ext.Arg, ok = ban.Normalize(s, ext.Arg); !ok {
+		return "", false
+	}
+
+	return ext.String(), true
+}
+
+// isQuietMask checks if mask is an extended ban that only stops clients from
+// speaking.
+func isQuietMask(mask string) bool {
+	ext, ok := parseExtBan(mask)
+	if !ok {
+		return false
+	}
+
+	quiet, ok := extBans[ext.Type].(QuietExtBan)
+	return ok && quiet.Quiet()
+}
+
+// matchesMask checks if mask, a hostmask or extended ban, matches c. hostmasks
+// holds c's hostmasks.
+func (s *Server) matchesMask(mask string, c *Client, hostmasks []string) bool {
+	ext, ok := parseExtBan(mask)
+	if !ok {
+		return protocol.MatchHostmask(mask, s.fold, hostmasks...)
+	}
+
+	ban, ok := extBans[ext.Type]
+	if !ok {
+		return false
+	}
+
+	return ban.Match(s, c, ext.Arg) != ext.Negate
+}
+
+// accountBan matches clients that are logged in to an account matching its
+// argument, or to any account if it has none. $~a matches clients that aren't
+// logged in.
+type accountBan struct{}
+
+func (accountBan) Normalize(s *Server, arg string) (string, bool) {
+	return arg, true
+}
+
+func (accountBan) Match(s *Server, c *Client, arg string) bool {
+	if len(c.Info.Account) == 0 {
+		return false
+	}
+
+	return len(arg) == 0 || protocol.Match(s.fold(arg), s.fold(c.Info.Account))
+}
+
+// realnameBan matches clients whose real name matches its argument.
+type realnameBan struct{}
+
+func (realnameBan) Normalize(s *Server, arg string) (string, bool) {
+	return arg, len(arg) > 0
+}
+
+func (realnameBan) Match(s *Server, c *Client, arg string) bool {
+	return protocol.Match(strings.ToLower(arg), strings.ToLower(c.Info.Real))
+}
+
+// channelBan matches clients that are members of the channel named by its
+// argument.
+type channelBan struct{}
+
+func (channelBan) Normalize(s *Server, arg string) (string, bool) {
+	return arg, s.isChannelName(arg)
+}
+
+func (channelBan) Match(s *Server, c *Client, arg string) bool {
+	_, ok := c.Channels[s.fold(arg)]
+	return ok
+}
+
+// quietBan matches the clients that its argument, a hostmask or another
+// extended ban, matches, but only stops them from speaking.
+type quietBan struct{}
+
+func (quietBan) Normalize(s *Server, arg string) (string, bool) {
+	if len(arg) == 0 {
+		return "", false
+	}
+
+	return s.normalizeMask(arg)
+}
+
+func (quietBan) Match(s *Server, c *Client, arg string) bool {
+	return s.matchesMask(arg, c, c.hostmasks())
+}
+
+func (quietBan) Quiet() bool {
+	return true
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import "testing"
+
+func TestParseExtBan(t *testing.T) {
+	tests := []struct {
+		mask     string
+		expected extBanMask
+		ok       bool
+	}{
+		{"$a:alice", extBanMask{Type: 'a', Arg: "alice"}, true},
+		{"$~a", extBanMask{Type: 'a', Negate: true}, true},
+		{"$c:#chan", extBanMask{Type: 'c', Arg: "#chan"}, true},
+		{"$q:$a:bob", extBanMask{Type: 'q', Arg: "$a:bob"}, true},
+		{"$", extBanMask{}, false},
+		{"$~", extBanMask{}, false},
+		{"$ab", extBanMask{}, false},
+		{"nick!user@host", extBanMask{}, false},
+	}
+
+	for _, test := range tests {
+		ext, ok := parseExtBan(test.mask)
+		if ok != test.ok || ext != test.expected {
+			t.Errorf("parseExtBan(%q) = %v, %v; expected %v, %v", test.mask, ext, ok, test.expected, test.ok)
+		}
+		if ok && ext.String() != test.mask {
+			t.Errorf("Expected %q to format as itself, got %q", test.mask, ext.String())
+		}
+	}
+}
+
+func TestNormalizeMask(t *testing.T) {
+	tests := []struct {
+		mask, expected string
+		ok             bool
+	}{
+		{"bob", "bob!*@*", true},
+		{"$a", "$a", true},
+		{"$r:*bot*", "$r:*bot*", true},
+		{"$r", "", false},
+		{"$c:nochan", "", false},
+		{"$q:bob", "$q:bob!*@*", true},
+		{"$q:$~a", "$q:$~a", true},
+		{"$q", "", false},
+		{"$z:x", "", false},
+	}
+
+	s := &Server{Casemapping: DefaultCasemapping}
+	for _, test := range tests {
+		mask, ok := s.normalizeMask(test.mask)
+		if ok != test.ok || mask != test.expected {
+			t.Errorf("normalizeMask(%q) = %q, %v; expected %q, %v", test.mask, mask, ok, test.expected, test.ok)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nightexcessive/excessiveircd/config"
+	"github.com/nightexcessive/excessiveircd/history"
+	"github.com/nightexcessive/excessiveircd/protocol"
+	"github.com/sorcix/irc"
+)
+
+const capChatHistory = "draft/chathistory"
+
+func init() {
+	registerCapability(&Capability{Name: capChatHistory})
+
+	registerISupport("CHATHISTORY", func(s *Server) (string, bool) {
+		return strconv.Itoa(s.Limits.ChatHistory), s.History != nil
+	})
+	registerISupport("MSGREFTYPES", func(s *Server) (string, bool) {
+		return "timestamp,msgid", s.History != nil
+	})
+}
+
+// HistoryStore stores the history of channels and private conversations. The
+// history package provides stores that keep it in memory and on disk. Stores
+// are used from the Server's event loop, so they should be quick.
+type HistoryStore interface {
+	// Add adds m to the history of target, discarding any messages that
+	// retention no longer allows to be kept.
+	Add(target string, m history.Message, retention history.Retention) error
+
+	// Query returns the messages in the history of target that match q, in
+	// chronological order.
+	Query(target string, q history.Query) ([]history.Message, error)
+
+	// Targets returns the targets whose latest message was sent between start
+	// and end, from the least to the most recently active.
+	Targets(start, end time.Time) ([]history.Target, error)
+}
+
+// HistoryConfig configures the history that the server keeps. It's loaded from
+// the "history" configuration key. Any settings that aren't set there keep
+// their default values.
+type HistoryConfig struct {
+	// Store is where history is kept: "memory", "disk" or "none". Disk history
+	// is kept in the history directory of the configuration directory.
+	Store string
+
+	// Retention limits how much history is kept for each channel and private
+	// conversation.
+	Retention history.Retention
+
+	// Channels overrides Retention for individual channels, keyed by channel
+	// name.
+	Channels map[string]history.Retention
+}
+
+// DefaultHistoryConfig is the history configuration that's used if it isn't set
+// in the configuration.
+var DefaultHistoryConfig = HistoryConfig{
+	Store: "memory",
+	Retention: history.Retention{
+		Length: 1000,
+		Age:    7 * 24 * time.Hour,
+	},
+}
+
+// openHistory creates the HistoryStore that HistoryConfig asks for.
+func (s *Server) openHistory() error {
+	switch s.HistoryConfig.Store {
+	case "memory":
+		s.History = history.NewMemoryStore()
+	case "disk":
+		store, err := history.NewDiskStore(config.Path("history"))
+		if err != nil {
+			return err
+		}
+		s.History = store
+	case "none":
+		s.History = nil
+	default:
+		return errors.New("unknown history store: " + s.HistoryConfig.Store)
+	}
+
+	return nil
+}
+
+// isChannelTarget checks if target is meant to be a channel rather than a
+// nickname.
+func isChannelTarget(target string) bool {
+	return len(target) > 0 && strings.ContainsRune(protocol.ChannelTypes, rune(target[0]))
+}
+
+// Private conversations are stored under the identities of their participants
+// rather than their nicknames, so that they don't pass to whoever uses a
+// nickname next. A client's identity is its account if it's logged in and its
+// ID otherwise.
+const (
+	accountHistoryIdentity = "account:"
+	clientHistoryIdentity  = "client:"
+)
+
+// historyIdentity returns the identity that c's private conversations are
+// stored under.
+func (s *Server) historyIdentity(c *Client) string {
+	if len(c.Info.Account) > 0 {
+		return accountHistoryIdentity + s.fold(c.Info.Account)
+	}
+
+	return clientHistoryIdentity + c.ID.String()
+}
+
+// nickHistoryIdentity returns the identity of the client using nick. If nobody
+// is, nick is taken to be the name of an account, so that conversations with
+// users who have logged off can still be read.
+func (s *Server) nickHistoryIdentity(nick string) string {
+	if c, ok := s.Clients[s.fold(nick)]; ok {
+		return s.historyIdentity(c)
+	}
+
+	return accountHistoryIdentity + s.fold(nick)
+}
+
+// identityNick returns the nickname that the private conversation with
+// identity should be listed under, or false if it can't be read any more.
+func (s *Server) identityNick(identity string) (string, bool) {
+	switch {
+	case strings.HasPrefix(identity, clientHistoryIdentity):
+		c, ok := s.ClientIDs[strings.TrimPrefix(identity, clientHistoryIdentity)]
+		if !ok {
+			return "", false
+		}
+		return c.Info.Name, true
+	case strings.HasPrefix(identity, accountHistoryIdentity):
+		account := strings.TrimPrefix(identity, accountHistoryIdentity)
+		for _, c := range s.ClientIDs {
+			if len(c.Info.Account) > 0 && s.fold(c.Info.Account) == account {
+				return c.Info.Name, true
+			}
+		}
+		return account, true
+	}
+
+	return "", false
+}
+
+// privateHistoryKey returns the key that the private conversation between the
+// identities a and b is stored under. It's stored once for both of them.
+func privateHistoryKey(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+
+	// Commas can't appear in identities.
+	return a + "," + b
+}
+
+// historyRetention returns the retention of the history stored under key.
+func (s *Server) historyRetention(key string) history.Retention {
+	for name, retention := range s.HistoryConfig.Channels {
+		if s.fold(name) == key {
+			return retention
+		}
+	}
+
+	return s.HistoryConfig.Retention
+}
+
+// addHistory adds a message that was relayed from c with tags to the history
+// stored under key.
+func (s *Server) addHistory(key string, c *Client, command, target, text string, tags protocol.Tags) {
+	if s.History == nil {
+		return
+	}
+
+	// The stored time must be exactly the one that clients were sent, so that
+	// they can refer to the message by it.
+	sent, err := time.Parse(serverTimeFormat, tags["time"])
+	if err != nil {
+		sent = time.Now()
+	}
+
+	m := history.Message{
+		ID:      tags["msgid"],
+		Time:    sent,
+		Source:  c.Info.Prefix.String(),
+		Account: c.Info.Account,
+		Command: command,
+		Target:  target,
+		Text:    text,
+		Tags:    tags.ClientOnly(),
+	}
+	if err := s.History.Add(key, m, s.historyRetention(key)); err != nil {
+		s.Logger.Printf("Error adding to the history of %s: %s", key, err)
+	}
+}
+
+// parseHistoryBound parses a message reference given to CHATHISTORY, which is
+// either timestamp=<time> or msgid=<id>. If star is true, "*" is also accepted
+// and gives the zero Bound.
+func parseHistoryBound(ref string, star bool) (history.Bound, bool) {
+	switch {
+	case star && ref == "*":
+		return history.Bound{}, true
+	case strings.HasPrefix(ref, "msgid="):
+		id := strings.TrimPrefix(ref, "msgid=")
+		return history.Bound{ID: id}, len(id) > 0
+	case strings.HasPrefix(ref, "timestamp="):
+		t, err := time.Parse(serverTimeFormat, strings.TrimPrefix(ref, "timestamp="))
+		return history.Bound{Time: t}, err == nil
+	}
+
+	return history.Bound{}, false
+}
+
+func cmdChatHistory(c *Client, m *Message) *CommandError {
+	subcommand := strings.ToUpper(m.Params[0])
+	params := m.Params[1:]
+
+	needed := 3
+	switch subcommand {
+	case "LATEST", "BEFORE", "AFTER", "AROUND", "TARGETS":
+	case "BETWEEN":
+		needed = 4
+	default:
+		c.fail(CHATHISTORY, "UNKNOWN_COMMAND", subcommand, "Unknown subcommand")
+		return nil
+	}
+	if len(params) < needed {
+		c.fail(CHATHISTORY, "NEED_MORE_PARAMS", subcommand, "Not enough parameters")
+		return nil
+	}
+
+	limit, err := strconv.Atoi(params[needed-1])
+	if err != nil || limit < 0 {
+		c.fail(CHATHISTORY, "INVALID_PARAMS", subcommand, params[needed-1], "Invalid limit")
+		return nil
+	}
+	if limit == 0 || limit > c.Server.Limits.ChatHistory {
+		limit = c.Server.Limits.ChatHistory
+	}
+
+	event := &SChatHistory{
+		Client:     c,
+		Subcommand: subcommand,
+		Query:      history.Query{Limit: limit},
+		Reply:      make(chan struct{}),
+	}
+
+	// TARGETS takes two timestamps instead of a target and references.
+	refs := params[1 : needed-1]
+	if subcommand == "TARGETS" {
+		refs = params[:2]
+	} else {
+		event.Target = params[0]
+	}
+
+	bounds := make([]history.Bound, len(refs))
+	for i, ref := range refs {
+		bound, ok := parseHistoryBound(ref, subcommand == "LATEST")
+		if !ok || (subcommand == "TARGETS" && len(bound.ID) > 0) {
+			c.fail(CHATHISTORY, "INVALID_PARAMS", subcommand, ref, "Invalid message reference")
+			return nil
+		}
+		bounds[i] = bound
+	}
+
+	switch subcommand {
+	case "LATEST":
+		event.Query.Start = bounds[0]
+		event.Query.Latest = true
+	case "BEFORE":
+		event.Query.End = bounds[0]
+		event.Query.Latest = true
+	case "AFTER":
+		event.Query.Start = bounds[0]
+	case "AROUND":
+		event.Query.Around = bounds[0]
+	case "BETWEEN", "TARGETS":
+		event.Query.Start, event.Query.End = bounds[0], bounds[1]
+	}
+
+	c.Server.Events <- event
+	<-event.Reply
+	return nil
+}
+
+// chatHistory sends the history of target that matches q to c in a chathistory
+// batch. Clients may only read the history of channels that they're in and, if
+// they're logged in, of their own private conversations.
+func (s *Server) chatHistory(c *Client, subcommand, target string, q history.Query) {
+	if s.History == nil {
+		c.fail(CHATHISTORY, "MESSAGE_ERROR", subcommand, target, "History isn't available on this server")
+		return
+	}
+
+	var key string
+	switch {
+	case isChannelTarget(target):
+		if _, ok := c.Channels[s.fold(target)]; !ok {
+			c.fail(CHATHISTORY, "INVALID_TARGET", subcommand, target, "You're not on that channel")
+			return
+		}
+		key = s.fold(target)
+	case !s.isNickname(target):
+		c.fail(CHATHISTORY, "INVALID_TARGET", subcommand, target, "Invalid target")
+		return
+	case len(c.Info.Account) == 0:
+		c.fail(CHATHISTORY, "INVALID_TARGET", subcommand, target, "You must be logged in to read private messages")
+		return
+	default:
+		key = privateHistoryKey(s.historyIdentity(c), s.nickHistoryIdentity(target))
+	}
+
+	retention := s.historyRetention(key)
+	if retention.Age > 0 {
+		q.Since = time.Now().Add(-retention.Age)
+	}
+	q.Retained = retention.Length
+
+	messages, err := s.History.Query(key, q)
+	if err != nil {
+		s.Logger.Printf("Error querying the history of %s: %s", key, err)
+		c.fail(CHATHISTORY, "MESSAGE_ERROR", subcommand, target, "Messages could not be retrieved")
+		return
+	}
+
+	b := c.startBatch(batchChatHistory, target)
+	for _, m := range messages {
+		tags := make(protocol.Tags, len(m.Tags)+3)
+		for key, value := range m.Tags {
+			tags[key] = value
+		}
+		tags["time"] = m.Time.UTC().Format(serverTimeFormat)
+		tags["msgid"] = m.ID
+		if len(m.Account) > 0 {
+			tags["account"] = m.Account
+		}
+
+		c.writeTaggedMessage(tags, &irc.Message{
+			Prefix:  irc.ParsePrefix(m.Source),
+			Command: m.Command,
+			Params:  []string{m.Target, m.Text},
+		})
+	}
+	b.End()
+}
+
+// chatHistoryTargets lists the channels and private conversations that c may
+// read the history of and that had messages between the bounds of q. Private
+// conversations are listed under the other participant's current nickname.
+func (s *Server) chatHistoryTargets(c *Client, q history.Query) {
+	if s.History == nil {
+		c.fail(CHATHISTORY, "MESSAGE_ERROR", "TARGETS", "History isn't available on this server")
+		return
+	}
+
+	start, end := q.Start.Time, q.End.Time
+	if start.After(end) {
+		start, end = end, start
+	}
+
+	targets, err := s.History.Targets(start, end)
+	if err != nil {
+		s.Logger.Printf("Error listing history targets: %s", err)
+		c.fail(CHATHISTORY, "MESSAGE_ERROR", "TARGETS", "Targets could not be retrieved")
+		return
+	}
+
+	b := c.startBatch(batchChatHistoryTargets)
+	sent := 0
+	for _, target := range targets {
+		if sent >= q.Limit {
+			break
+		}
+
+		// Channels are stored under their folded names and private
+		// conversations under the identities of their participants.
+		name := target.Name
+		if isChannelTarget(name) {
+			channel, ok := c.Channels[name]
+			if !ok {
+				continue
+			}
+			name = channel.Name
+		} else {
+			if len(c.Info.Account) == 0 {
+				continue
+			}
+
+			identity := s.historyIdentity(c)
+			identities := strings.SplitN(name, ",", 2)
+			var other string
+			switch {
+			case len(identities) != 2:
+				continue
+			case identities[0] == identity:
+				other = identities[1]
+			case identities[1] == identity:
+				other = identities[0]
+			default:
+				continue
+			}
+
+			var ok bool
+			if name, ok = s.identityNick(other); !ok {
+				continue
+			}
+		}
+
+		c.writeLine(nil, ":"+s.FriendlyName()+" "+CHATHISTORY+" TARGETS "+name+" "+target.Latest.UTC().Format(serverTimeFormat))
+		sent++
+	}
+	b.End()
+}
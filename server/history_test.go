@@ -0,0 +1,136 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nightexcessive/excessiveircd/history"
+	"github.com/sorcix/irc"
+)
+
+// newHistoryTestServer returns a server that keeps its history in memory.
+func newHistoryTestServer() *Server {
+	s := newLinkTestServer("irc.test")
+	s.HistoryConfig = DefaultHistoryConfig
+	s.History = history.NewMemoryStore()
+
+	return s
+}
+
+// newHistoryTestClient registers nick on s, logged into account if it isn't
+// empty.
+func newHistoryTestClient(t *testing.T, s *Server, nick, account string) *Client {
+	c := newLinkTestClient(t, s, nick)
+	c.Info.Account = account
+
+	return c
+}
+
+// historyLines runs a CHATHISTORY subcommand for c and returns what it's sent.
+func historyLines(c *Client, subcommand, target string) []string {
+	event := &SChatHistory{
+		Client:     c,
+		Subcommand: subcommand,
+		Target:     target,
+		Query:      history.Query{Limit: 100, Latest: true},
+		Reply:      make(chan struct{}),
+	}
+	if subcommand == "TARGETS" {
+		now := time.Now()
+		event.Query = history.Query{
+			Start: history.Bound{Time: now.Add(-time.Hour)},
+			End:   history.Bound{Time: now.Add(time.Hour)},
+			Limit: 100,
+		}
+	}
+
+	c.Server.Events <- event
+	<-event.Reply
+	return queued(c)
+}
+
+func disconnectTestClient(c *Client) {
+	reply := make(chan struct{})
+	c.Server.Events <- &SDeregisterClient{c, "Leaving", reply}
+	<-reply
+}
+
+func containsLine(lines []string, substr string) bool {
+	for _, line := range lines {
+		if strings.Contains(line, substr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestHistory_PrivateMessagesStayWithTheirOwners(t *testing.T) {
+	s := newHistoryTestServer()
+
+	alice := newHistoryTestClient(t, s, "alice", "alice")
+	bob := newHistoryTestClient(t, s, "bob", "bob")
+	if err := linkTestCommand(alice, irc.PRIVMSG, "bob", "the secret"); err != nil {
+		t.Fatalf("Couldn't send message: %s", err)
+	}
+	queued(alice)
+	queued(bob)
+
+	if lines := historyLines(bob, "LATEST", "alice"); !containsLine(lines, "the secret") {
+		t.Errorf("bob couldn't read the conversation: %q", lines)
+	}
+
+	// Someone else takes bob's nickname without logging in.
+	disconnectTestClient(bob)
+	mallory := newHistoryTestClient(t, s, "bob", "")
+	if lines := historyLines(mallory, "LATEST", "alice"); containsLine(lines, "the secret") || !containsLine(lines, "INVALID_TARGET") {
+		t.Errorf("The new holder of bob's nickname got %q", lines)
+	}
+	if lines := historyLines(mallory, "TARGETS", ""); containsLine(lines, "TARGETS alice") {
+		t.Errorf("The new holder of bob's nickname was listed %q", lines)
+	}
+	if lines := historyLines(alice, "LATEST", "bob"); containsLine(lines, "the secret") {
+		t.Errorf("alice was shown the old conversation with the new holder of bob's nickname: %q", lines)
+	}
+
+	// Logging in to a different account doesn't help.
+	disconnectTestClient(mallory)
+	mallory = newHistoryTestClient(t, s, "bob", "mallory")
+	if lines := historyLines(mallory, "LATEST", "alice"); containsLine(lines, "the secret") {
+		t.Errorf("The new holder of bob's nickname got %q", lines)
+	}
+	if lines := historyLines(mallory, "TARGETS", ""); containsLine(lines, "TARGETS alice") {
+		t.Errorf("The new holder of bob's nickname was listed %q", lines)
+	}
+
+	// bob can still read it under a different nickname.
+	bob = newHistoryTestClient(t, s, "robert", "bob")
+	if lines := historyLines(bob, "LATEST", "alice"); !containsLine(lines, "the secret") {
+		t.Errorf("bob couldn't read the conversation after reconnecting: %q", lines)
+	}
+	if lines := historyLines(bob, "TARGETS", ""); !containsLine(lines, "TARGETS alice ") {
+		t.Errorf("alice wasn't listed for bob: %q", lines)
+	}
+}
+
+func TestHistory_ChannelTargets(t *testing.T) {
+	s := newHistoryTestServer()
+
+	alice := newHistoryTestClient(t, s, "alice", "")
+	linkTestCommand(alice, irc.JOIN, "#MixedCase")
+	if err := linkTestCommand(alice, irc.PRIVMSG, "#mixedcase", "hi"); err != nil {
+		t.Fatalf("Couldn't send message: %s", err)
+	}
+	queued(alice)
+
+	lines := historyLines(alice, "TARGETS", "")
+	if !containsLine(lines, " TARGETS #MixedCase ") || containsLine(lines, " TARGETS #mixedcase ") {
+		t.Errorf("Expected the channel's own name, got %q", lines)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// cloakedHost returns the host that c would be shown with if its real host
+// were hidden. It's derived from c's IP address with a key that's unique to
+// the server, so it stays the same across connections but can't be reversed.
+// It's empty if c's IP address isn't known.
+func (c *Client) cloakedHost() string {
+	if c.IP == nil {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, c.Server.ID)
+	mac.Write(c.IP)
+	sum := hex.EncodeToString(mac.Sum(nil))
+
+	return sum[:8] + "." + sum[8:16] + ".ip"
+}
+
+// hostmasks returns the forms of c's hostmask that masks, such as bans, are
+// matched against: with its host, with its real IP address and with its
+// cloaked host.
+func (c *Client) hostmasks() []string {
+	prefix := c.Info.Name + "!" + c.Info.User + "@"
+
+	hostmasks := []string{prefix + c.Info.Host}
+	if c.IP != nil && c.IP.String() != c.Info.Host {
+		hostmasks = append(hostmasks, prefix+c.IP.String())
+	}
+	if cloak := c.cloakedHost(); len(cloak) > 0 {
+		hostmasks = append(hostmasks, prefix+cloak)
+	}
+
+	return hostmasks
+}
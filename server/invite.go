@@ -0,0 +1,131 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+const capInviteNotify = "invite-notify"
+
+func init() {
+	registerCapability(&Capability{Name: capInviteNotify})
+
+	registerISupport("KNOCK", isupportValue(""))
+}
+
+// isInvited checks if c has an invitation to the channel that hasn't expired.
+func (c *Client) isInvited(channel *Channel) bool {
+	expiry, ok := c.Invited[channel]
+	return ok && time.Now().Before(expiry)
+}
+
+// invite invites the client named nick to the channel named name on c's
+// behalf.
+func (s *Server) invite(c *Client, nick, name string) *CommandError {
+	target, ok := s.Clients[s.fold(nick)]
+	if !ok {
+		return &CommandError{irc.ERR_NOSUCHNICK, []string{nick, "No such nick/channel"}}
+	}
+
+	channel, ok := s.Channels[s.fold(name)]
+	if !ok {
+		return &CommandError{irc.ERR_NOSUCHCHANNEL, []string{name, "No such channel"}}
+	}
+
+	if _, ok := channel.Members[c]; !ok {
+		return &CommandError{irc.ERR_NOTONCHANNEL, []string{name, "You're not on that channel"}}
+	}
+	if _, ok := channel.Members[target]; ok {
+		return &CommandError{irc.ERR_USERONCHANNEL, []string{target.Info.Name, name, "is already on channel"}}
+	}
+
+	if channel.Modes['i'] && channel.privilege(c) < Halfop {
+		return &CommandError{irc.ERR_CHANOPRIVSNEEDED, []string{name, "You're not channel operator"}}
+	}
+
+	c.numeric(irc.RPL_INVITING, target.Info.Name, channel.Name)
+	s.deliverInvite(c, target, channel)
+
+	return nil
+}
+
+// deliverInvite records c's invitation of target to channel, sends it to target
+// and tells the channel's operators about it.
+func (s *Server) deliverInvite(c, target *Client, channel *Channel) {
+	// Expired invitations are dropped here so that they don't build up.
+	now := time.Now()
+	for invited, expiry := range target.Invited {
+		if !now.Before(expiry) {
+			delete(target.Invited, invited)
+		}
+	}
+	target.Invited[channel] = now.Add(s.Timeouts.InviteTimeout)
+
+	m := &irc.Message{
+		Prefix:  c.Info.Prefix,
+		Command: irc.INVITE,
+		Params:  []string{target.Info.Name, channel.Name},
+	}
+	tags := c.relayTags(nil)
+	target.relay(c, tags, m)
+
+	// Channel operators that asked for them are told about the invitation.
+	for member := range channel.Members {
+		if member == c || member == target || !member.HasCapability(capInviteNotify) {
+			continue
+		}
+		if channel.privilege(member) < Halfop {
+			continue
+		}
+
+		member.relay(c, tags, m)
+	}
+
+	s.propagate(c.link(), linkLine(c.ID.String(), irc.INVITE, target.ID.String(), channel.Name))
+}
+
+// knock asks the operators of the channel named name to invite c.
+func (s *Server) knock(c *Client, name string) *CommandError {
+	channel, ok := s.Channels[s.fold(name)]
+	if !ok {
+		return &CommandError{irc.ERR_NOSUCHCHANNEL, []string{name, "No such channel"}}
+	}
+
+	if _, ok := channel.Members[c]; ok {
+		return &CommandError{ERR_KNOCKONCHAN, []string{channel.Name, "You're already on that channel"}}
+	}
+	if !channel.Modes['i'] {
+		return &CommandError{ERR_CHANOPEN, []string{channel.Name, "Channel is open"}}
+	}
+	if s.isBanned(channel, c, false) {
+		return &CommandError{irc.ERR_BANNEDFROMCHAN, []string{channel.Name, "Cannot knock on channel (+b)"}}
+	}
+
+	now := time.Now()
+	if now.Sub(channel.LastKnock) < s.Timeouts.KnockInterval {
+		return &CommandError{ERR_TOOMANYKNOCK, []string{channel.Name, "Too many KNOCKs (channel)"}}
+	}
+	channel.LastKnock = now
+
+	s.deliverKnock(c, channel)
+	c.numeric(RPL_KNOCKDLVR, channel.Name, "Your KNOCK has been delivered")
+
+	return nil
+}
+
+// deliverKnock asks the channel's operators to invite c.
+func (s *Server) deliverKnock(c *Client, channel *Channel) {
+	for member := range channel.Members {
+		if channel.privilege(member) >= Halfop {
+			member.unsolicitedNumeric(RPL_KNOCK, channel.Name, c.Info.Prefix.String(), "has asked for an invite")
+		}
+	}
+
+	s.propagate(c.link(), linkLine(c.ID.String(), KNOCK, channel.Name))
+}
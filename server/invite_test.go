@@ -0,0 +1,177 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// knock runs KNOCK for c.
+func knock(c *Client, name string) *CommandError {
+	reply := make(chan *CommandError)
+	c.Server.Events <- &SKnock{c, name, reply}
+	return <-reply
+}
+
+func TestInvite_InviteOnly(t *testing.T) {
+	s := newLinkTestServer("irc.test")
+	alice := newLinkTestClient(t, s, "alice")
+	carol := newLinkTestClient(t, s, "carol")
+	bob := newLinkTestClient(t, s, "bob")
+
+	linkTestCommand(alice, irc.JOIN, "#p")
+	linkTestCommand(carol, irc.JOIN, "#p")
+	linkTestCommand(alice, irc.MODE, "#p", "+ik", "key")
+	if err := linkTestCommand(bob, irc.JOIN, "#p"); err == nil || err.Numeric != irc.ERR_INVITEONLYCHAN {
+		t.Fatalf("Joining an invite-only channel gave %v, want %s", err, irc.ERR_INVITEONLYCHAN)
+	}
+
+	if err := linkTestCommand(carol, irc.INVITE, "bob", "#p"); err == nil || err.Numeric != irc.ERR_CHANOPRIVSNEEDED {
+		t.Errorf("Inviting as a regular member gave %v, want %s", err, irc.ERR_CHANOPRIVSNEEDED)
+	}
+	if err := linkTestCommand(alice, irc.INVITE, "carol", "#p"); err == nil || err.Numeric != irc.ERR_USERONCHANNEL {
+		t.Errorf("Inviting a member gave %v, want %s", err, irc.ERR_USERONCHANNEL)
+	}
+
+	if err := linkTestCommand(alice, irc.INVITE, "bob", "#p"); err != nil {
+		t.Fatalf("Inviting as an operator failed: %v", err)
+	}
+	expectLine(t, alice, " "+irc.RPL_INVITING+" alice bob :#p")
+	expectLine(t, bob, ":alice!~alice@localhost INVITE bob :#p")
+
+	// The invitation gets bob past both +i and +k.
+	if err := linkTestCommand(bob, irc.JOIN, "#p"); err != nil {
+		t.Errorf("Joining after an invitation failed: %v", err)
+	}
+}
+
+func TestInvite_Expiry(t *testing.T) {
+	s := newLinkTestServer("irc.test")
+	s.Timeouts.InviteTimeout = time.Millisecond
+	alice := newLinkTestClient(t, s, "alice")
+	bob := newLinkTestClient(t, s, "bob")
+
+	linkTestCommand(alice, irc.JOIN, "#p")
+	linkTestCommand(alice, irc.MODE, "#p", "+i")
+	linkTestCommand(alice, irc.INVITE, "bob", "#p")
+	time.Sleep(10 * time.Millisecond)
+
+	if err := linkTestCommand(bob, irc.JOIN, "#p"); err == nil || err.Numeric != irc.ERR_INVITEONLYCHAN {
+		t.Errorf("Joining after the invitation expired gave %v, want %s", err, irc.ERR_INVITEONLYCHAN)
+	}
+}
+
+func TestInvite_Notify(t *testing.T) {
+	s := newLinkTestServer("irc.test")
+	alice := newLinkTestClient(t, s, "alice")
+	dave := newLinkTestClient(t, s, "dave")
+	dave.Capabilities[capInviteNotify] = true
+	erin := newLinkTestClient(t, s, "erin")
+	carol := newLinkTestClient(t, s, "carol")
+	carol.Capabilities[capInviteNotify] = true
+	bob := newLinkTestClient(t, s, "bob")
+
+	linkTestCommand(alice, irc.JOIN, "#p")
+	for _, c := range []*Client{dave, erin, carol} {
+		linkTestCommand(c, irc.JOIN, "#p")
+	}
+	linkTestCommand(alice, irc.MODE, "#p", "+oo", "dave", "erin")
+	for _, c := range []*Client{alice, dave, erin, carol} {
+		queued(c)
+	}
+
+	linkTestCommand(alice, irc.INVITE, "bob", "#p")
+	expectLine(t, bob, ":alice!~alice@localhost INVITE bob :#p")
+
+	// Only operators that asked for it are told.
+	expectLine(t, dave, ":alice!~alice@localhost INVITE bob :#p")
+	if lines := queued(erin); containsLine(lines, " INVITE ") {
+		t.Errorf("An operator without invite-notify was sent %q", lines)
+	}
+	if lines := queued(carol); containsLine(lines, " INVITE ") {
+		t.Errorf("A regular member was sent %q", lines)
+	}
+	if lines := queued(alice); containsLine(lines, " INVITE ") {
+		t.Errorf("The inviter was sent %q", lines)
+	}
+}
+
+func TestKnock(t *testing.T) {
+	s := newLinkTestServer("irc.test")
+	alice := newLinkTestClient(t, s, "alice")
+	carol := newLinkTestClient(t, s, "carol")
+	bob := newLinkTestClient(t, s, "bob")
+
+	linkTestCommand(alice, irc.JOIN, "#p")
+	linkTestCommand(carol, irc.JOIN, "#p")
+	if err := knock(bob, "#p"); err == nil || err.Numeric != ERR_CHANOPEN {
+		t.Errorf("Knocking on an open channel gave %v, want %s", err, ERR_CHANOPEN)
+	}
+
+	linkTestCommand(alice, irc.MODE, "#p", "+i")
+	if err := knock(carol, "#p"); err == nil || err.Numeric != ERR_KNOCKONCHAN {
+		t.Errorf("Knocking as a member gave %v, want %s", err, ERR_KNOCKONCHAN)
+	}
+	queued(carol)
+
+	if err := knock(bob, "#p"); err != nil {
+		t.Fatalf("Knocking failed: %v", err)
+	}
+	expectLine(t, bob, " "+RPL_KNOCKDLVR+" bob #p :Your KNOCK has been delivered")
+	expectLine(t, alice, " "+RPL_KNOCK+" alice #p bob!~bob@localhost :has asked for an invite")
+	if lines := queued(carol); containsLine(lines, " "+RPL_KNOCK+" ") {
+		t.Errorf("A regular member was sent %q", lines)
+	}
+
+	// The channel can only be knocked on once per interval, by anyone.
+	dave := newLinkTestClient(t, s, "dave")
+	if err := knock(dave, "#p"); err == nil || err.Numeric != ERR_TOOMANYKNOCK {
+		t.Errorf("Knocking again gave %v, want %s", err, ERR_TOOMANYKNOCK)
+	}
+	if lines := queued(alice); containsLine(lines, " "+RPL_KNOCK+" ") {
+		t.Errorf("A rate limited knock was delivered: %q", lines)
+	}
+}
+
+func TestKick_MultipleTargets(t *testing.T) {
+	s := newLinkTestServer("irc.test")
+	alice := newLinkTestClient(t, s, "alice")
+	bob := newLinkTestClient(t, s, "bob")
+	carol := newLinkTestClient(t, s, "carol")
+	newLinkTestClient(t, s, "dave")
+
+	for _, name := range []string{"#a", "#b"} {
+		for _, c := range []*Client{alice, bob, carol} {
+			linkTestCommand(c, irc.JOIN, name)
+		}
+	}
+	queued(alice)
+
+	// One channel with several nicknames.
+	m := &Message{Message: &irc.Message{Command: irc.KICK, Params: []string{"#a", "bob,dave,carol", "bye"}}}
+	if err := cmdKick(alice, m); err != nil {
+		t.Fatalf("Kicking failed: %v", err)
+	}
+	expectLine(t, alice, ":alice!~alice@localhost KICK #a bob :bye")
+	expectLine(t, alice, " "+irc.ERR_USERNOTINCHANNEL+" alice dave #a ")
+	expectLine(t, alice, ":alice!~alice@localhost KICK #a carol :bye")
+
+	// Channels paired with nicknames.
+	m.Params = []string{"#a,#b", "alice,bob"}
+	if err := cmdKick(alice, m); err != nil {
+		t.Fatalf("Kicking failed: %v", err)
+	}
+	expectLine(t, alice, ":alice!~alice@localhost KICK #a alice ")
+	expectLine(t, bob, ":alice!~alice@localhost KICK #b bob ")
+
+	m.Params = []string{"#a,#b", "alice,bob,carol"}
+	if err := cmdKick(alice, m); err == nil || err.Numeric != irc.ERR_NEEDMOREPARAMS {
+		t.Errorf("Mismatched channels and nicknames gave %v, want %s", err, irc.ERR_NEEDMOREPARAMS)
+	}
+}
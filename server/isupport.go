@@ -0,0 +1,119 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// maxISupportTokens is the number of tokens sent in a single
+	// RPL_ISUPPORT. The client's nickname and the trailing text take up the
+	// other two of the 15 parameters that a message may have.
+	maxISupportTokens = 13
+
+	isupportTrailing = "are supported by this server"
+)
+
+// ISupportFunc returns the value of an RPL_ISUPPORT token for s. If ok is
+// false, the token isn't sent. Tokens without a value are sent as just their
+// name.
+type ISupportFunc func(s *Server) (value string, ok bool)
+
+var isupportTokens = make(map[string]ISupportFunc)
+
+// registerISupport registers an RPL_ISUPPORT token. Each subsystem registers
+// the tokens that describe it from its init function, so that the tokens stay
+// in step with what the subsystem enforces.
+func registerISupport(name string, f ISupportFunc) {
+	if _, ok := isupportTokens[name]; ok {
+		panic("server: RPL_ISUPPORT token registered twice: " + name)
+	}
+
+	isupportTokens[name] = f
+}
+
+// isupportValue returns an ISupportFunc that always returns value.
+func isupportValue(value string) ISupportFunc {
+	return func(*Server) (string, bool) {
+		return value, true
+	}
+}
+
+// isupportEscaper escapes the characters that may not appear in RPL_ISUPPORT
+// values.
+var isupportEscaper = strings.NewReplacer(
+	`\`, `\x5C`,
+	" ", `\x20`,
+	"=", `\x3D`,
+)
+
+// isupport returns the server's RPL_ISUPPORT tokens, sorted by name.
+func (s *Server) isupport() []string {
+	names := make([]string, 0, len(isupportTokens))
+	for name := range isupportTokens {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tokens := make([]string, 0, len(names))
+	for _, name := range names {
+		value, ok := isupportTokens[name](s)
+		if !ok {
+			continue
+		}
+
+		if len(value) == 0 {
+			tokens = append(tokens, name)
+		} else {
+			tokens = append(tokens, name+"="+isupportEscaper.Replace(value))
+		}
+	}
+
+	return tokens
+}
+
+// splitISupport splits tokens into groups that can each be sent as a single
+// RPL_ISUPPORT. Each group has at most maxISupportTokens tokens, and the tokens
+// in a group take up at most maxLength bytes when joined by spaces.
+func splitISupport(tokens []string, maxLength int) [][]string {
+	var (
+		lines  [][]string
+		line   []string
+		length int
+	)
+
+	for _, token := range tokens {
+		if len(line) > 0 && (len(line) == maxISupportTokens || length+1+len(token) > maxLength) {
+			lines = append(lines, line)
+			line, length = nil, 0
+		}
+
+		if len(line) > 0 {
+			length++
+		}
+		line = append(line, token)
+		length += len(token)
+	}
+
+	if len(line) > 0 {
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// sendISupport sends the server's RPL_ISUPPORT tokens to c.
+func (c *Client) sendISupport() {
+	// :server 005 nick tokens :are supported by this server
+	maxLength := 510 - len(fmt.Sprintf(":%s %s %s  :%s", c.Server.FriendlyName(), RPL_ISUPPORT, c.Info.Name, isupportTrailing))
+
+	for _, tokens := range splitISupport(c.Server.isupport(), maxLength) {
+		c.numeric(RPL_ISUPPORT, append(tokens, isupportTrailing)...)
+	}
+}
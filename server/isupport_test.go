@@ -0,0 +1,49 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitISupport_TokenLimit(t *testing.T) {
+	tokens := make([]string, maxISupportTokens+1)
+	for i := range tokens {
+		tokens[i] = "A"
+	}
+
+	lines := splitISupport(tokens, 510)
+	if len(lines) != 2 || len(lines[0]) != maxISupportTokens || len(lines[1]) != 1 {
+		t.Errorf("Expected lines of %d and 1 tokens, got %v", maxISupportTokens, lines)
+	}
+}
+
+func TestSplitISupport_LengthLimit(t *testing.T) {
+	tokens := []string{"AAAA", "BBBB", "CCCC"}
+
+	lines := splitISupport(tokens, len("AAAA BBBB"))
+	expected := [][]string{{"AAAA", "BBBB"}, {"CCCC"}}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %v, got %v", expected, lines)
+	}
+}
+
+func TestISupport_Escaping(t *testing.T) {
+	s := &Server{Network: `My Net=\`, Limits: DefaultLimits}
+
+	for _, token := range s.isupport() {
+		if strings.HasPrefix(token, "NETWORK=") {
+			if expected := `NETWORK=My\x20Net\x3D\x5C`; token != expected {
+				t.Errorf("Expected %q, got %q", expected, token)
+			}
+			return
+		}
+	}
+
+	t.Error("NETWORK token wasn't sent")
+}
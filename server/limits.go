@@ -0,0 +1,45 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+// Limits holds the limits that a server enforces on its clients. They're loaded
+// from the "limits" configuration key. Any limits that aren't set there keep
+// their default values.
+type Limits struct {
+	// MaxTargets is the maximum number of comma-separated targets that a
+	// PRIVMSG or NOTICE may be sent to.
+	MaxTargets int
+
+	// Modes is the maximum number of channel modes with a parameter that may
+	// be changed by one MODE command.
+	Modes int
+
+	// ListEntries is the maximum number of entries that a channel's ban,
+	// exception and invite exception lists may hold between them.
+	ListEntries int
+
+	// ChatHistory is the maximum number of messages or targets that a
+	// CHATHISTORY request may return.
+	ChatHistory int
+
+	// Monitor is the maximum number of nicknames that a client may monitor.
+	Monitor int
+
+	// Whowas is the number of departed nicknames that are remembered for
+	// WHOWAS.
+	Whowas int
+}
+
+// DefaultLimits are the limits that are used if they aren't set in the
+// configuration.
+var DefaultLimits = Limits{
+	MaxTargets:  4,
+	Modes:       4,
+	ListEntries: 100,
+	ChatHistory: 100,
+	Monitor:     100,
+	Whowas:      100,
+}
@@ -0,0 +1,1418 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nightexcessive/excessiveircd/protocol"
+	"github.com/pborman/uuid"
+	"github.com/sorcix/irc"
+)
+
+// Servers link to each other with a line-based protocol that looks like the
+// client protocol. Every server is identified by its ID, and every client by
+// its ID, so that nicknames can change without the other servers losing track
+// of anyone. Timestamps are in Unix seconds.
+//
+// The server that connects sends its credentials first:
+//
+//	PASS <password>
+//	SERVER <server ID> <server name> :<description>
+//
+// The server that accepted the connection checks them against the link with
+// the same name in its configuration and replies with its own credentials, or
+// with ERROR if they're wrong. Once both sides have accepted each other, each
+// one sends a burst of everything that it knows about, ending with EOB:
+//
+//	:<uplink ID> SID <server ID> <server name> <hops>
+//	:<server ID> UID <client ID> <nick> <nick TS> <user> <host> <IP> <account> :<real name>
+//	:<server ID> SJOIN <channel TS> <channel> <modes> [<mode params>...] :<members>
+//	:<server ID> BMASK <channel TS> <channel> <list mode> <mask> <set by> <set TS>
+//	:<server ID> TB <channel> <topic TS> <set by> :<topic>
+//	:<server ID> EOB
+//
+// Servers are sent after the servers that introduced them. The account is *
+// for clients that aren't logged in. A host or IP that starts with ':', such as
+// ::1, is sent with a 0 in front of it. Each member in SJOIN is a client ID with
+// the prefixes of its privileges in front of it. Changes are then sent to every
+// other server as they happen:
+//
+//	:<client ID> NICK <nick> <nick TS>
+//	:<client ID> QUIT :<reason>
+//	:<server or client ID> KILL <client ID> :<reason>
+//	:<client ID> PART <channel> :<reason>
+//	:<client ID> KICK <channel> <client ID> :<reason>
+//	:<client ID> TOPIC <channel> :<topic>
+//	:<client ID> TMODE <channel TS> <channel> <modes> [<mode params>...]
+//	:<client ID> INVITE <client ID> <channel>
+//	:<client ID> KNOCK <channel>
+//	[@<tags>] :<client ID> PRIVMSG|NOTICE|TAGMSG <channel or client ID> [:<text>]
+//	:<server ID> SQUIT <server ID> :<reason>
+//
+// A client that joins a channel is sent as an SJOIN with only that client in
+// it. Prefix modes in TMODE take client IDs rather than nicknames. Tags on
+// messages are the ones that clients are sent, so every server sends the same
+// time and message ID.
+//
+// Conflicts are resolved with timestamps. If two servers have a channel with
+// different timestamps, the older channel wins: the newer one loses its modes,
+// lists and privileges, and the modes and privileges in the winner's SJOIN are
+// ignored by the loser. Mode changes with a channel timestamp newer than the
+// channel's are ignored. Nickname collisions are resolved with
+// ResolveCollision, and the clients that lose are killed on every server.
+//
+// Either side may send PING and must answer it with PONG. ERROR closes the link
+// with the given reason. When a link closes, each side removes the servers that
+// were behind it, along with their clients.
+
+const (
+	// linkSendQLength is the number of lines that may be waiting to be written
+	// to a linked server before the link is closed. It's large enough for a
+	// burst.
+	linkSendQLength = 64 * 1024
+
+	// maxLinkLineLen is the maximum length of a line from a linked server,
+	// including its tags but not its \r\n.
+	maxLinkLineLen = 32 * 1024
+
+	// linkRetryInterval is how long we wait between attempts to connect to a
+	// server.
+	linkRetryInterval = 30 * time.Second
+)
+
+// LinkConfig describes a server that may link to this one. The links are loaded
+// from the "links" configuration key.
+type LinkConfig struct {
+	// Name is the name of the server.
+	Name string
+
+	// Password is the password that both servers send to each other.
+	Password string
+
+	// Address is the address to connect to the server at. If it's empty, we
+	// wait for the server to connect to us.
+	Address string
+
+	// TLS specifies the TLS configuration to connect with. If nil, the
+	// connection is cleartext.
+	TLS *tls.Config
+}
+
+// RemoteServer represents a server that's part of the network, either linked
+// directly or through other servers. RemoteServers are owned by the Server's
+// event loop.
+type RemoteServer struct {
+	ID   string
+	Name string
+
+	// Hops is the number of links between us and the server.
+	Hops int
+
+	// Uplink is the ID of the server that introduced this one.
+	Uplink string
+
+	// Link is the link that the server is reached through.
+	Link *Link
+}
+
+// Link represents a connection to another server.
+type Link struct {
+	Server *Server
+
+	// Config is the configuration of the server on the other side of the
+	// link. It's nil for connections that we accepted until the other server
+	// has authenticated.
+	Config *LinkConfig
+
+	// Remote is the server on the other side of the link. It's set by the
+	// Server's event loop once the link is established.
+	Remote *RemoteServer
+
+	conn net.Conn
+	buf  *bufio.Reader
+
+	// partial holds the start of a line whose read was interrupted by the read
+	// deadline.
+	partial []byte
+
+	// sendQ holds lines that are waiting to be written to conn by writeLoop.
+	sendQ chan string
+
+	// done is closed when the link begins closing, and reason is why.
+	done      chan struct{}
+	reason    string
+	closeOnce sync.Once
+}
+
+// Link begins linking to another server over conn. config is the configuration
+// of the server that we connected to, or nil if the other server connected to
+// us. The link runs until either side closes it.
+func (s *Server) Link(conn net.Conn, config *LinkConfig) *Link {
+	l := &Link{
+		Server: s,
+		Config: config,
+		conn:   conn,
+		buf:    bufio.NewReader(conn),
+		sendQ:  make(chan string, linkSendQLength),
+		done:   make(chan struct{}),
+	}
+
+	s.connections.Add(1)
+	s.Events <- &SNewLink{l}
+
+	go l.readLoop()
+	go l.writeLoop()
+
+	return l
+}
+
+// connectLink connects to the server described by config and reconnects
+// whenever the link closes, until the server shuts down.
+func (s *Server) connectLink(config *LinkConfig) {
+	for {
+		var conn net.Conn
+		var err error
+		if config.TLS != nil {
+			conn, err = tls.Dial("tcp", config.Address, config.TLS)
+		} else {
+			conn, err = net.Dial("tcp", config.Address)
+		}
+
+		if err != nil {
+			s.Logger.Printf("Failed to connect to %s at %s: %s", config.Name, config.Address, err)
+		} else {
+			<-s.Link(conn, config).done
+		}
+
+		select {
+		case <-time.After(linkRetryInterval):
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// linkConfig returns the configuration of the named server, or nil if it may
+// not link to us.
+func (s *Server) linkConfig(name string) *LinkConfig {
+	for _, config := range s.LinkConfigs {
+		if config.Name == name {
+			return config
+		}
+	}
+
+	return nil
+}
+
+// send queues line to be written to the other server. It never blocks, so it
+// may be called from any goroutine. If the other server isn't reading quickly
+// enough to keep up, the link is closed.
+func (l *Link) send(line string) {
+	select {
+	case l.sendQ <- line:
+	default:
+		l.close("SendQ exceeded")
+	}
+}
+
+// close closes the link, telling the other server why. Only the first reason is
+// kept.
+func (l *Link) close(reason string) {
+	l.closeOnce.Do(func() {
+		l.reason = reason
+		select {
+		case l.sendQ <- "ERROR :" + reason:
+		default:
+		}
+		close(l.done)
+	})
+}
+
+var errLinkLineTooLong = errors.New("maximum line length exceeded")
+
+func (l *Link) readLine() (string, error) {
+	for {
+		b, err := l.buf.ReadSlice('\n')
+		if len(l.partial)+len(b) > maxLinkLineLen+len("\r\n") {
+			l.partial = nil
+			return "", errLinkLineTooLong
+		}
+
+		l.partial = append(l.partial, b...)
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err != nil {
+			// What we've read is kept, so a line that's interrupted by the
+			// read deadline is finished by the next call.
+			return "", err
+		}
+		break
+	}
+
+	line := bytes.TrimSuffix(l.partial[:len(l.partial)-1], []byte{'\r'})
+	l.partial = nil
+	return string(line), nil
+}
+
+// parseLinkLine parses a line from a linked server. Like client messages, the
+// trailing parameter is moved onto the end of the parameters. Unlike them, the
+// line has no length limit other than maxLinkLineLen, and the other parameters
+// may contain ':', which IPv6 addresses do.
+func parseLinkLine(line string) (*Message, error) {
+	tags, line, err := protocol.SplitTags(line, protocol.MaximumTagsLen-2)
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(irc.Message)
+	line = strings.TrimLeft(line, " ")
+	if strings.HasPrefix(line, ":") {
+		var source string
+		source, line, _ = strings.Cut(line[1:], " ")
+		if len(source) == 0 {
+			return nil, errors.New("invalid message")
+		}
+		m.Prefix = irc.ParsePrefix(source)
+	}
+
+	for {
+		line = strings.TrimLeft(line, " ")
+		if len(line) == 0 {
+			break
+		}
+		if len(m.Command) > 0 && line[0] == ':' {
+			m.Params = append(m.Params, line[1:])
+			break
+		}
+
+		var param string
+		param, line, _ = strings.Cut(line, " ")
+		if len(m.Command) == 0 {
+			m.Command = strings.ToUpper(param)
+		} else {
+			m.Params = append(m.Params, param)
+		}
+	}
+	if len(m.Command) == 0 {
+		return nil, errors.New("invalid message")
+	}
+
+	return &Message{m, tags}, nil
+}
+
+// linkLine formats a line to send to linked servers. The last parameter is
+// always sent as the trailing parameter. The others mustn't be empty or contain
+// spaces, and a 0 is put in front of any that start with ':'. Lines aren't cut
+// to the 510 bytes that clients are limited to, so messages with long IDs in
+// them arrive intact.
+func linkLine(source, command string, params ...string) string {
+	var b strings.Builder
+	b.WriteString(":" + source + " " + command)
+	for i, param := range params {
+		switch {
+		case i == len(params)-1:
+			b.WriteString(" :")
+		case strings.HasPrefix(param, ":"):
+			b.WriteString(" 0")
+		default:
+			b.WriteString(" ")
+		}
+		b.WriteString(param)
+	}
+	return b.String()
+}
+
+// linkParam returns the ith parameter of m, or an empty string if it wasn't
+// sent.
+func linkParam(m *Message, i int) string {
+	if i >= len(m.Params) {
+		return ""
+	}
+
+	return m.Params[i]
+}
+
+// formatTS formats t as a timestamp for the linking protocol.
+func formatTS(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// parseTS parses a timestamp from the linking protocol.
+func parseTS(ts string) (time.Time, bool) {
+	n, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(n, 0), true
+}
+
+func (l *Link) readLoop() {
+	l.close(l.run())
+	l.Server.Events <- &SLinkClosed{l}
+	l.Server.connections.Done()
+}
+
+// run authenticates the other server and then hands everything that it sends to
+// the Server's event loop. It returns the reason that the link closed.
+func (l *Link) run() string {
+	s := l.Server
+	if l.Config != nil {
+		l.sendCredentials()
+	}
+
+	l.conn.SetReadDeadline(time.Now().Add(s.Timeouts.RegistrationTimeout))
+	var password, id, name string
+	for len(id) == 0 {
+		line, err := l.readLine()
+		if err != nil {
+			return "Read error: " + err.Error()
+		}
+
+		m, err := parseLinkLine(line)
+		if err != nil {
+			return "Invalid line during authentication"
+		}
+
+		switch m.Command {
+		case irc.PASS:
+			password = linkParam(m, 0)
+		case SERVER:
+			id, name = linkParam(m, 0), linkParam(m, 1)
+			if len(id) == 0 || len(name) == 0 {
+				return "Invalid SERVER"
+			}
+		case irc.ERROR:
+			return "Remote error: " + linkParam(m, 0)
+		default:
+			return "Unexpected " + m.Command + " during authentication"
+		}
+	}
+
+	config := l.Config
+	if config == nil {
+		config = s.linkConfig(name)
+	}
+	if config == nil || config.Name != name || subtle.ConstantTimeCompare([]byte(password), []byte(config.Password)) != 1 {
+		return "Authentication failed"
+	}
+	if uuid.Parse(id) == nil {
+		return "Invalid server ID"
+	}
+
+	if l.Config == nil {
+		l.Config = config
+		l.sendCredentials()
+	}
+
+	reply := make(chan error)
+	s.Events <- &SLinkEstablished{l, id, name, reply}
+	if err := <-reply; err != nil {
+		return err.Error()
+	}
+
+	// pingSent is true if the other server has been idle long enough to be
+	// sent a PING and hasn't sent anything since.
+	pingSent := false
+	for {
+		if pingSent {
+			l.conn.SetReadDeadline(time.Now().Add(s.Timeouts.PingTimeout))
+		} else {
+			l.conn.SetReadDeadline(time.Now().Add(s.Timeouts.PingInterval))
+		}
+
+		line, err := l.readLine()
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			if pingSent {
+				return "Ping timeout"
+			}
+
+			l.send("PING :" + s.ID.String())
+			pingSent = true
+			continue
+		} else if err == io.EOF {
+			return "Connection closed"
+		} else if err != nil {
+			return "Read error: " + err.Error()
+		}
+		pingSent = false
+
+		m, err := parseLinkLine(line)
+		if err != nil {
+			s.Logger.Printf("Error in parsing %q from %s: %s", line, name, err)
+			continue
+		}
+
+		switch m.Command {
+		case irc.PING:
+			l.send("PONG :" + linkParam(m, 0))
+		case irc.PONG:
+		case irc.ERROR:
+			return "Remote error: " + linkParam(m, 0)
+		default:
+			s.Events <- &SLinkMessage{l, m}
+		}
+	}
+}
+
+// sendCredentials sends the password and our identity to the other server.
+func (l *Link) sendCredentials() {
+	s := l.Server
+	l.send("PASS :" + l.Config.Password)
+	l.send(formatMessage(&irc.Message{
+		Command: SERVER,
+		Params:  []string{s.ID.String(), s.FriendlyName(), SoftwareName + "-" + SoftwareVersion},
+	}))
+}
+
+func (l *Link) writeLoop() {
+	for {
+		select {
+		case line := <-l.sendQ:
+			if _, err := io.WriteString(l.conn, line+"\r\n"); err != nil {
+				l.close("Write error: " + err.Error())
+				l.conn.Close()
+				return
+			}
+		case <-l.done:
+			l.flush()
+			l.conn.Close()
+			return
+		}
+	}
+}
+
+// flush writes any lines that are still queued. It gives up after
+// flushTimeout.
+func (l *Link) flush() {
+	l.conn.SetWriteDeadline(time.Now().Add(flushTimeout))
+	for {
+		select {
+		case line := <-l.sendQ:
+			if _, err := io.WriteString(l.conn, line+"\r\n"); err != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// propagate sends line to every linked server except for except, which may be
+// nil.
+func (s *Server) propagate(except *Link, line string) {
+	for l := range s.Links {
+		if l != except && l.Remote != nil {
+			l.send(line)
+		}
+	}
+}
+
+// forward sends m, which was received from l, on to every other linked server.
+func (s *Server) forward(l *Link, m *Message) {
+	s.propagate(l, prefixTags(m.Tags, linkLine(linkSourceID(l, m), m.Command, m.Params...)))
+}
+
+// link returns the link that c is reached through, or nil if it's one of our
+// own clients.
+func (c *Client) link() *Link {
+	if c.Origin == nil {
+		return nil
+	}
+
+	return c.Origin.Link
+}
+
+// serverID returns the ID of the server that c is connected to.
+func (c *Client) serverID() string {
+	if c.Origin == nil {
+		return c.Server.ID.String()
+	}
+
+	return c.Origin.ID
+}
+
+// serverName returns the name of the server that c is connected to.
+func (c *Client) serverName() string {
+	if c.Origin == nil {
+		return c.Server.FriendlyName()
+	}
+
+	return c.Origin.Name
+}
+
+// serverRelayTags returns the tags to send with a message that's relayed from
+// a server rather than a client.
+func serverRelayTags() protocol.Tags {
+	return protocol.Tags{
+		"time":  time.Now().UTC().Format(serverTimeFormat),
+		"msgid": uuid.NewRandom().String(),
+	}
+}
+
+// establishLink adds the server on the other side of l to the network once it
+// has authenticated, and sends it everything that we know about.
+func (s *Server) establishLink(l *Link, id, name string) error {
+	if id == s.ID.String() {
+		return errors.New("Server is linking to itself")
+	}
+	if _, ok := s.Servers[id]; ok {
+		return errors.New("Server " + name + " is already linked")
+	}
+
+	remote := &RemoteServer{
+		ID:     id,
+		Name:   name,
+		Hops:   1,
+		Uplink: s.ID.String(),
+		Link:   l,
+	}
+	s.Servers[id] = remote
+	s.propagate(nil, linkLine(remote.Uplink, SID, id, name, "2"))
+	l.Remote = remote
+	s.Logger.Printf("Linked to %s (%s)", name, id)
+
+	s.sendBurst(l)
+	return nil
+}
+
+// sendBurst sends every server, client and channel that we know about to l.
+func (s *Server) sendBurst(l *Link) {
+	sid := s.ID.String()
+
+	servers := make([]*RemoteServer, 0, len(s.Servers))
+	for _, remote := range s.Servers {
+		if remote.Link != l {
+			servers = append(servers, remote)
+		}
+	}
+	// Every server has more hops than the server that introduced it.
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Hops < servers[j].Hops })
+	for _, remote := range servers {
+		l.send(linkLine(remote.Uplink, SID, remote.ID, remote.Name, strconv.Itoa(remote.Hops+1)))
+	}
+
+	for _, c := range s.ClientIDs {
+		if c.link() != l {
+			l.send(s.uidLine(c))
+		}
+	}
+
+	for _, channel := range s.Channels {
+		var members []*Member
+		for _, member := range channel.Members {
+			if member.Client.link() != l {
+				members = append(members, member)
+			}
+		}
+		if len(members) == 0 {
+			continue
+		}
+
+		for _, line := range s.sjoinLines(channel, members) {
+			l.send(line)
+		}
+		for mode, entries := range channel.Lists {
+			for _, entry := range entries {
+				l.send(linkLine(sid, BMASK, formatTS(channel.CreateTime), channel.Name, string(mode), entry.Mask, entry.SetBy, formatTS(entry.SetTime)))
+			}
+		}
+		if len(channel.Topic.Text) > 0 {
+			l.send(linkLine(sid, TB, channel.Name, formatTS(channel.Topic.SetTime), channel.Topic.SetBy, channel.Topic.Text))
+		}
+	}
+
+	l.send(linkLine(sid, EOB))
+}
+
+// uidLine returns the UID line that introduces c to other servers.
+func (s *Server) uidLine(c *Client) string {
+	ip := "*"
+	if c.IP != nil {
+		ip = c.IP.String()
+	}
+	account := "*"
+	if len(c.Info.Account) > 0 {
+		account = c.Info.Account
+	}
+
+	return linkLine(c.serverID(), UID, c.ID.String(), c.Info.Name, formatTS(c.Info.ChangeTime),
+		c.Info.User, c.Info.Host, ip, account, c.Info.Real)
+}
+
+// sjoinLines returns the SJOIN lines that send the channel's modes and members
+// to other servers.
+func (s *Server) sjoinLines(channel *Channel, members []*Member) []string {
+	modes := channel.modeString(true)
+
+	// Channels with too many members to fit in one line are sent in several.
+	maxLength := maxLinkLineLen - len(s.sjoinLine(channel, modes, nil))
+
+	var lines []string
+	var names []string
+	length := 0
+	send := func() {
+		lines = append(lines, s.sjoinLine(channel, modes, names))
+	}
+	for _, member := range members {
+		name := member.Privileges.Prefixes(true) + member.Client.ID.String()
+		if length+len(name) > maxLength && len(names) > 0 {
+			send()
+			names, length = names[:0], 0
+		}
+
+		names = append(names, name)
+		length += len(name) + 1
+	}
+	if len(names) > 0 {
+		send()
+	}
+
+	return lines
+}
+
+// sjoinLine returns an SJOIN line that sends the channel's timestamp, modes and
+// the given members, which are client IDs with prefixes, to other servers.
+func (s *Server) sjoinLine(channel *Channel, modes []string, names []string) string {
+	params := append([]string{formatTS(channel.CreateTime), channel.Name}, modes...)
+	return linkLine(s.ID.String(), SJOIN, append(params, strings.Join(names, " "))...)
+}
+
+// closeLink removes the servers behind l once it has closed.
+func (s *Server) closeLink(l *Link) {
+	delete(s.Links, l)
+	if l.Remote == nil {
+		return
+	}
+
+	s.Logger.Printf("Link to %s closed: %s", l.Remote.Name, l.reason)
+	s.propagate(l, linkLine(s.ID.String(), irc.SQUIT, l.Remote.ID, l.reason))
+	s.splitServer(l.Remote, s.FriendlyName()+" "+l.Remote.Name)
+}
+
+// splitServer removes remote and every server behind it from the network, along
+// with their clients, who quit with reason.
+func (s *Server) splitServer(remote *RemoteServer, reason string) {
+	gone := map[string]bool{remote.ID: true}
+	for found := true; found; {
+		found = false
+		for id, other := range s.Servers {
+			if !gone[id] && gone[other.Uplink] {
+				gone[id] = true
+				found = true
+			}
+		}
+	}
+
+	for id := range gone {
+		delete(s.Servers, id)
+	}
+	for id, c := range s.ClientIDs {
+		if c.Origin != nil && gone[c.Origin.ID] {
+			delete(s.ClientIDs, id)
+			s.removeClient(c, reason)
+		}
+	}
+}
+
+// removeClient removes c from the network without telling other servers.
+func (s *Server) removeClient(c *Client, reason string) {
+	delete(s.ClientIDs, c.ID.String())
+	if s.Clients[s.fold(c.Info.Name)] == c {
+		s.recordWhowas(c)
+	}
+	s.deregisterClient(c, reason)
+}
+
+// killClient removes c from the network, telling every linked server except
+// except. If c is one of our own clients, it's disconnected.
+func (s *Server) killClient(c *Client, reason string, except *Link) {
+	s.propagate(except, linkLine(s.ID.String(), irc.KILL, c.ID.String(), reason))
+
+	reason = "Killed (" + reason + ")"
+	s.removeClient(c, reason)
+	if c.Origin == nil {
+		go c.sendEvent(&CClose{reason})
+	}
+}
+
+// resolveNickCollision resolves a collision between incoming, which is taking
+// nick at ts, and whoever already has it. The existing client is killed if it
+// loses. It returns false if incoming loses, in which case the caller must kill
+// it.
+func (s *Server) resolveNickCollision(incoming *Client, nick string, ts time.Time) bool {
+	existing, ok := s.Clients[s.fold(nick)]
+	if !ok || existing == incoming {
+		return true
+	}
+
+	result := ResolveCollision(existing.Info.ChangeTime, ts)
+	if result != CollisionKeepExisting {
+		s.killClient(existing, "Nick collision", nil)
+	}
+
+	return result == CollisionKeepIncoming
+}
+
+// linkCommand is a command that linked servers may send.
+type linkCommand struct {
+	Func          func(s *Server, l *Link, m *Message)
+	MinimumParams int
+}
+
+var linkCommands = map[string]linkCommand{
+	SID:        {linkSID, 3},
+	UID:        {linkUID, 8},
+	SJOIN:      {linkSJoin, 4},
+	BMASK:      {linkBMask, 6},
+	TB:         {linkTB, 3},
+	EOB:        {linkEOB, 0},
+	TMODE:      {linkTMode, 3},
+	irc.SQUIT:  {linkSQuit, 1},
+	irc.NICK:   {linkNick, 2},
+	irc.QUIT:   {linkQuit, 0},
+	irc.KILL:   {linkKill, 1},
+	irc.PART:   {linkPart, 1},
+	irc.KICK:   {linkKick, 2},
+	irc.TOPIC:  {linkTopic, 1},
+	irc.INVITE: {linkInvite, 2},
+	KNOCK:      {linkKnock, 1},
+
+	irc.PRIVMSG: {linkPrivmsg, 1},
+	irc.NOTICE:  {linkPrivmsg, 1},
+	TAGMSG:      {linkPrivmsg, 1},
+}
+
+// handleLinkMessage handles a message from the server on the other side of l.
+func (s *Server) handleLinkMessage(l *Link, m *Message) {
+	// Lines that were read before the link was closed are ignored.
+	select {
+	case <-l.done:
+		return
+	default:
+	}
+
+	command, ok := linkCommands[strings.ToUpper(m.Command)]
+	if !ok {
+		s.Logger.Printf("Unknown command %s from %s", m.Command, l.Remote.Name)
+		return
+	}
+	if len(m.Params) < command.MinimumParams {
+		s.Logger.Printf("Not enough parameters for %s from %s", m.Command, l.Remote.Name)
+		return
+	}
+
+	command.Func(s, l, m)
+}
+
+// linkSource returns the client that sent m, or nil if it was sent by a server
+// or an unknown client.
+func (s *Server) linkSource(m *Message) *Client {
+	if m.Prefix == nil {
+		return nil
+	}
+
+	return s.ClientIDs[m.Prefix.Name]
+}
+
+// linkSourcePrefix returns the prefix to show clients for m's source, which may
+// be a client or a server.
+func (s *Server) linkSourcePrefix(m *Message) *irc.Prefix {
+	if c := s.linkSource(m); c != nil {
+		return c.Info.Prefix
+	}
+	if m.Prefix != nil {
+		if remote, ok := s.Servers[m.Prefix.Name]; ok {
+			return &irc.Prefix{Name: remote.Name}
+		}
+	}
+
+	return &irc.Prefix{Name: s.FriendlyName()}
+}
+
+func linkSID(s *Server, l *Link, m *Message) {
+	id, name := m.Params[0], m.Params[1]
+	if uuid.Parse(id) == nil {
+		l.close("Invalid server ID for " + name)
+		return
+	}
+	if _, ok := s.Servers[id]; ok || id == s.ID.String() {
+		l.close("Server " + name + " already exists")
+		return
+	}
+
+	// The server must be introduced by one that's behind the link, and be one
+	// hop further away than it.
+	uplink := linkSourceID(l, m)
+	introducer, ok := s.Servers[uplink]
+	if !ok || introducer.Link != l {
+		l.close("Server " + name + " was introduced by a server that isn't behind this link")
+		return
+	}
+	hops, err := strconv.Atoi(m.Params[2])
+	if err != nil || hops != introducer.Hops+1 {
+		l.close("Invalid hop count for server " + name)
+		return
+	}
+
+	s.Servers[id] = &RemoteServer{
+		ID:     id,
+		Name:   name,
+		Hops:   hops,
+		Uplink: uplink,
+		Link:   l,
+	}
+
+	s.propagate(l, linkLine(uplink, SID, id, name, strconv.Itoa(hops+1)))
+}
+
+func linkUID(s *Server, l *Link, m *Message) {
+	if m.Prefix == nil {
+		return
+	}
+	origin, ok := s.Servers[m.Prefix.Name]
+	if !ok || origin.Link != l {
+		l.close("Client introduced by a server that isn't behind this link")
+		return
+	}
+
+	id := uuid.Parse(m.Params[0])
+	ts, ok := parseTS(m.Params[2])
+	if id == nil || !ok {
+		return
+	}
+	if _, ok := s.ClientIDs[id.String()]; ok {
+		l.close("Client " + id.String() + " already exists")
+		return
+	}
+	if !s.isNickname(m.Params[1]) {
+		// Nobody else has been told about the client yet.
+		l.send(linkLine(s.ID.String(), irc.KILL, id.String(), "Invalid nickname"))
+		return
+	}
+
+	c := newRemoteClient(s, origin, id)
+	c.Info.Name = m.Params[1]
+	c.Info.ChangeTime = ts
+	c.Info.User = m.Params[3]
+	c.Info.Host = m.Params[4]
+	c.IP = net.ParseIP(m.Params[5])
+	if ip := net.ParseIP(c.Info.Host); ip != nil {
+		// Undo the 0 that was put in front of a host like ::1.
+		c.Info.Host = ip.String()
+	}
+	if account := m.Params[6]; account != "*" {
+		c.Info.Account = account
+	}
+	c.Info.Real = m.Params[7]
+	c.ConnectTime = ts
+
+	if !s.resolveNickCollision(c, c.Info.Name, ts) {
+		// Nobody else has been told about the client yet.
+		l.send(linkLine(s.ID.String(), irc.KILL, c.ID.String(), "Nick collision"))
+		return
+	}
+
+	s.Clients[s.fold(c.Info.Name)] = c
+	s.ClientIDs[c.ID.String()] = c
+	s.notifyMonitors(c.Info.Name, c)
+
+	s.propagate(l, s.uidLine(c))
+}
+
+// newRemoteClient returns a client that's connected to another server.
+func newRemoteClient(s *Server, origin *RemoteServer, id uuid.UUID) *Client {
+	c := &Client{
+		ID:         id,
+		Server:     s,
+		Logger:     s.Logger,
+		Origin:     origin,
+		Registered: true,
+
+		Capabilities: make(map[string]bool),
+
+		Channels:   make(map[string]*Channel),
+		Monitoring: make(map[string]string),
+		Invited:    make(map[*Channel]time.Time),
+
+		RWMutex: new(sync.RWMutex),
+	}
+	c.Info.Prefix = new(irc.Prefix)
+	c.lastActive = time.Now().UnixNano()
+
+	return c
+}
+
+func linkSJoin(s *Server, l *Link, m *Message) {
+	ts, ok := parseTS(m.Params[0])
+	if !ok {
+		return
+	}
+	name := m.Params[1]
+	if !s.isChannelName(name) {
+		return
+	}
+
+	channel, ok := s.Channels[s.fold(name)]
+	if !ok {
+		channel = newChannel(name)
+		channel.CreateTime = ts
+		channel.Modes = make(map[byte]bool)
+		s.Channels[s.fold(name)] = channel
+	}
+
+	// The older channel wins. If it's theirs, ours loses everything that it
+	// had set, and if it's ours, theirs does.
+	keepTheirs := ts.Unix() <= channel.CreateTime.Unix()
+	if ts.Unix() < channel.CreateTime.Unix() {
+		s.resetChannel(channel, ts)
+	}
+
+	modes := []string{"+"}
+	if keepTheirs {
+		modes = m.Params[2 : len(m.Params)-1]
+		changes, _ := parseModeChanges(modes[0], modes[1:], len(modes))
+		s.announceModes(channel, nil, s.linkSourcePrefix(m), s.applyRemoteModes(channel, changes, l.Remote.Name))
+	}
+
+	var joined []string
+	var granted []ModeChange
+	for _, name := range strings.Fields(m.Params[len(m.Params)-1]) {
+		var privilege Privilege
+		for len(name) > 0 {
+			p, ok := privilegeForPrefix(name[0])
+			if !ok {
+				break
+			}
+			privilege |= p
+			name = name[1:]
+		}
+
+		c, ok := s.ClientIDs[name]
+		if !ok || c.link() != l {
+			continue
+		}
+		if !keepTheirs {
+			privilege = 0
+		}
+
+		member, ok := channel.Members[c]
+		if !ok {
+			member = &Member{
+				Client:   c,
+				JoinTime: time.Now(),
+			}
+			channel.Members[c] = member
+			c.Channels[s.fold(channel.Name)] = channel
+			delete(c.Invited, channel)
+
+			channel.send(c, c.relayTags(nil), &irc.Message{
+				Prefix:  c.Info.Prefix,
+				Command: irc.JOIN,
+				Params:  []string{channel.Name},
+			}, nil)
+		}
+
+		for _, p := range privileges {
+			if privilege&p.Privilege != 0 && member.Privileges&p.Privilege == 0 {
+				member.Privileges |= p.Privilege
+				granted = append(granted, ModeChange{Add: true, Mode: p.Mode, Param: c.Info.Name})
+			}
+		}
+
+		joined = append(joined, privilege.Prefixes(true)+name)
+	}
+	s.announceModes(channel, nil, s.linkSourcePrefix(m), granted)
+
+	if len(channel.Members) == 0 {
+		delete(s.Channels, s.fold(channel.Name))
+		return
+	}
+	if len(joined) > 0 {
+		params := append([]string{formatTS(channel.CreateTime), channel.Name}, modes...)
+		s.propagate(l, linkLine(linkSourceID(l, m), SJOIN, append(params, strings.Join(joined, " "))...))
+	}
+}
+
+// linkSourceID returns the ID of the server or client that sent m, which was
+// received from l.
+func linkSourceID(l *Link, m *Message) string {
+	if m.Prefix == nil {
+		return l.Remote.ID
+	}
+
+	return m.Prefix.Name
+}
+
+// resetChannel takes away the channel's modes, lists and privileges because
+// another server has an older channel with the same name, whose timestamp is
+// ts.
+func (s *Server) resetChannel(channel *Channel, ts time.Time) {
+	var removed []ModeChange
+	for mode := range channel.Modes {
+		removed = append(removed, ModeChange{Mode: mode})
+	}
+	if len(channel.Key) > 0 {
+		removed = append(removed, ModeChange{Mode: 'k', Param: "*"})
+	}
+	if channel.Limit > 0 {
+		removed = append(removed, ModeChange{Mode: 'l'})
+	}
+	for mode, entries := range channel.Lists {
+		for _, entry := range entries {
+			removed = append(removed, ModeChange{Mode: mode, Param: entry.Mask})
+		}
+	}
+	for c, member := range channel.Members {
+		for _, p := range privileges {
+			if member.Privileges&p.Privilege != 0 {
+				removed = append(removed, ModeChange{Mode: p.Mode, Param: c.Info.Name})
+			}
+		}
+		member.Privileges = 0
+	}
+
+	channel.CreateTime = ts
+	channel.Modes = make(map[byte]bool)
+	channel.Lists = make(map[byte][]ListEntry)
+	channel.Key, channel.Limit = "", 0
+
+	s.announceModes(channel, nil, &irc.Prefix{Name: s.FriendlyName()}, removed)
+}
+
+// applyRemoteModes applies changes that were made on another server to the
+// channel. Nobody's permissions are checked, since the other server has already
+// done that. Prefix modes take client IDs. setBy is the name to record for
+// list entries that are added. It returns the changes that took effect, with
+// the nicknames of the clients whose privileges changed.
+func (s *Server) applyRemoteModes(channel *Channel, changes []ModeChange, setBy string) []ModeChange {
+	var applied []ModeChange
+	for _, change := range changes {
+		switch channelModeTypes[change.Mode] {
+		case ChannelModePrefix:
+			target, ok := s.ClientIDs[change.Param]
+			if !ok {
+				continue
+			}
+			member, ok := channel.Members[target]
+			if !ok {
+				continue
+			}
+
+			privilege, _ := privilegeForMode(change.Mode)
+			if (member.Privileges&privilege != 0) == change.Add {
+				continue
+			}
+			if change.Add {
+				member.Privileges |= privilege
+			} else {
+				member.Privileges &^= privilege
+			}
+			change.Param = target.Info.Name
+		case ChannelModeList:
+			if len(change.Param) == 0 {
+				continue
+			}
+			if !s.updateList(channel, &change, ListEntry{Mask: change.Param, SetBy: setBy, SetTime: time.Now()}) {
+				continue
+			}
+		default:
+			if !channel.applyModeChange(&change) {
+				continue
+			}
+		}
+
+		applied = append(applied, change)
+	}
+
+	return applied
+}
+
+// announceModes tells the channel's members about changes to its modes, which
+// were made by from. from is nil if a server made them, in which case prefix is
+// the server's.
+func (s *Server) announceModes(channel *Channel, from *Client, prefix *irc.Prefix, changes []ModeChange) {
+	tags := serverRelayTags()
+	if from != nil {
+		tags = from.relayTags(nil)
+	}
+
+	for len(changes) > 0 {
+		n := len(changes)
+		if n > s.Limits.Modes {
+			n = s.Limits.Modes
+		}
+
+		channel.send(from, tags, &irc.Message{
+			Prefix:  prefix,
+			Command: irc.MODE,
+			Params:  append([]string{channel.Name}, formatModeChanges(changes[:n])...),
+		}, nil)
+		changes = changes[n:]
+	}
+}
+
+// linkModeParams returns the mode string and parameters to send to other
+// servers for changes, which have the nicknames of the clients whose privileges
+// changed.
+func (s *Server) linkModeParams(changes []ModeChange) []string {
+	converted := make([]ModeChange, len(changes))
+	for i, change := range changes {
+		if channelModeTypes[change.Mode] == ChannelModePrefix {
+			if target, ok := s.Clients[s.fold(change.Param)]; ok {
+				change.Param = target.ID.String()
+			}
+		}
+		converted[i] = change
+	}
+
+	return formatModeChanges(converted)
+}
+
+func linkBMask(s *Server, l *Link, m *Message) {
+	channel, ok := s.Channels[s.fold(m.Params[1])]
+	if !ok {
+		return
+	}
+
+	ts, ok := parseTS(m.Params[0])
+	if !ok || ts.Unix() > channel.CreateTime.Unix() {
+		return
+	}
+
+	mode := m.Params[2]
+	if len(mode) != 1 || channelModeTypes[mode[0]] != ChannelModeList {
+		return
+	}
+	setTime, ok := parseTS(m.Params[5])
+	if !ok {
+		return
+	}
+
+	change := ModeChange{Add: true, Mode: mode[0]}
+	if s.updateList(channel, &change, ListEntry{Mask: m.Params[3], SetBy: m.Params[4], SetTime: setTime}) {
+		s.announceModes(channel, nil, s.linkSourcePrefix(m), []ModeChange{change})
+	}
+
+	s.forward(l, m)
+}
+
+func linkTB(s *Server, l *Link, m *Message) {
+	channel, ok := s.Channels[s.fold(m.Params[0])]
+	if !ok {
+		return
+	}
+
+	ts, ok := parseTS(m.Params[1])
+	if !ok {
+		return
+	}
+
+	// The older topic wins.
+	if len(channel.Topic.Text) > 0 && ts.Unix() >= channel.Topic.SetTime.Unix() {
+		return
+	}
+
+	topic := linkParam(m, 3)
+	if len(topic) == 0 {
+		return
+	}
+	channel.Topic.Text = topic
+	channel.Topic.SetBy = m.Params[2]
+	channel.Topic.SetTime = ts
+
+	channel.send(nil, serverRelayTags(), &irc.Message{
+		Prefix:  s.linkSourcePrefix(m),
+		Command: irc.TOPIC,
+		Params:  []string{channel.Name, topic},
+	}, nil)
+
+	s.forward(l, m)
+}
+
+func linkEOB(s *Server, l *Link, m *Message) {
+	if m.Prefix == nil || m.Prefix.Name == l.Remote.ID {
+		s.Logger.Printf("Finished receiving burst from %s", l.Remote.Name)
+	}
+}
+
+func linkTMode(s *Server, l *Link, m *Message) {
+	channel, ok := s.Channels[s.fold(m.Params[1])]
+	if !ok {
+		return
+	}
+
+	ts, ok := parseTS(m.Params[0])
+	if !ok || ts.Unix() > channel.CreateTime.Unix() {
+		return
+	}
+
+	from := s.linkSource(m)
+	setBy := l.Remote.Name
+	if from != nil {
+		setBy = from.Info.Name
+	}
+
+	changes, _ := parseModeChanges(m.Params[2], m.Params[3:], len(m.Params))
+	applied := s.applyRemoteModes(channel, changes, setBy)
+	s.announceModes(channel, from, s.linkSourcePrefix(m), applied)
+
+	s.forward(l, m)
+}
+
+func linkSQuit(s *Server, l *Link, m *Message) {
+	remote, ok := s.Servers[m.Params[0]]
+	if !ok || remote.Link != l {
+		return
+	}
+
+	uplink := s.FriendlyName()
+	if other, ok := s.Servers[remote.Uplink]; ok {
+		uplink = other.Name
+	}
+	s.Logger.Printf("%s split from %s: %s", remote.Name, uplink, linkParam(m, 1))
+
+	s.forward(l, m)
+	s.splitServer(remote, uplink+" "+remote.Name)
+}
+
+func linkNick(s *Server, l *Link, m *Message) {
+	c := s.linkSource(m)
+	ts, ok := parseTS(m.Params[1])
+	if c == nil || !ok {
+		return
+	}
+
+	nick := m.Params[0]
+	if !s.isNickname(nick) {
+		s.killClient(c, "Invalid nickname", nil)
+		return
+	}
+	if !s.resolveNickCollision(c, nick, ts) {
+		s.killClient(c, "Nick collision", nil)
+		return
+	}
+
+	if s.Clients[s.fold(c.Info.Name)] == c {
+		s.recordWhowas(c)
+	}
+	s.changeNick(c, nick, ts)
+}
+
+func linkQuit(s *Server, l *Link, m *Message) {
+	c := s.linkSource(m)
+	if c == nil {
+		return
+	}
+
+	s.removeClient(c, linkParam(m, 0))
+	s.forward(l, m)
+}
+
+func linkKill(s *Server, l *Link, m *Message) {
+	target, ok := s.ClientIDs[m.Params[0]]
+	if !ok {
+		return
+	}
+
+	reason := linkParam(m, 1)
+	if len(reason) == 0 {
+		reason = "No reason"
+	}
+	s.killClient(target, reason, l)
+}
+
+func linkPart(s *Server, l *Link, m *Message) {
+	if c := s.linkSource(m); c != nil {
+		s.partChannel(c, m.Params[0], linkParam(m, 1))
+	}
+}
+
+func linkKick(s *Server, l *Link, m *Message) {
+	channel, ok := s.Channels[s.fold(m.Params[0])]
+	if !ok {
+		return
+	}
+	target, ok := s.ClientIDs[m.Params[1]]
+	if !ok {
+		return
+	}
+	if _, ok := channel.Members[target]; !ok {
+		return
+	}
+
+	if c := s.linkSource(m); c != nil {
+		s.kickMember(c, channel, target, linkParam(m, 2))
+	}
+}
+
+func linkTopic(s *Server, l *Link, m *Message) {
+	channel, ok := s.Channels[s.fold(m.Params[0])]
+	if !ok {
+		return
+	}
+
+	if c := s.linkSource(m); c != nil {
+		s.setTopic(c, channel, linkParam(m, 1))
+	}
+}
+
+func linkInvite(s *Server, l *Link, m *Message) {
+	target, ok := s.ClientIDs[m.Params[0]]
+	if !ok {
+		return
+	}
+	channel, ok := s.Channels[s.fold(m.Params[1])]
+	if !ok {
+		return
+	}
+
+	if c := s.linkSource(m); c != nil {
+		s.deliverInvite(c, target, channel)
+	}
+}
+
+func linkKnock(s *Server, l *Link, m *Message) {
+	channel, ok := s.Channels[s.fold(m.Params[0])]
+	if !ok {
+		return
+	}
+
+	if c := s.linkSource(m); c != nil {
+		channel.LastKnock = time.Now()
+		s.deliverKnock(c, channel)
+	}
+}
+
+func linkPrivmsg(s *Server, l *Link, m *Message) {
+	c := s.linkSource(m)
+	if c == nil {
+		return
+	}
+
+	target := m.Params[0]
+	if !isChannelTarget(target) {
+		recipient, ok := s.ClientIDs[target]
+		if !ok {
+			return
+		}
+		target = recipient.Info.Name
+	}
+
+	s.privmsg(c, strings.ToUpper(m.Command), target, linkParam(m, 1), m.Tags)
+}
@@ -0,0 +1,559 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nightexcessive/excessiveircd/protocol"
+	"github.com/pborman/uuid"
+	"github.com/sorcix/irc"
+)
+
+const linkTestPassword = "secret"
+
+// newLinkTestServer returns a server that's running its event loop without
+// listening for anything. It accepts links from the named servers.
+func newLinkTestServer(name string, links ...string) *Server {
+	s := &Server{
+		ID:          uuid.NewRandom(),
+		Name:        name,
+		Logger:      log.New(ioutil.Discard, "", 0),
+		Casemapping: DefaultCasemapping,
+		Limits:      DefaultLimits,
+		Timeouts:    DefaultTimeouts,
+	}
+	for _, link := range links {
+		s.LinkConfigs = append(s.LinkConfigs, &LinkConfig{Name: link, Password: linkTestPassword})
+	}
+	s.initialize()
+	go s.eventLoop()
+
+	return s
+}
+
+// linkTestServers links a to b over a pipe, as though a had connected to b. It
+// returns a's side of the link.
+func linkTestServers(a, b *Server) *Link {
+	aConn, bConn := net.Pipe()
+	l := a.Link(aConn, a.linkConfig(b.Name))
+	b.Link(bConn, nil)
+
+	return l
+}
+
+// newLinkTestClient registers a client on s that queues its output without
+// being connected to anything.
+func newLinkTestClient(t *testing.T, s *Server, nick string) *Client {
+	c := &Client{
+		ID:         uuid.NewRandom(),
+		Server:     s,
+		Logger:     s.Logger,
+		Registered: true,
+
+		Capabilities: make(map[string]bool),
+
+		Channels:   make(map[string]*Channel),
+		Monitoring: make(map[string]string),
+		Invited:    make(map[*Channel]time.Time),
+
+		sendQ: make(chan string, sendQLength),
+		done:  make(chan struct{}),
+
+		RWMutex: new(sync.RWMutex),
+	}
+	c.Info.Prefix = &irc.Prefix{Name: nick, User: "~" + nick, Host: "localhost"}
+	c.Info.Real = nick
+	c.Info.ChangeTime = time.Now()
+
+	reply := make(chan bool)
+	s.Events <- &SRegisterClient{c, reply}
+	if !<-reply {
+		t.Fatalf("Couldn't register %s", nick)
+	}
+
+	return c
+}
+
+// expectLine waits for c to be sent a line that contains substr and returns
+// it. Lines before it are skipped.
+func expectLine(t *testing.T, c *Client, substr string) string {
+	t.Helper()
+
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case line := <-c.sendQ:
+			if strings.Contains(line, substr) {
+				return line
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for %q", substr)
+			return ""
+		}
+	}
+}
+
+// syncClients waits until from's server has sent everything that it's sent so
+// far to to's server, by sending a message from from to to.
+func syncClients(t *testing.T, from, to *Client, toNick string) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for linkTestCommand(from, irc.PRIVMSG, toNick, "sync") != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never appeared", toNick)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	expectLine(t, to, "PRIVMSG "+toNick+" :sync")
+}
+
+// linkTestCommand runs a command for c in its server's event loop.
+func linkTestCommand(c *Client, command string, params ...string) *CommandError {
+	reply := make(chan *CommandError)
+	var event interface{}
+	switch command {
+	case irc.JOIN:
+		event = &SJoinChannel{Client: c, Name: params[0], Reply: reply}
+	case irc.PRIVMSG:
+		event = &SPrivmsg{Client: c, Command: command, Target: params[0], Text: params[1], Reply: reply}
+	case irc.TOPIC:
+		event = &STopic{Client: c, Name: params[0], Topic: params[1], Set: true, Reply: reply}
+	case irc.KICK:
+		event = &SKick{Client: c, Name: params[0], Nick: params[1], Reply: reply}
+	case irc.INVITE:
+		event = &SInvite{Client: c, Nick: params[0], Name: params[1], Reply: reply}
+	case irc.MODE:
+		changes, _ := parseModeChanges(params[1], params[2:], len(params))
+		event = &SChannelMode{Client: c, Name: params[0], Changes: changes, Set: true, Reply: reply}
+	default:
+		panic("unsupported command " + command)
+	}
+
+	c.Server.Events <- event
+	return <-reply
+}
+
+func TestLink_Burst(t *testing.T) {
+	a := newLinkTestServer("a.test", "b.test")
+	b := newLinkTestServer("b.test", "a.test")
+
+	alice := newLinkTestClient(t, a, "alice")
+	linkTestCommand(alice, irc.JOIN, "#test")
+	linkTestCommand(alice, irc.TOPIC, "#test", "hello world")
+	linkTestCommand(alice, irc.MODE, "#test", "+kb", "key", "*!*@banned")
+	bob := newLinkTestClient(t, b, "bob")
+
+	linkTestServers(a, b)
+	syncClients(t, alice, bob, "bob")
+	syncClients(t, bob, alice, "alice")
+
+	if err := linkTestCommand(bob, irc.JOIN, "#test"); err == nil || err.Numeric != irc.ERR_BADCHANNELKEY {
+		t.Fatalf("Joining without the key gave %v, want %s", err, irc.ERR_BADCHANNELKEY)
+	}
+
+	reply := make(chan *CommandError)
+	b.Events <- &SJoinChannel{Client: bob, Name: "#TEST", Key: "key", Reply: reply}
+	if err := <-reply; err != nil {
+		t.Fatalf("Joining with the key failed: %v", err)
+	}
+	expectLine(t, bob, " 332 bob #test :hello world")
+	expectLine(t, bob, " 353 bob = #test :")
+	expectLine(t, alice, ":bob!~bob@localhost JOIN :#test")
+
+	b.Events <- &SChannelMode{Client: bob, Name: "#test", Changes: []ModeChange{{Add: true, Mode: 'b'}}, Set: true, Reply: reply}
+	<-reply
+	expectLine(t, bob, " 367 bob #test *!*@banned alice ")
+}
+
+func TestLink_Propagation(t *testing.T) {
+	a := newLinkTestServer("a.test", "b.test")
+	b := newLinkTestServer("b.test", "a.test")
+	alice := newLinkTestClient(t, a, "alice")
+	bob := newLinkTestClient(t, b, "bob")
+
+	linkTestServers(a, b)
+	syncClients(t, alice, bob, "bob")
+	syncClients(t, bob, alice, "alice")
+
+	linkTestCommand(alice, irc.JOIN, "#p")
+	linkTestCommand(alice, irc.MODE, "#p", "+i")
+	syncClients(t, alice, bob, "bob")
+	if err := linkTestCommand(bob, irc.JOIN, "#p"); err == nil || err.Numeric != irc.ERR_INVITEONLYCHAN {
+		t.Fatalf("Joining an invite-only channel gave %v, want %s", err, irc.ERR_INVITEONLYCHAN)
+	}
+
+	linkTestCommand(alice, irc.INVITE, "bob", "#p")
+	expectLine(t, bob, ":alice!~alice@localhost INVITE bob :#p")
+	if err := linkTestCommand(bob, irc.JOIN, "#p"); err != nil {
+		t.Fatalf("Joining after an invitation failed: %v", err)
+	}
+	expectLine(t, bob, " 353 bob = #p :")
+	expectLine(t, alice, ":bob!~bob@localhost JOIN :#p")
+
+	linkTestCommand(alice, irc.MODE, "#p", "+o", "bob")
+	expectLine(t, bob, ":alice!~alice@localhost MODE #p +o :bob")
+
+	linkTestCommand(bob, irc.TOPIC, "#p", "from b")
+	expectLine(t, alice, ":bob!~bob@localhost TOPIC #p :from b")
+
+	linkTestCommand(bob, irc.PRIVMSG, "#p", "hi all")
+	expectLine(t, alice, ":bob!~bob@localhost PRIVMSG #p :hi all")
+
+	reply := make(chan bool)
+	a.Events <- &SChangeNick{NewNick: "alicia", Client: alice, Reply: reply}
+	<-reply
+	expectLine(t, bob, ":alice!~alice@localhost NICK :alicia")
+
+	linkTestCommand(bob, irc.PRIVMSG, "alicia", "hi")
+	expectLine(t, alice, ":bob!~bob@localhost PRIVMSG alicia :hi")
+
+	linkTestCommand(bob, irc.KICK, "#p", "alicia")
+	expectLine(t, alice, ":bob!~bob@localhost KICK #p alicia :bob")
+
+	linkTestCommand(alice, irc.JOIN, "#r")
+	syncClients(t, alice, bob, "bob")
+	linkTestCommand(bob, irc.JOIN, "#r")
+	expectLine(t, alice, ":bob!~bob@localhost JOIN :#r")
+
+	done := make(chan struct{})
+	a.Events <- &SDeregisterClient{alice, "Leaving", done}
+	<-done
+	expectLine(t, bob, ":alicia!~alice@localhost QUIT :Leaving")
+	if err := linkTestCommand(bob, irc.PRIVMSG, "alicia", "hi"); err == nil || err.Numeric != irc.ERR_NOSUCHNICK {
+		t.Errorf("Messaging alicia after quitting gave %v, want %s", err, irc.ERR_NOSUCHNICK)
+	}
+}
+
+func TestLink_Authentication(t *testing.T) {
+	a := newLinkTestServer("a.test", "b.test")
+	b := newLinkTestServer("b.test")
+	b.LinkConfigs = []*LinkConfig{{Name: "a.test", Password: "wrong"}}
+
+	aConn, bConn := net.Pipe()
+	aLink := a.Link(aConn, a.linkConfig("b.test"))
+	bLink := b.Link(bConn, nil)
+
+	for _, l := range []*Link{aLink, bLink} {
+		select {
+		case <-l.done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("Link wasn't closed")
+		}
+	}
+
+	if bLink.reason != "Authentication failed" {
+		t.Errorf("Accepting side closed with %q", bLink.reason)
+	}
+	if aLink.reason != "Remote error: Authentication failed" {
+		t.Errorf("Connecting side closed with %q", aLink.reason)
+	}
+}
+
+func TestLink_AlreadyLinked(t *testing.T) {
+	a := newLinkTestServer("a.test", "b.test")
+	b := newLinkTestServer("b.test", "a.test")
+	alice := newLinkTestClient(t, a, "alice")
+	bob := newLinkTestClient(t, b, "bob")
+
+	linkTestServers(a, b)
+	syncClients(t, alice, bob, "bob")
+
+	l := linkTestServers(a, b)
+	select {
+	case <-l.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Second link wasn't closed")
+	}
+
+	// The first link still works.
+	syncClients(t, alice, bob, "bob")
+}
+
+func TestLink_NickCollision(t *testing.T) {
+	a := newLinkTestServer("a.test", "b.test")
+	b := newLinkTestServer("b.test", "a.test")
+	alice := newLinkTestClient(t, a, "alice")
+	bob := newLinkTestClient(t, b, "bob")
+
+	older := newLinkTestClient(t, a, "dup")
+	older.Info.ChangeTime = time.Now().Add(-time.Hour)
+	newLinkTestClient(t, b, "dup")
+
+	linkTestServers(a, b)
+	syncClients(t, alice, bob, "bob")
+	syncClients(t, bob, alice, "alice")
+
+	for _, c := range []*Client{alice, bob} {
+		reply := make(chan struct{})
+		c.Server.Events <- &SWhois{Client: c, Nick: "dup", Reply: reply}
+		<-reply
+		expectLine(t, c, " 312 "+c.Info.Name+" dup a.test ")
+	}
+}
+
+func TestLink_ChannelTimestamps(t *testing.T) {
+	a := newLinkTestServer("a.test", "b.test")
+	b := newLinkTestServer("b.test", "a.test")
+	alice := newLinkTestClient(t, a, "alice")
+	bob := newLinkTestClient(t, b, "bob")
+
+	linkTestCommand(alice, irc.JOIN, "#ts")
+	alice.Channels["#ts"].CreateTime = time.Now().Add(-time.Hour)
+	linkTestCommand(bob, irc.JOIN, "#ts")
+	linkTestCommand(bob, irc.MODE, "#ts", "+m")
+
+	linkTestServers(a, b)
+
+	// b's channel is newer, so it loses its modes and bob is no longer an
+	// operator.
+	expectLine(t, bob, ":b.test MODE #ts -")
+	expectLine(t, bob, ":alice!~alice@localhost JOIN :#ts")
+	expectLine(t, bob, ":a.test MODE #ts +o :alice")
+
+	syncClients(t, alice, bob, "bob")
+	syncClients(t, bob, alice, "alice")
+
+	for _, c := range []*Client{alice, bob} {
+		reply := make(chan struct{})
+		c.Server.Events <- &SNames{Client: c, Name: "#ts", Reply: reply}
+		<-reply
+		line := expectLine(t, c, " 353 ")
+		if !strings.Contains(line, "@alice") || strings.Contains(line, "@bob") {
+			t.Errorf("%s got %q, want only alice to be an operator", c.Info.Name, line)
+		}
+
+		c.Server.Events <- &SChannelMode{Client: c, Name: "#ts", Reply: make(chan *CommandError, 1)}
+		if line := expectLine(t, c, " 324 "); !strings.HasSuffix(line, " #ts :+nt") {
+			t.Errorf("%s got %q, want +nt", c.Info.Name, line)
+		}
+	}
+}
+
+func TestLink_Netsplit(t *testing.T) {
+	a := newLinkTestServer("a.test", "b.test")
+	b := newLinkTestServer("b.test", "a.test", "c.test")
+	c := newLinkTestServer("c.test", "b.test")
+	alice := newLinkTestClient(t, a, "alice")
+	carol := newLinkTestClient(t, c, "carol")
+
+	linkTestServers(a, b)
+	bc := linkTestServers(b, c)
+	syncClients(t, alice, carol, "carol")
+	syncClients(t, carol, alice, "alice")
+
+	linkTestCommand(alice, irc.JOIN, "#split")
+	linkTestCommand(carol, irc.JOIN, "#split")
+	expectLine(t, alice, ":carol!~carol@localhost JOIN :#split")
+
+	reply := make(chan struct{})
+	a.Events <- &SLusers{Client: alice, Reply: reply}
+	<-reply
+	expectLine(t, alice, "There are 2 users and 0 services on 3 servers")
+
+	bc.close("Test")
+	expectLine(t, alice, ":carol!~carol@localhost QUIT :b.test c.test")
+
+	a.Events <- &SLusers{Client: alice, Reply: reply}
+	<-reply
+	expectLine(t, alice, "There are 1 users and 0 services on 2 servers")
+}
+
+func TestParseLinkLine_TagsLimit(t *testing.T) {
+	tags := "@+a=" + strings.Repeat("a", protocol.MaximumTagsLen-5) + " "
+	if _, err := parseLinkLine(tags + ":1 PRIVMSG #test :hi"); err != nil {
+		t.Errorf("Tags of the maximum length were rejected: %s", err)
+	}
+
+	tags = "@+a=" + strings.Repeat("a", protocol.MaximumTagsLen-4) + " "
+	if _, err := parseLinkLine(tags + ":1 PRIVMSG #test :hi"); err != protocol.ErrTagsTooLong {
+		t.Errorf("Tags that were too long gave %v, want %v", err, protocol.ErrTagsTooLong)
+	}
+}
+
+func TestLink_LongMessages(t *testing.T) {
+	a := newLinkTestServer("a.test", "b.test")
+	b := newLinkTestServer("b.test", "a.test")
+	alice := newLinkTestClient(t, a, "alice")
+	alice.Info.Host = "::1"
+	alice.IP = net.ParseIP("::1")
+	carol := newLinkTestClient(t, a, "carol")
+	bob := newLinkTestClient(t, b, "bob")
+
+	linkTestServers(a, b)
+	syncClients(t, alice, bob, "bob")
+	syncClients(t, bob, alice, "alice")
+
+	linkTestCommand(bob, irc.PRIVMSG, "alice", "hi")
+	expectLine(t, alice, ":bob!~bob@localhost PRIVMSG alice :hi")
+	linkTestCommand(alice, irc.PRIVMSG, "bob", "hi")
+	expectLine(t, bob, ":alice!~alice@::1 PRIVMSG bob :hi")
+
+	linkTestCommand(alice, irc.JOIN, "#test")
+	linkTestCommand(carol, irc.JOIN, "#test")
+	linkTestCommand(bob, irc.JOIN, "#test")
+	expectLine(t, carol, ":bob!~bob@localhost JOIN :#test")
+
+	// The longest text that a client could send. Bob should be sent the same
+	// line as carol, who's on the same server as alice.
+	text := strings.Repeat("a", 510-len("PRIVMSG #test :"))
+	linkTestCommand(alice, irc.PRIVMSG, "#test", text)
+	want := expectLine(t, carol, " PRIVMSG #test :")
+	if line := expectLine(t, bob, " PRIVMSG #test :"); line != want {
+		t.Errorf("Bob was sent %q, want %q", line, want)
+	}
+}
+
+func TestLinkLine(t *testing.T) {
+	id := uuid.NewRandom().String()
+	tests := []struct {
+		params []string
+		line   string
+	}{
+		{[]string{id, "bob", "1400000000", "~bob", "::1", "::1", "*", "Bob"},
+			":1 UID " + id + " bob 1400000000 ~bob 0::1 0::1 * :Bob"},
+		{[]string{id, "bob", "1400000000", "~bob", "2001:db8::1", "2001:db8::1", "*", ":)"},
+			":1 UID " + id + " bob 1400000000 ~bob 2001:db8::1 2001:db8::1 * ::)"},
+		{[]string{id, strings.Repeat("a", 1000)},
+			":1 PRIVMSG " + id + " :" + strings.Repeat("a", 1000)},
+		{[]string{"#test", ""}, ":1 PART #test :"},
+	}
+	for _, test := range tests {
+		command := strings.Fields(test.line)[1]
+		line := linkLine("1", command, test.params...)
+		if line != test.line {
+			t.Errorf("Formatted %q as %q, want %q", test.params, line, test.line)
+			continue
+		}
+
+		m, err := parseLinkLine(line)
+		if err != nil {
+			t.Errorf("Parsing %q failed: %s", line, err)
+			continue
+		}
+		if m.Prefix.Name != "1" || m.Command != command || len(m.Params) != len(test.params) {
+			t.Errorf("Parsed %q as %q %q %q", line, m.Prefix.Name, m.Command, m.Params)
+			continue
+		}
+		for i, param := range m.Params {
+			if param != test.params[i] && param != "0"+test.params[i] {
+				t.Errorf("Parameter %d of %q is %q, want %q", i, line, param, test.params[i])
+			}
+		}
+	}
+}
+
+func TestLink_Validation(t *testing.T) {
+	a := newLinkTestServer("a.test", "b.test")
+	alice := newLinkTestClient(t, a, "alice")
+	unknown := uuid.NewRandom().String()
+
+	tests := []struct {
+		name   string
+		line   func(b *Server) string
+		closed bool
+	}{
+		{"Duplicate client ID", func(b *Server) string {
+			return linkLine(b.ID.String(), UID, alice.ID.String(), "bob", "1400000000", "~bob", "localhost", "*", "*", "Bob")
+		}, true},
+		{"Client from an unknown server", func(b *Server) string {
+			return linkLine(unknown, UID, uuid.NewRandom().String(), "bob", "1400000000", "~bob", "localhost", "*", "*", "Bob")
+		}, true},
+		{"Client from a server on our side", func(b *Server) string {
+			return linkLine(a.ID.String(), UID, uuid.NewRandom().String(), "bob", "1400000000", "~bob", "localhost", "*", "*", "Bob")
+		}, true},
+		{"Invalid nickname", func(b *Server) string {
+			return linkLine(b.ID.String(), UID, uuid.NewRandom().String(), "1bob", "1400000000", "~bob", "localhost", "*", "*", "Bob")
+		}, false},
+		{"Server with the wrong hop count", func(b *Server) string {
+			return linkLine(b.ID.String(), SID, uuid.NewRandom().String(), "c.test", "5")
+		}, true},
+		{"Server from an unknown uplink", func(b *Server) string {
+			return linkLine(unknown, SID, uuid.NewRandom().String(), "c.test", "2")
+		}, true},
+		{"Server from an uplink on our side", func(b *Server) string {
+			return linkLine(a.ID.String(), SID, uuid.NewRandom().String(), "c.test", "1")
+		}, true},
+		{"Server with an invalid ID", func(b *Server) string {
+			return linkLine(b.ID.String(), SID, "c", "c.test", "2")
+		}, true},
+	}
+
+	for _, test := range tests {
+		b := newLinkTestServer("b.test", "a.test")
+		bob := newLinkTestClient(t, b, "bob")
+		l := linkTestServers(a, b)
+		syncClients(t, alice, bob, "bob")
+
+		m, err := parseLinkLine(test.line(b))
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		a.Events <- &SLinkMessage{l, m}
+
+		// The other server is told about the invalid nickname, and the link
+		// stays up.
+		if !test.closed {
+			syncClients(t, bob, alice, "alice")
+			if err := linkTestCommand(alice, irc.PRIVMSG, "1bob", "hi"); err == nil || err.Numeric != irc.ERR_NOSUCHNICK {
+				t.Errorf("%s: messaging the client gave %v, want %s", test.name, err, irc.ERR_NOSUCHNICK)
+			}
+		}
+
+		select {
+		case <-l.done:
+			if !test.closed {
+				t.Errorf("%s: the link was closed", test.name)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if test.closed {
+				t.Errorf("%s: the link wasn't closed", test.name)
+			}
+		}
+
+		// Wait for bob to be gone before the next server links.
+		l.close("Done")
+		deadline := time.Now().Add(2 * time.Second)
+		for linkTestCommand(alice, irc.PRIVMSG, "bob", "hi") == nil {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: bob never left", test.name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestLinkReadLine_Deadline(t *testing.T) {
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+
+	l := &Link{buf: bufio.NewReader(conn)}
+
+	go other.Write([]byte(":1 PRIVMSG #a :hel"))
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if line, err := l.readLine(); err == nil {
+		t.Fatalf("Read %q before the line was finished", line)
+	}
+
+	long := ":1 PRIVMSG #a :" + strings.Repeat("a", maxLinkLineLen-len(":1 PRIVMSG #a :"))
+	go other.Write([]byte("lo\r\n" + long + "\r\n"))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for _, want := range []string{":1 PRIVMSG #a :hello", long} {
+		if line, err := l.readLine(); err != nil || line != want {
+			t.Errorf("Got a %d byte line and %v, want %d bytes", len(line), err, len(want))
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// ListEntry is an entry in one of a channel's lists, such as its ban list.
+type ListEntry struct {
+	Mask string
+
+	// The nickname of the client that added the entry and the time at which
+	// it was added.
+	SetBy   string
+	SetTime time.Time
+}
+
+// listModes holds the numerics that each list mode is sent with.
+var listModes = map[byte]struct {
+	Entry, End, EndText string
+}{
+	'b': {irc.RPL_BANLIST, irc.RPL_ENDOFBANLIST, "End of channel ban list"},
+	'e': {irc.RPL_EXCEPTLIST, irc.RPL_ENDOFEXCEPTLIST, "End of channel exception list"},
+	'I': {irc.RPL_INVITELIST, irc.RPL_ENDOFINVITELIST, "End of channel invite list"},
+}
+
+func init() {
+	for mode := range listModes {
+		channelModeTypes[mode] = ChannelModeList
+	}
+
+	registerISupport("MAXLIST", func(s *Server) (string, bool) {
+		return "beI:" + strconv.Itoa(s.Limits.ListEntries), true
+	})
+	registerISupport("EXCEPTS", isupportValue("e"))
+	registerISupport("INVEX", isupportValue("I"))
+}
+
+// sendList sends the entries in the channel's list for mode to c.
+func (ch *Channel) sendList(c *Client, mode byte) {
+	numerics := listModes[mode]
+	for _, entry := range ch.Lists[mode] {
+		c.numeric(numerics.Entry, ch.Name, entry.Mask, entry.SetBy, strconv.FormatInt(entry.SetTime.Unix(), 10))
+	}
+	c.numeric(numerics.End, ch.Name, numerics.EndText)
+}
+
+// listLength returns the number of entries in all of the channel's lists.
+func (ch *Channel) listLength() int {
+	length := 0
+	for _, entries := range ch.Lists {
+		length += len(entries)
+	}
+
+	return length
+}
+
+// applyListChange adds or removes the mask in change from one of the channel's
+// lists on c's behalf. It returns false if the list didn't change.
+func (s *Server) applyListChange(c *Client, channel *Channel, change *ModeChange) bool {
+	mask, ok := s.normalizeMask(change.Param)
+	if !ok {
+		c.numeric(ERR_INVALIDMODEPARAM, channel.Name, string(change.Mode), change.Param, "Invalid extended ban")
+		return false
+	}
+
+	if change.Add && s.listIndex(channel, change.Mode, mask) < 0 && channel.listLength() >= s.Limits.ListEntries {
+		c.numeric(irc.ERR_BANLISTFULL, channel.Name, mask, "Channel list is full")
+		return false
+	}
+
+	return s.updateList(channel, change, ListEntry{
+		Mask:    mask,
+		SetBy:   c.Info.Name,
+		SetTime: time.Now(),
+	})
+}
+
+// listIndex returns the index of mask in the channel's list for mode, or -1 if
+// it isn't there.
+func (s *Server) listIndex(channel *Channel, mode byte, mask string) int {
+	folded := s.fold(mask)
+	for i, entry := range channel.Lists[mode] {
+		if s.fold(entry.Mask) == folded {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// updateList adds entry to the channel's list for change.Mode, or removes the
+// entry with the same mask if change removes it. change.Param is set to the mask
+// that was added or removed. It returns false if the list didn't change.
+func (s *Server) updateList(channel *Channel, change *ModeChange, entry ListEntry) bool {
+	i := s.listIndex(channel, change.Mode, entry.Mask)
+	if change.Add == (i >= 0) {
+		return false
+	}
+
+	entries := channel.Lists[change.Mode]
+	if change.Add {
+		channel.Lists[change.Mode] = append(entries, entry)
+		change.Param = entry.Mask
+	} else {
+		change.Param = entries[i].Mask
+		channel.Lists[change.Mode] = append(entries[:i:i], entries[i+1:]...)
+	}
+
+	return true
+}
+
+// matchesList checks if any of the masks in the channel's list for mode match
+// c. Quiet bans are only included if speaking is true.
+func (s *Server) matchesList(channel *Channel, mode byte, c *Client, speaking bool) bool {
+	entries := channel.Lists[mode]
+	if len(entries) == 0 {
+		return false
+	}
+
+	hostmasks := c.hostmasks()
+	for _, entry := range entries {
+		if !speaking && isQuietMask(entry.Mask) {
+			continue
+		}
+
+		if s.matchesMask(entry.Mask, c, hostmasks) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isBanned checks if c is banned from the channel and doesn't have an
+// exception. If speaking is true, quiet bans are included.
+func (s *Server) isBanned(channel *Channel, c *Client, speaking bool) bool {
+	return s.matchesList(channel, 'b', c, speaking) && !s.matchesList(channel, 'e', c, speaking)
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import "github.com/sorcix/irc"
+
+const (
+	capMultiPrefix     = "multi-prefix"
+	capUserhostInNames = "userhost-in-names"
+)
+
+// Privilege is a set of membership privileges in a channel. Higher privileges
+// have higher values, so the highest privilege in a set can be compared with
+// others.
+type Privilege uint8
+
+// Membership privileges, from the lowest to the highest.
+const (
+	Voice Privilege = 1 << iota
+	Halfop
+	Operator
+	Admin
+	Founder
+)
+
+// privileges maps each membership privilege to its channel mode and the prefix
+// that's shown before a member's nickname. It's ordered from the highest
+// privilege to the lowest, as PREFIX requires.
+var privileges = []struct {
+	Privilege Privilege
+	Mode      byte
+	Prefix    byte
+}{
+	{Founder, 'q', '~'},
+	{Admin, 'a', '&'},
+	{Operator, 'o', '@'},
+	{Halfop, 'h', '%'},
+	{Voice, 'v', '+'},
+}
+
+func init() {
+	registerCapability(&Capability{Name: capMultiPrefix})
+	registerCapability(&Capability{Name: capUserhostInNames})
+
+	registerISupport("PREFIX", func(*Server) (string, bool) {
+		var modes, prefixes []byte
+		for _, p := range privileges {
+			modes = append(modes, p.Mode)
+			prefixes = append(prefixes, p.Prefix)
+		}
+
+		return "(" + string(modes) + ")" + string(prefixes), true
+	})
+
+	for _, p := range privileges {
+		channelModeTypes[p.Mode] = ChannelModePrefix
+	}
+}
+
+// privilegeForMode returns the membership privilege that mode grants.
+func privilegeForMode(mode byte) (Privilege, bool) {
+	for _, p := range privileges {
+		if p.Mode == mode {
+			return p.Privilege, true
+		}
+	}
+
+	return 0, false
+}
+
+// privilegeForPrefix returns the membership privilege that's shown with prefix.
+func privilegeForPrefix(prefix byte) (Privilege, bool) {
+	for _, p := range privileges {
+		if p.Prefix == prefix {
+			return p.Privilege, true
+		}
+	}
+
+	return 0, false
+}
+
+// Highest returns the highest privilege in p, or 0 if p is empty.
+func (p Privilege) Highest() Privilege {
+	for _, privilege := range privileges {
+		if p&privilege.Privilege != 0 {
+			return privilege.Privilege
+		}
+	}
+
+	return 0
+}
+
+// Prefixes returns the prefixes of the privileges in p, from the highest to
+// the lowest. If all is false, only the highest prefix is returned.
+func (p Privilege) Prefixes(all bool) string {
+	var prefixes []byte
+	for _, privilege := range privileges {
+		if p&privilege.Privilege == 0 {
+			continue
+		}
+
+		prefixes = append(prefixes, privilege.Prefix)
+		if !all {
+			break
+		}
+	}
+
+	return string(prefixes)
+}
+
+// privilege returns the highest privilege that c has in the channel. It's 0 if
+// c has none or isn't a member.
+func (ch *Channel) privilege(c *Client) Privilege {
+	member, ok := ch.Members[c]
+	if !ok {
+		return 0
+	}
+
+	return member.Privileges.Highest()
+}
+
+// prefixes returns the prefixes to show before c's nickname in replies about the
+// channel that are sent to to. Every prefix is shown if to has enabled
+// multi-prefix.
+func (ch *Channel) prefixes(c *Client, to *Client) string {
+	member, ok := ch.Members[c]
+	if !ok {
+		return ""
+	}
+
+	return member.Privileges.Prefixes(to.HasCapability(capMultiPrefix))
+}
+
+// canChangePrivilege checks if c may give or take away privilege. Halfops may
+// only change voice, and everyone else may change privileges up to their own.
+// Members may always take away their own privileges.
+func (ch *Channel) canChangePrivilege(c *Client, privilege Privilege, target *Client, add bool) bool {
+	if c == target && !add {
+		return true
+	}
+
+	required := privilege
+	if required < Operator {
+		required = Operator
+	}
+	if privilege == Voice {
+		required = Halfop
+	}
+
+	return ch.privilege(c) >= required && ch.privilege(c) >= ch.privilege(target)
+}
+
+// canKick checks if c may kick target from the channel. Halfops and above may
+// kick members that don't have a higher privilege than themselves.
+func (ch *Channel) canKick(c, target *Client) bool {
+	return ch.privilege(c) >= Halfop && ch.privilege(c) >= ch.privilege(target)
+}
+
+// applyPrivilegeChange applies a change to a membership privilege that was
+// requested by c. It returns false if the change wasn't made, having sent c
+// any error.
+func (s *Server) applyPrivilegeChange(c *Client, channel *Channel, change *ModeChange) bool {
+	privilege, _ := privilegeForMode(change.Mode)
+
+	target, ok := s.Clients[s.fold(change.Param)]
+	if !ok {
+		c.numeric(irc.ERR_NOSUCHNICK, change.Param, "No such nick/channel")
+		return false
+	}
+
+	member, ok := channel.Members[target]
+	if !ok {
+		c.numeric(irc.ERR_USERNOTINCHANNEL, target.Info.Name, channel.Name, "They aren't on that channel")
+		return false
+	}
+
+	if !channel.canChangePrivilege(c, privilege, target, change.Add) {
+		c.numeric(irc.ERR_CHANOPRIVSNEEDED, channel.Name, "You're not channel operator")
+		return false
+	}
+
+	if (member.Privileges&privilege != 0) == change.Add {
+		return false
+	}
+	if change.Add {
+		member.Privileges |= privilege
+	} else {
+		member.Privileges &^= privilege
+	}
+	change.Param = target.Info.Name
+
+	return true
+}
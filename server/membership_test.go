@@ -0,0 +1,57 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import "testing"
+
+func TestPrivilege_Prefixes(t *testing.T) {
+	p := Voice | Operator | Founder
+
+	if highest := p.Highest(); highest != Founder {
+		t.Errorf("Expected the highest privilege to be %d, got %d", Founder, highest)
+	}
+	if prefixes := p.Prefixes(false); prefixes != "~" {
+		t.Errorf("Expected prefix %q, got %q", "~", prefixes)
+	}
+	if prefixes := p.Prefixes(true); prefixes != "~@+" {
+		t.Errorf("Expected prefixes %q, got %q", "~@+", prefixes)
+	}
+	if prefixes := Privilege(0).Prefixes(true); prefixes != "" {
+		t.Errorf("Expected no prefixes, got %q", prefixes)
+	}
+}
+
+func TestChannel_CanChangePrivilege(t *testing.T) {
+	op, halfop, voiced, admin := new(Client), new(Client), new(Client), new(Client)
+	channel := newChannel("#test")
+	channel.Members[op] = &Member{Client: op, Privileges: Operator}
+	channel.Members[halfop] = &Member{Client: halfop, Privileges: Halfop}
+	channel.Members[voiced] = &Member{Client: voiced, Privileges: Voice}
+	channel.Members[admin] = &Member{Client: admin, Privileges: Admin}
+
+	tests := []struct {
+		name      string
+		c         *Client
+		privilege Privilege
+		target    *Client
+		add       bool
+		expected  bool
+	}{
+		{"op gives op", op, Operator, voiced, true, true},
+		{"op gives admin", op, Admin, voiced, true, false},
+		{"op takes from admin", op, Operator, admin, false, false},
+		{"halfop gives voice", halfop, Voice, voiced, true, true},
+		{"halfop gives halfop", halfop, Halfop, voiced, true, false},
+		{"voiced gives voice", voiced, Voice, halfop, true, false},
+		{"halfop removes own", halfop, Halfop, halfop, false, true},
+	}
+
+	for _, test := range tests {
+		if actual := channel.canChangePrivilege(test.c, test.privilege, test.target, test.add); actual != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, actual)
+		}
+	}
+}
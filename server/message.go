@@ -0,0 +1,113 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"strconv"
+
+	"github.com/nightexcessive/excessiveircd/protocol"
+	"github.com/sorcix/irc"
+)
+
+const capEchoMessage = "echo-message"
+
+func init() {
+	registerCapability(&Capability{Name: capEchoMessage})
+
+	registerISupport("MAXTARGETS", func(s *Server) (string, bool) {
+		return strconv.Itoa(s.Limits.MaxTargets), true
+	})
+	registerISupport("TARGMAX", func(s *Server) (string, bool) {
+		n := strconv.Itoa(s.Limits.MaxTargets)
+		return irc.PRIVMSG + ":" + n + "," + irc.NOTICE + ":" + n, true
+	})
+}
+
+// Message is a message received from a client, along with its IRCv3 tags.
+type Message struct {
+	*irc.Message
+
+	Tags protocol.Tags
+}
+
+// privmsg delivers a PRIVMSG, NOTICE or TAGMSG from c to target, which may be
+// either a nickname or a channel name. Only the client-only tags in tags are
+// relayed. TAGMSG is only delivered to clients that can receive tags. If c has
+// enabled echo-message, the message is also sent back to c. PRIVMSG and NOTICE
+// are added to the target's history. Messages from other servers' clients have
+// already been checked and keep the tags that they were sent with.
+func (s *Server) privmsg(c *Client, command, target, text string, tags protocol.Tags) *CommandError {
+	m := &irc.Message{
+		Prefix:  c.Info.Prefix,
+		Command: command,
+		Params:  []string{target},
+	}
+	if command != TAGMSG {
+		m.Params = append(m.Params, text)
+	}
+
+	var recipients []*Client
+	var key, linkTarget string
+	if isChannelTarget(target) {
+		channel, ok := s.Channels[s.fold(target)]
+		if !ok {
+			return &CommandError{irc.ERR_NOSUCHNICK, []string{target, "No such nick/channel"}}
+		}
+		if c.Origin == nil && !s.canSpeak(c, channel) {
+			return &CommandError{irc.ERR_CANNOTSENDTOCHAN, []string{target, "Cannot send to channel"}}
+		}
+
+		for member := range channel.Members {
+			if member != c {
+				recipients = append(recipients, member)
+			}
+		}
+		key = s.fold(channel.Name)
+		linkTarget = channel.Name
+	} else {
+		recipient, ok := s.Clients[s.fold(target)]
+		if !ok {
+			return &CommandError{irc.ERR_NOSUCHNICK, []string{target, "No such nick/channel"}}
+		}
+
+		recipients = append(recipients, recipient)
+		key = privateHistoryKey(s.historyIdentity(c), s.historyIdentity(recipient))
+		linkTarget = recipient.ID.String()
+	}
+
+	if c.Origin == nil {
+		tags = c.relayTags(tags.ClientOnly())
+	}
+	// A client that messages itself is already a recipient.
+	if c.HasCapability(capEchoMessage) && (len(recipients) == 0 || recipients[0] != c) {
+		recipients = append(recipients, c)
+	}
+
+	for _, recipient := range recipients {
+		if command == TAGMSG && !recipient.HasCapability(capMessageTags) {
+			continue
+		}
+
+		recipient.relay(c, tags, m)
+	}
+
+	params := []string{linkTarget}
+	if command != TAGMSG {
+		params = append(params, text)
+	}
+	line := prefixTags(tags, linkLine(c.ID.String(), command, params...))
+	if isChannelTarget(target) {
+		s.propagate(c.link(), line)
+	} else if l := recipients[0].link(); l != nil && l != c.link() {
+		l.send(line)
+	}
+
+	if command != TAGMSG {
+		s.addHistory(key, c, command, target, text, tags)
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+func TestPrivmsg_EchoMessage(t *testing.T) {
+	s := newLinkTestServer("irc.test")
+	alice := newLinkTestClient(t, s, "alice")
+	alice.Capabilities[capEchoMessage] = true
+	bob := newLinkTestClient(t, s, "bob")
+
+	linkTestCommand(alice, irc.JOIN, "#test")
+	queued(alice)
+	for _, target := range []string{"alice", "bob", "#test"} {
+		if err := linkTestCommand(alice, irc.PRIVMSG, target, "hi"); err != nil {
+			t.Fatalf("Messaging %s failed: %v", target, err)
+		}
+
+		echoed := 0
+		for _, line := range queued(alice) {
+			if strings.HasSuffix(line, " PRIVMSG "+target+" :hi") {
+				echoed++
+			}
+		}
+		if echoed != 1 {
+			t.Errorf("Messaging %s was echoed %d times, want 1", target, echoed)
+		}
+	}
+	expectLine(t, bob, ":alice!~alice@localhost PRIVMSG bob :hi")
+}
@@ -0,0 +1,372 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sorcix/irc"
+)
+
+// MaximumKeyLen specifies the maximum length that a channel key may be.
+const MaximumKeyLen = 23
+
+// defaultChannelModes are the flag modes that new channels are created with.
+const defaultChannelModes = "nt"
+
+// ChannelModeType describes how a channel mode takes its parameter. The types
+// are the ones used in the CHANMODES RPL_ISUPPORT token.
+type ChannelModeType int
+
+const (
+	// ChannelModeList modes hold a list of values. They always take a
+	// parameter.
+	ChannelModeList ChannelModeType = iota
+
+	// ChannelModeSetting modes always take a parameter.
+	ChannelModeSetting
+
+	// ChannelModeParam modes only take a parameter when they're set.
+	ChannelModeParam
+
+	// ChannelModeFlag modes never take a parameter.
+	ChannelModeFlag
+
+	// ChannelModePrefix modes give a member a privilege. They always take a
+	// nickname as their parameter. They're advertised in PREFIX rather than
+	// CHANMODES.
+	ChannelModePrefix
+)
+
+// channelModeTypes holds the type of each channel mode that the server
+// supports.
+var channelModeTypes = map[byte]ChannelModeType{
+	'k': ChannelModeSetting,
+	'l': ChannelModeParam,
+	'i': ChannelModeFlag,
+	'm': ChannelModeFlag,
+	'n': ChannelModeFlag,
+	'p': ChannelModeFlag,
+	's': ChannelModeFlag,
+	't': ChannelModeFlag,
+}
+
+func init() {
+	registerISupport("CHANMODES", func(*Server) (string, bool) {
+		types := make([][]byte, ChannelModeFlag+1)
+		for mode, modeType := range channelModeTypes {
+			if modeType <= ChannelModeFlag {
+				types[modeType] = append(types[modeType], mode)
+			}
+		}
+
+		groups := make([]string, len(types))
+		for i, modes := range types {
+			sort.Slice(modes, func(a, b int) bool { return modes[a] < modes[b] })
+			groups[i] = string(modes)
+		}
+
+		return strings.Join(groups, ","), true
+	})
+	registerISupport("MODES", func(s *Server) (string, bool) {
+		return strconv.Itoa(s.Limits.Modes), true
+	})
+	registerISupport("KEYLEN", isupportValue(strconv.Itoa(MaximumKeyLen)))
+}
+
+// ModeChange is a single change in a MODE command.
+type ModeChange struct {
+	Add   bool
+	Mode  byte
+	Param string
+}
+
+// parseModeChanges parses a mode string and its parameters. Parameters are
+// taken in order by the modes that need them, and modes that need a parameter
+// but don't have one are skipped, except for list modes, which are then
+// requests for the list. At most maxParams modes with a parameter are
+// parsed, and any after them are dropped. Modes that the server doesn't support
+// are returned in unknown.
+func parseModeChanges(modes string, params []string, maxParams int) (changes []ModeChange, unknown []byte) {
+	add := true
+	usedParams := 0
+	for i := 0; i < len(modes); i++ {
+		mode := modes[i]
+		switch mode {
+		case '+', '-':
+			add = mode == '+'
+			continue
+		}
+
+		modeType, ok := channelModeTypes[mode]
+		if !ok {
+			unknown = append(unknown, mode)
+			continue
+		}
+
+		change := ModeChange{Add: add, Mode: mode}
+
+		needsParam := modeType != ChannelModeFlag && (modeType != ChannelModeParam || add)
+		if needsParam {
+			if usedParams >= maxParams {
+				continue
+			}
+
+			if len(params) == 0 {
+				// A list mode without a mask asks for the list, and a key can
+				// be removed without giving it.
+				if modeType != ChannelModeList && (modeType != ChannelModeSetting || add) {
+					continue
+				}
+			} else {
+				change.Param, params = params[0], params[1:]
+			}
+			usedParams++
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes, unknown
+}
+
+// formatModeChanges formats changes as a mode string followed by the changes'
+// parameters.
+func formatModeChanges(changes []ModeChange) []string {
+	var modes []byte
+	var params []string
+	for i, change := range changes {
+		if i == 0 || change.Add != changes[i-1].Add {
+			if change.Add {
+				modes = append(modes, '+')
+			} else {
+				modes = append(modes, '-')
+			}
+		}
+		modes = append(modes, change.Mode)
+
+		if len(change.Param) > 0 {
+			params = append(params, change.Param)
+		}
+	}
+
+	return append([]string{string(modes)}, params...)
+}
+
+// modeString returns the channel's modes and their parameters, as they're sent
+// in RPL_CHANNELMODEIS. The key is only included if showKey is true.
+func (ch *Channel) modeString(showKey bool) []string {
+	var changes []ModeChange
+	for mode := range ch.Modes {
+		changes = append(changes, ModeChange{Add: true, Mode: mode})
+	}
+	if len(ch.Key) > 0 {
+		change := ModeChange{Add: true, Mode: 'k'}
+		if showKey {
+			change.Param = ch.Key
+		}
+		changes = append(changes, change)
+	}
+	if ch.Limit > 0 {
+		changes = append(changes, ModeChange{Add: true, Mode: 'l', Param: strconv.Itoa(ch.Limit)})
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Mode < changes[j].Mode })
+	if len(changes) == 0 {
+		return []string{"+"}
+	}
+
+	return formatModeChanges(changes)
+}
+
+// isOperator checks if c may change the channel's modes.
+func (ch *Channel) isOperator(c *Client) bool {
+	return ch.privilege(c) >= Operator
+}
+
+// canSpeak checks if c may send messages to channel, taking the
+// no-external-messages and moderated modes and bans, including quiet bans, into
+// account. Voiced members may speak even if they're banned.
+func (s *Server) canSpeak(c *Client, channel *Channel) bool {
+	if _, ok := channel.Members[c]; !ok {
+		return !channel.Modes['n'] && !channel.Modes['m'] && !s.isBanned(channel, c, true)
+	}
+
+	if channel.privilege(c) >= Voice {
+		return true
+	}
+
+	return !channel.Modes['m'] && !s.isBanned(channel, c, true)
+}
+
+// isVisibleTo checks if c may see the channel in LIST, WHOIS, NAMES, WHO and
+// MODE.
+// Secret and private channels are only visible to their members.
+func (ch *Channel) isVisibleTo(c *Client) bool {
+	if !ch.Modes['s'] && !ch.Modes['p'] {
+		return true
+	}
+
+	_, ok := ch.Members[c]
+	return ok
+}
+
+// applyModeChange applies change, which mustn't be a prefix or list mode, to
+// the channel. It returns false if the change was invalid or had no effect, in
+// which case it isn't announced.
+func (ch *Channel) applyModeChange(change *ModeChange) bool {
+	switch change.Mode {
+	case 'k':
+		if !change.Add {
+			if len(ch.Key) == 0 {
+				return false
+			}
+			ch.Key = ""
+			change.Param = "*"
+			return true
+		}
+
+		key := change.Param
+		if len(key) == 0 || len(key) > MaximumKeyLen || strings.ContainsAny(key, ", ") || key == ch.Key {
+			return false
+		}
+		ch.Key = key
+		return true
+	case 'l':
+		if !change.Add {
+			if ch.Limit == 0 {
+				return false
+			}
+			ch.Limit = 0
+			return true
+		}
+
+		limit, err := strconv.Atoi(change.Param)
+		if err != nil || limit <= 0 || limit == ch.Limit {
+			return false
+		}
+		ch.Limit = limit
+		change.Param = strconv.Itoa(limit)
+		return true
+	}
+
+	if ch.Modes[change.Mode] == change.Add {
+		return false
+	}
+	if change.Add {
+		ch.Modes[change.Mode] = true
+	} else {
+		delete(ch.Modes, change.Mode)
+	}
+	return true
+}
+
+func cmdMode(c *Client, m *Message) *CommandError {
+	target := m.Params[0]
+	if !isChannelTarget(target) {
+		return userMode(c, m)
+	}
+
+	event := &SChannelMode{
+		Client: c,
+		Name:   target,
+		Reply:  make(chan *CommandError),
+	}
+	if len(m.Params) > 1 {
+		var unknown []byte
+		event.Changes, unknown = parseModeChanges(m.Params[1], m.Params[2:], c.Server.Limits.Modes)
+		for _, mode := range unknown {
+			c.numeric(irc.ERR_UNKNOWNMODE, string(mode), "is unknown mode char to me for "+target)
+		}
+		event.Set = true
+	}
+
+	c.Server.Events <- event
+	return <-event.Reply
+}
+
+// userMode handles MODE for a nickname. There are no user modes yet, so
+// clients can only see that they have none.
+func userMode(c *Client, m *Message) *CommandError {
+	if c.Server.fold(m.Params[0]) != c.Server.fold(c.Info.Name) {
+		return &CommandError{irc.ERR_USERSDONTMATCH, []string{"Cannot change mode for other users"}}
+	}
+
+	if len(m.Params) > 1 && strings.Trim(m.Params[1], "+-") != "" {
+		return &CommandError{irc.ERR_UMODEUNKNOWNFLAG, []string{"Unknown MODE flag"}}
+	}
+
+	c.numeric(irc.RPL_UMODEIS, "+")
+	return nil
+}
+
+// channelMode sends the modes of the named channel to c or, if set is true,
+// applies changes to it and announces the ones that took effect.
+func (s *Server) channelMode(c *Client, name string, changes []ModeChange, set bool) *CommandError {
+	channel, ok := s.Channels[s.fold(name)]
+	if !ok || !channel.isVisibleTo(c) {
+		return &CommandError{irc.ERR_NOSUCHCHANNEL, []string{name, "No such channel"}}
+	}
+
+	_, member := channel.Members[c]
+
+	if !set {
+		c.numeric(irc.RPL_CHANNELMODEIS, append([]string{channel.Name}, channel.modeString(member)...)...)
+		c.numeric(RPL_CREATIONTIME, channel.Name, strconv.FormatInt(channel.CreateTime.Unix(), 10))
+		return nil
+	}
+
+	if !member {
+		return &CommandError{irc.ERR_NOTONCHANNEL, []string{channel.Name, "You're not on that channel"}}
+	}
+
+	var applied []ModeChange
+	deniedSent := false
+	for _, change := range changes {
+		switch modeType := channelModeTypes[change.Mode]; {
+		case modeType == ChannelModePrefix:
+			if s.applyPrivilegeChange(c, channel, &change) {
+				applied = append(applied, change)
+			}
+			continue
+		case modeType == ChannelModeList && len(change.Param) == 0:
+			channel.sendList(c, change.Mode)
+			continue
+		}
+
+		if !channel.isOperator(c) {
+			if !deniedSent {
+				c.numeric(irc.ERR_CHANOPRIVSNEEDED, channel.Name, "You're not channel operator")
+				deniedSent = true
+			}
+			continue
+		}
+
+		if channelModeTypes[change.Mode] == ChannelModeList {
+			if s.applyListChange(c, channel, &change) {
+				applied = append(applied, change)
+			}
+		} else if channel.applyModeChange(&change) {
+			applied = append(applied, change)
+		}
+	}
+	if len(applied) == 0 {
+		return nil
+	}
+
+	channel.send(c, c.relayTags(nil), &irc.Message{
+		Prefix:  c.Info.Prefix,
+		Command: irc.MODE,
+		Params:  append([]string{channel.Name}, formatModeChanges(applied)...),
+	}, nil)
+
+	params := append([]string{formatTS(channel.CreateTime), channel.Name}, s.linkModeParams(applied)...)
+	s.propagate(nil, linkLine(c.ID.String(), TMODE, params...))
+
+	return nil
+}
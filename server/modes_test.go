@@ -0,0 +1,125 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+func TestParseModeChanges(t *testing.T) {
+	changes, unknown := parseModeChanges("+nk-l+Xz", []string{"key", "extra"}, 4)
+
+	expected := []ModeChange{
+		{Add: true, Mode: 'n'},
+		{Add: true, Mode: 'k', Param: "key"},
+		{Add: false, Mode: 'l'},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected changes %v, got %v", expected, changes)
+	}
+	if string(unknown) != "Xz" {
+		t.Errorf("Expected unknown modes %q, got %q", "Xz", unknown)
+	}
+}
+
+func TestParseModeChanges_MissingParams(t *testing.T) {
+	changes, _ := parseModeChanges("+l-k+k", nil, 4)
+
+	expected := []ModeChange{{Add: false, Mode: 'k'}}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected changes %v, got %v", expected, changes)
+	}
+}
+
+func TestParseModeChanges_ParamLimit(t *testing.T) {
+	changes, _ := parseModeChanges("+lktk", []string{"5", "a", "b"}, 2)
+
+	expected := []ModeChange{
+		{Add: true, Mode: 'l', Param: "5"},
+		{Add: true, Mode: 'k', Param: "a"},
+		{Add: true, Mode: 't'},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected changes %v, got %v", expected, changes)
+	}
+}
+
+func TestParseModeChanges_ListQuery(t *testing.T) {
+	changes, _ := parseModeChanges("+b-e+I", []string{"*!*@host"}, 4)
+
+	expected := []ModeChange{
+		{Add: true, Mode: 'b', Param: "*!*@host"},
+		{Add: false, Mode: 'e'},
+		{Add: true, Mode: 'I'},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected changes %v, got %v", expected, changes)
+	}
+}
+
+func TestFormatModeChanges(t *testing.T) {
+	formatted := formatModeChanges([]ModeChange{
+		{Add: true, Mode: 'n'},
+		{Add: true, Mode: 'k', Param: "key"},
+		{Add: false, Mode: 'l'},
+		{Add: false, Mode: 's'},
+		{Add: true, Mode: 'l', Param: "10"},
+	})
+
+	expected := []string{"+nk-ls+l", "key", "10"}
+	if !reflect.DeepEqual(formatted, expected) {
+		t.Errorf("Expected %v, got %v", expected, formatted)
+	}
+}
+
+func TestUserMode_Fold(t *testing.T) {
+	c := newBatchTestClient()
+	c.Server.Casemapping = DefaultCasemapping
+	c.Info.Prefix = &irc.Prefix{Name: "alice"}
+
+	m := &Message{Message: &irc.Message{Command: irc.MODE, Params: []string{"ALICE"}}}
+	if err := userMode(c, m); err != nil {
+		t.Errorf("Asking for the modes of a differently cased nickname failed: %v", err)
+	}
+
+	m.Params[0] = "bob"
+	if err := userMode(c, m); err == nil || err.Numeric != irc.ERR_USERSDONTMATCH {
+		t.Errorf("Expected %s for someone else's modes, got %v", irc.ERR_USERSDONTMATCH, err)
+	}
+}
+
+func TestChannelMode_Secret(t *testing.T) {
+	s := newLinkTestServer("irc.test")
+	alice := newLinkTestClient(t, s, "alice")
+	bob := newLinkTestClient(t, s, "bob")
+
+	for _, mode := range []string{"+s", "+p"} {
+		name := "#" + mode[1:]
+		linkTestCommand(alice, irc.JOIN, name)
+		linkTestCommand(alice, irc.MODE, name, mode)
+
+		for _, set := range []bool{false, true} {
+			reply := make(chan *CommandError)
+			s.Events <- &SChannelMode{Client: bob, Name: name, Set: set, Reply: reply}
+			if err := <-reply; err == nil || err.Numeric != irc.ERR_NOSUCHCHANNEL {
+				t.Errorf("MODE on a %s channel by a non-member gave %v, want %s", mode, err, irc.ERR_NOSUCHCHANNEL)
+			}
+		}
+		if lines := queued(bob); len(lines) != 0 {
+			t.Errorf("A non-member was sent the modes of a %s channel: %q", mode, lines)
+		}
+
+		reply := make(chan *CommandError)
+		s.Events <- &SChannelMode{Client: alice, Name: name, Reply: reply}
+		if err := <-reply; err != nil {
+			t.Errorf("MODE on a %s channel by a member gave %v", mode, err)
+		}
+		expectLine(t, alice, " "+irc.RPL_CHANNELMODEIS+" alice "+name+" ")
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/sorcix/irc"
+)
+
+func init() {
+	registerISupport("MONITOR", func(s *Server) (string, bool) {
+		return strconv.Itoa(s.Limits.Monitor), true
+	})
+}
+
+func cmdMonitor(c *Client, m *Message) *CommandError {
+	event := &SMonitor{
+		Client:     c,
+		Subcommand: strings.ToUpper(m.Params[0]),
+		Reply:      make(chan *CommandError),
+	}
+
+	switch event.Subcommand {
+	case "+", "-":
+		if len(m.Params) < 2 {
+			return &CommandError{irc.ERR_NEEDMOREPARAMS, []string{m.Command, "Not enough parameters"}}
+		}
+		event.Targets = strings.Split(m.Params[1], ",")
+	case "C", "L", "S":
+	default:
+		// Unknown subcommands are ignored, as the specification asks.
+		return nil
+	}
+
+	c.Server.Events <- event
+	return <-event.Reply
+}
+
+// monitor handles a MONITOR subcommand from c.
+func (s *Server) monitor(c *Client, subcommand string, targets []string) *CommandError {
+	switch subcommand {
+	case "+":
+		var added []string
+		for i, target := range targets {
+			if !s.isNickname(target) {
+				continue
+			}
+			if _, ok := c.Monitoring[s.fold(target)]; ok {
+				continue
+			}
+
+			if len(c.Monitoring) >= s.Limits.Monitor {
+				s.sendMonitorStatus(c, added)
+				return &CommandError{ERR_MONLISTFULL, []string{strconv.Itoa(s.Limits.Monitor), strings.Join(targets[i:], ","), "Monitor list is full."}}
+			}
+
+			s.addMonitor(c, target)
+			added = append(added, target)
+		}
+		s.sendMonitorStatus(c, added)
+	case "-":
+		for _, target := range targets {
+			s.removeMonitor(c, target)
+		}
+	case "C":
+		for _, target := range c.Monitoring {
+			s.removeMonitor(c, target)
+		}
+	case "L":
+		targets := make([]string, 0, len(c.Monitoring))
+		for _, target := range c.Monitoring {
+			targets = append(targets, target)
+		}
+		sendList(c, RPL_MONLIST, ",", targets)
+		c.numeric(RPL_ENDOFMONLIST, "End of MONITOR list")
+	case "S":
+		targets := make([]string, 0, len(c.Monitoring))
+		for _, target := range c.Monitoring {
+			targets = append(targets, target)
+		}
+		s.sendMonitorStatus(c, targets)
+	}
+
+	return nil
+}
+
+func (s *Server) addMonitor(c *Client, target string) {
+	key := s.fold(target)
+
+	watchers, ok := s.Monitors[key]
+	if !ok {
+		watchers = make(map[*Client]struct{})
+		s.Monitors[key] = watchers
+	}
+
+	watchers[c] = struct{}{}
+	c.Monitoring[key] = target
+}
+
+func (s *Server) removeMonitor(c *Client, target string) {
+	key := s.fold(target)
+	delete(c.Monitoring, key)
+
+	watchers := s.Monitors[key]
+	delete(watchers, c)
+	if len(watchers) == 0 {
+		delete(s.Monitors, key)
+	}
+}
+
+// sendMonitorStatus tells c which of targets are online and which are offline.
+func (s *Server) sendMonitorStatus(c *Client, targets []string) {
+	var online, offline []string
+	for _, target := range targets {
+		if client, ok := s.Clients[s.fold(target)]; ok {
+			online = append(online, client.Info.Prefix.String())
+		} else {
+			offline = append(offline, target)
+		}
+	}
+
+	sendList(c, RPL_MONONLINE, ",", online)
+	sendList(c, RPL_MONOFFLINE, ",", offline)
+}
+
+// notifyMonitors tells everyone who's monitoring nick that it's come online as
+// client or, if client is nil, gone offline. It must be called after s.Clients
+// has been updated.
+func (s *Server) notifyMonitors(nick string, client *Client) {
+	for watcher := range s.Monitors[s.fold(nick)] {
+		if client != nil {
+			watcher.unsolicitedNumeric(RPL_MONONLINE, client.Info.Prefix.String())
+		} else {
+			watcher.unsolicitedNumeric(RPL_MONOFFLINE, nick)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+// monitorLines runs a MONITOR subcommand for c and returns the error and what
+// it's sent.
+func monitorLines(c *Client, subcommand string, targets ...string) (*CommandError, []string) {
+	event := &SMonitor{c, subcommand, targets, make(chan *CommandError)}
+	c.Server.Events <- event
+	err := <-event.Reply
+	return err, queued(c)
+}
+
+func TestMonitor(t *testing.T) {
+	s := newLinkTestServer("irc.test")
+	alice := newLinkTestClient(t, s, "alice")
+	newLinkTestClient(t, s, "bob")
+	queued(alice)
+
+	expected := []string{
+		":irc.test " + RPL_MONONLINE + " alice :bob!~bob@localhost",
+		":irc.test " + RPL_MONOFFLINE + " alice :Carol",
+	}
+	if _, lines := monitorLines(alice, "+", "bob", "Carol", "not a nick"); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+
+	// Nicknames that are already monitored aren't repeated.
+	if _, lines := monitorLines(alice, "+", "BOB"); len(lines) != 0 {
+		t.Errorf("Monitoring bob again gave %q", lines)
+	}
+
+	if _, lines := monitorLines(alice, "S"); len(lines) != 2 {
+		t.Errorf("Expected the status of bob and Carol, got %q", lines)
+	}
+
+	if _, lines := monitorLines(alice, "-", "carol"); len(lines) != 0 {
+		t.Errorf("Removing carol gave %q", lines)
+	}
+	expected = []string{
+		":irc.test " + RPL_MONLIST + " alice :bob",
+		":irc.test " + RPL_ENDOFMONLIST + " alice :End of MONITOR list",
+	}
+	if _, lines := monitorLines(alice, "L"); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+
+	monitorLines(alice, "C")
+	expected = []string{
+		":irc.test " + RPL_ENDOFMONLIST + " alice :End of MONITOR list",
+	}
+	if _, lines := monitorLines(alice, "L"); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+	if len(s.Monitors) != 0 {
+		t.Errorf("Clearing the list left %d nicknames monitored", len(s.Monitors))
+	}
+}
+
+func TestMonitor_Limit(t *testing.T) {
+	s := newLinkTestServer("irc.test")
+	s.Limits.Monitor = 2
+	alice := newLinkTestClient(t, s, "alice")
+	queued(alice)
+
+	err, lines := monitorLines(alice, "+", "a", "b", "c", "d")
+	expected := []string{
+		":irc.test " + RPL_MONOFFLINE + " alice :a,b",
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+	if err == nil || err.Numeric != ERR_MONLISTFULL || !reflect.DeepEqual(err.Params, []string{"2", "c,d", "Monitor list is full."}) {
+		t.Errorf("Expected %s for c and d, got %v", ERR_MONLISTFULL, err)
+	}
+
+	// Removing one makes room again.
+	monitorLines(alice, "-", "a")
+	if err, _ := monitorLines(alice, "+", "c"); err != nil {
+		t.Errorf("Monitoring after removing one gave %v", err)
+	}
+}
+
+func TestMonitor_Notifications(t *testing.T) {
+	s := newLinkTestServer("irc.test")
+	alice := newLinkTestClient(t, s, "alice")
+	monitorLines(alice, "+", "bob", "robert")
+
+	bob := newLinkTestClient(t, s, "bob")
+	expectLine(t, alice, " "+RPL_MONONLINE+" alice :bob!~bob@localhost")
+
+	reply := make(chan bool)
+	s.Events <- &SChangeNick{NewNick: "Robert", Client: bob, Reply: reply}
+	<-reply
+	expected := []string{
+		":irc.test " + RPL_MONOFFLINE + " alice :bob",
+		":irc.test " + RPL_MONONLINE + " alice :Robert!~bob@localhost",
+	}
+	if lines := queued(alice); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+
+	disconnectTestClient(bob)
+	expected = []string{
+		":irc.test " + RPL_MONOFFLINE + " alice :Robert",
+	}
+	if lines := queued(alice); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+// Commands that aren't defined by RFC 2812, and are therefore missing from
+// github.com/sorcix/irc.
+const (
+	ACK          = "ACK"
+	AUTHENTICATE = "AUTHENTICATE"
+	BATCH        = "BATCH"
+	CAP          = "CAP"
+	CHATHISTORY  = "CHATHISTORY"
+	FAIL         = "FAIL"
+	KNOCK        = "KNOCK"
+	MONITOR      = "MONITOR"
+	TAGMSG       = "TAGMSG"
+)
+
+// Commands that are only sent between linked servers.
+const (
+	BMASK  = "BMASK"
+	EOB    = "EOB"
+	SERVER = "SERVER"
+	SID    = "SID"
+	SJOIN  = "SJOIN"
+	TB     = "TB"
+	TMODE  = "TMODE"
+	UID    = "UID"
+)
+
+// Numerics that aren't defined by RFC 2812, and are therefore missing from
+// github.com/sorcix/irc. They're named in the same style.
+const (
+	RPL_ISUPPORT     = "005"
+	RPL_CREATIONTIME = "329"
+	RPL_WHOISACCOUNT = "330"
+	RPL_TOPICWHOTIME = "333"
+	RPL_WHOSPCRPL    = "354"
+
+	ERR_INVALIDCAPCMD = "410"
+	ERR_INPUTTOOLONG  = "417"
+
+	RPL_KNOCK        = "710"
+	RPL_KNOCKDLVR    = "711"
+	ERR_TOOMANYKNOCK = "712"
+	ERR_CHANOPEN     = "713"
+	ERR_KNOCKONCHAN  = "714"
+
+	RPL_MONONLINE    = "730"
+	RPL_MONOFFLINE   = "731"
+	RPL_MONLIST      = "732"
+	RPL_ENDOFMONLIST = "733"
+	ERR_MONLISTFULL  = "734"
+
+	RPL_WHOISSECURE      = "671"
+	ERR_INVALIDMODEPARAM = "696"
+
+	RPL_LOGGEDIN    = "900"
+	RPL_LOGGEDOUT   = "901"
+	RPL_SASLSUCCESS = "903"
+	ERR_SASLFAIL    = "904"
+	ERR_SASLTOOLONG = "905"
+	ERR_SASLABORTED = "906"
+	ERR_SASLALREADY = "907"
+	RPL_SASLMECHS   = "908"
+)
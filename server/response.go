@@ -0,0 +1,105 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"github.com/nightexcessive/excessiveircd/protocol"
+)
+
+const capLabeledResponse = "labeled-response"
+
+func init() {
+	registerCapability(&Capability{Name: capLabeledResponse})
+
+	registerTag("label", capLabeledResponse)
+}
+
+// response collects the replies to a labeled command so that they can be sent
+// together once the command has finished.
+type response struct {
+	label string
+	lines []responseLine
+}
+
+type responseLine struct {
+	tags protocol.Tags
+	line string
+}
+
+// startResponse starts collecting the replies to a command labeled with label.
+func (c *Client) startResponse(label string) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.response = &response{label: label}
+}
+
+// collectResponse adds line to the response that's being collected, if there
+// is one. It returns false if the client isn't waiting for a labeled response.
+func (c *Client) collectResponse(tags protocol.Tags, line string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.response == nil {
+		return false
+	}
+
+	c.response.lines = append(c.response.lines, responseLine{tags, line})
+	return true
+}
+
+// finishResponse sends the collected response. An empty response is
+// acknowledged with ACK, a single reply is labeled directly and multiple replies
+// are sent in a labeled-response batch. Replies that are already part of a
+// batch stay in it, so their batch is nested inside the labeled-response one.
+func (c *Client) finishResponse() {
+	c.Lock()
+	r := c.response
+	c.response = nil
+	c.Unlock()
+
+	if r == nil {
+		return
+	}
+
+	source := ":" + c.Server.FriendlyName() + " "
+	label := protocol.Tags{"label": r.label}
+
+	switch {
+	case len(r.lines) == 0:
+		c.writeString(prefixTags(label, source+ACK))
+	case len(r.lines) == 1:
+		tags := withTag(r.lines[0].tags, "label", r.label)
+		c.writeString(prefixTags(tags, r.lines[0].line))
+	case !c.HasCapability(capBatch):
+		// Without batches, there's no way to label more than one reply.
+		for _, line := range r.lines {
+			c.writeString(prefixTags(line.tags, line.line))
+		}
+	default:
+		ref := c.newBatchRef()
+		c.writeString(prefixTags(label, source+BATCH+" +"+ref+" "+batchLabeledResponse))
+		for _, line := range r.lines {
+			tags := line.tags
+			if _, ok := tags[batchTag]; !ok {
+				tags = withTag(tags, batchTag, ref)
+			}
+			c.writeString(prefixTags(tags, line.line))
+		}
+		c.writeString(source + BATCH + " -" + ref)
+	}
+}
+
+// withTag returns a copy of tags with key set to value.
+func withTag(tags protocol.Tags, key, value string) protocol.Tags {
+	copied := make(protocol.Tags, len(tags)+1)
+	for k, v := range tags {
+		copied[k] = v
+	}
+	copied[key] = value
+
+	return copied
+}
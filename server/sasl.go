@@ -0,0 +1,173 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"sort"
+	"strings"
+)
+
+const (
+	// saslChunkLength is the length of a full AUTHENTICATE payload chunk. A
+	// chunk of this length means that more chunks follow.
+	saslChunkLength = 400
+
+	// saslMaximumLength is the maximum length of a decoded SASL response.
+	saslMaximumLength = 8192
+)
+
+// saslMechanism checks a client's decoded SASL response. It returns the name of
+// the account that the client authenticated as, or false if authentication
+// failed.
+type saslMechanism func(c *Client, response []byte) (account string, ok bool)
+
+var saslMechanisms = map[string]saslMechanism{
+	"PLAIN":    saslPlain,
+	"EXTERNAL": saslExternal,
+}
+
+func init() {
+	registerCapability(&Capability{
+		Name: "sasl",
+		Value: func(*Server) string {
+			return saslMechanismList()
+		},
+	})
+}
+
+// saslMechanismList returns the supported mechanisms, separated by commas.
+func saslMechanismList() string {
+	names := make([]string, 0, len(saslMechanisms))
+	for name := range saslMechanisms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ",")
+}
+
+// saslPlain implements the PLAIN mechanism, as defined by RFC 4616.
+func saslPlain(c *Client, response []byte) (string, bool) {
+	fields := bytes.Split(response, []byte{0})
+	if len(fields) != 3 {
+		return "", false
+	}
+
+	authzid, authcid, password := string(fields[0]), string(fields[1]), string(fields[2])
+	if len(authzid) > 0 && authzid != authcid {
+		return "", false
+	}
+
+	account, err := LoadAccount(authcid)
+	if err != nil {
+		dummyAccount.CheckPassword(password)
+		return "", false
+	}
+
+	if !account.CheckPassword(password) {
+		return "", false
+	}
+
+	return account.Name, true
+}
+
+// saslExternal implements the EXTERNAL mechanism, as defined by RFC 4422,
+// using the client's TLS certificate.
+func saslExternal(c *Client, response []byte) (string, bool) {
+	fingerprint := c.CertFingerprint()
+	if len(fingerprint) == 0 {
+		return "", false
+	}
+
+	var (
+		account *Account
+		err     error
+	)
+	if authzid := string(response); len(authzid) > 0 {
+		account, err = LoadAccount(authzid)
+		if err == nil && !account.HasCertFingerprint(fingerprint) {
+			return "", false
+		}
+	} else {
+		account, err = LoadAccountByCertFingerprint(fingerprint)
+	}
+	if err != nil {
+		return "", false
+	}
+
+	return account.Name, true
+}
+
+func cmdAuthenticate(c *Client, m *Message) *CommandError {
+	if !c.HasCapability("sasl") {
+		return &CommandError{ERR_SASLFAIL, []string{"SASL authentication failed"}}
+	}
+	if len(c.Info.Account) > 0 {
+		return &CommandError{ERR_SASLALREADY, []string{"You have already authenticated using SASL"}}
+	}
+
+	param := m.Params[0]
+
+	if param == "*" {
+		c.resetSASL()
+		return &CommandError{ERR_SASLABORTED, []string{"SASL authentication aborted"}}
+	}
+
+	if len(c.sasl.mechanism) == 0 {
+		mechanism := strings.ToUpper(param)
+		if _, ok := saslMechanisms[mechanism]; !ok {
+			c.numeric(RPL_SASLMECHS, saslMechanismList(), "are available SASL mechanisms")
+			return &CommandError{ERR_SASLFAIL, []string{"SASL authentication failed"}}
+		}
+
+		c.sasl.mechanism = mechanism
+		c.writeLine(nil, AUTHENTICATE+" +")
+		return nil
+	}
+
+	if len(param) > saslChunkLength {
+		c.resetSASL()
+		return &CommandError{ERR_SASLTOOLONG, []string{"SASL message too long"}}
+	}
+	if param != "+" {
+		c.sasl.buffer += param
+	}
+	if len(c.sasl.buffer) > base64.StdEncoding.EncodedLen(saslMaximumLength) {
+		c.resetSASL()
+		return &CommandError{ERR_SASLTOOLONG, []string{"SASL message too long"}}
+	}
+	if len(param) == saslChunkLength {
+		// More chunks follow.
+		return nil
+	}
+
+	mechanism, encoded := c.sasl.mechanism, c.sasl.buffer
+	c.resetSASL()
+
+	response, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return &CommandError{ERR_SASLFAIL, []string{"SASL authentication failed"}}
+	}
+
+	account, ok := saslMechanisms[mechanism](c, response)
+	if !ok {
+		c.Logger.Printf("SASL %s authentication failed", mechanism)
+		return &CommandError{ERR_SASLFAIL, []string{"SASL authentication failed"}}
+	}
+
+	c.Info.Account = account
+	c.numeric(RPL_LOGGEDIN, c.Info.String(), account, "You are now logged in as "+account)
+	c.numeric(RPL_SASLSUCCESS, "SASL authentication successful")
+	return nil
+}
+
+// resetSASL discards any SASL exchange that's in progress.
+func (c *Client) resetSASL() {
+	c.sasl.mechanism = ""
+	c.sasl.buffer = ""
+}
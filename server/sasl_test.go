@@ -0,0 +1,94 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+// newSASLTestClient returns an unregistered client that has enabled the sasl
+// capability and queues its output.
+func newSASLTestClient() *Client {
+	c := newBatchTestClient("sasl")
+	c.Logger = log.New(ioutil.Discard, "", 0)
+	c.Info.Prefix = &irc.Prefix{Name: "*"}
+
+	return c
+}
+
+// authenticate sends each of params to c in an AUTHENTICATE command and returns
+// the lines that c was sent.
+func authenticate(c *Client, params ...string) []string {
+	for _, param := range params {
+		m := &Message{Message: &irc.Message{Command: AUTHENTICATE, Params: []string{param}}}
+		if err := cmdAuthenticate(c, m); err != nil {
+			c.sendError(err)
+		}
+	}
+
+	return queued(c)
+}
+
+func plainResponse(authzid, authcid, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(authzid + "\x00" + authcid + "\x00" + password))
+}
+
+func TestSASL_Plain(t *testing.T) {
+	useTestConfig(t)
+
+	account := &Account{Name: "alice"}
+	if err := account.SetPassword("hunter2"); err != nil {
+		t.Fatalf("Error setting password: %s", err)
+	}
+	if err := SaveAccount(account); err != nil {
+		t.Fatalf("Error saving account: %s", err)
+	}
+
+	tests := []struct {
+		response string
+		numeric  string
+		account  string
+	}{
+		{plainResponse("", "alice", "hunter2"), RPL_SASLSUCCESS, "alice"},
+		{plainResponse("alice", "alice", "hunter2"), RPL_SASLSUCCESS, "alice"},
+		{plainResponse("", "alice", "hunter3"), ERR_SASLFAIL, ""},
+		{plainResponse("bob", "alice", "hunter2"), ERR_SASLFAIL, ""},
+		{plainResponse("", "bob", "hunter2"), ERR_SASLFAIL, ""},
+		{base64.StdEncoding.EncodeToString([]byte("alice\x00hunter2")), ERR_SASLFAIL, ""},
+		{"not base64!", ERR_SASLFAIL, ""},
+	}
+
+	for _, test := range tests {
+		c := newSASLTestClient()
+		lines := authenticate(c, "PLAIN", test.response)
+
+		if len(lines) == 0 || lines[0] != AUTHENTICATE+" +" {
+			t.Errorf("%q: PLAIN wasn't accepted: %q", test.response, lines)
+			continue
+		}
+		if last := lines[len(lines)-1]; !strings.Contains(last, " "+test.numeric+" ") {
+			t.Errorf("%q: last reply is %q, want %s", test.response, last, test.numeric)
+		}
+		if c.Info.Account != test.account {
+			t.Errorf("%q: logged in as %q, want %q", test.response, c.Info.Account, test.account)
+		}
+	}
+}
+
+func TestSASL_UnknownMechanism(t *testing.T) {
+	c := newSASLTestClient()
+	lines := authenticate(c, "SCRAM-SHA-1")
+
+	if len(lines) != 2 || !strings.Contains(lines[0], " "+RPL_SASLMECHS+" ") || !strings.Contains(lines[1], " "+ERR_SASLFAIL+" ") {
+		t.Errorf("Unknown mechanism got %q", lines)
+	}
+}
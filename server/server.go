@@ -14,21 +14,41 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/nightexcessive/excessiveircd/config"
+	"github.com/nightexcessive/excessiveircd/protocol"
 	"github.com/pborman/uuid"
+	"github.com/sorcix/irc"
 )
 
+func init() {
+	registerISupport("NETWORK", func(s *Server) (string, bool) {
+		return s.Network, len(s.Network) > 0
+	})
+}
+
+// AdminInfo holds the administrative information sent in reply to ADMIN.
+type AdminInfo struct {
+	Location1 string
+	Location2 string
+	Email     string
+}
+
 // ListenPort represents a port to be listened on.
 // IP specifies the local IP address to listen on.
 // Port specifies the port number to listen on.
 // TLS specifies the TLS configuration to use. If nil, the port listens for
 // cleartext traffic.
+// Servers specifies that the port accepts links from other servers rather than
+// clients.
 type ListenPort struct {
 	IP   net.IP
 	Port uint16
 
 	TLS *tls.Config
+
+	Servers bool
 }
 
 // Server represents a local server.
@@ -37,13 +57,73 @@ type Server struct {
 	Name    string
 	Network string
 
+	// The time at which the server was first started.
+	Created time.Time
+
+	// MOTD holds the lines of the message of the day.
+	MOTD []string
+
+	Admin AdminInfo
+
 	Logger *log.Logger
 
+	// UTF8 allows nicknames and channel names to contain Unicode letters and
+	// requires that everything clients send is valid UTF-8.
+	UTF8 bool
+
+	// Casemapping is the name of the casemapping that nicknames and channel
+	// names are compared with. It must be one of protocol.Casemappings.
+	Casemapping string
+
+	Limits   Limits
+	Timeouts Timeouts
+
+	HistoryConfig HistoryConfig
+
+	// History stores the history of channels and private conversations. It's
+	// nil if no history is kept.
+	History HistoryStore
+
 	Events chan interface{}
 
+	// Clients holds the registered clients, including other servers' clients,
+	// keyed by their folded nicknames.
 	Clients map[string]*Client
 
+	// ClientIDs holds the same clients as Clients, keyed by their IDs.
+	ClientIDs map[string]*Client
+
+	// Unregistered holds connections that haven't finished registering yet.
+	Unregistered map[*Client]struct{}
+
+	// Whowas holds the nicknames that clients have stopped using, from the
+	// oldest to the newest.
+	Whowas []WhowasEntry
+
+	// Monitors holds the clients that are monitoring each folded nickname.
+	Monitors map[string]map[*Client]struct{}
+
+	// Channels is keyed by folded channel name. Channels are created when the first
+	// client joins and removed when the last client leaves.
+	Channels map[string]*Channel
+
+	// LinkConfigs holds the servers that may link to this one.
+	LinkConfigs []*LinkConfig
+
+	// Links holds the connections to other servers.
+	Links map[*Link]struct{}
+
+	// Servers holds the other servers on the network, keyed by their IDs.
+	Servers map[string]*RemoteServer
+
 	Listeners []net.Listener
+
+	// connections tracks every client and link that has connected and hasn't
+	// finished closing yet.
+	connections sync.WaitGroup
+
+	// quit is closed when the server begins shutting down.
+	quit chan struct{}
 }
 
 // FriendlyName is a convenience function to return the server's display name.
@@ -59,23 +139,106 @@ func (s *Server) eventLoop() {
 	for event := range s.Events {
 		s.Logger.Printf("Event: %T", event)
 		switch ev := event.(type) {
+		case *SNewClient:
+			s.Unregistered[ev.Client] = struct{}{}
 		case *SRegisterClient:
-			if _, ok := s.Clients[ev.Client.Info.Name]; ok {
+			if s.nickInUse(ev.Client, ev.Client.Info.Name) {
 				ev.Reply <- false
 				continue
 			}
-			s.Clients[ev.Client.Info.Name] = ev.Client
+			delete(s.Unregistered, ev.Client)
+			s.Clients[s.fold(ev.Client.Info.Name)] = ev.Client
+			s.ClientIDs[ev.Client.ID.String()] = ev.Client
+			s.notifyMonitors(ev.Client.Info.Name, ev.Client)
+			s.propagate(nil, s.uidLine(ev.Client))
 			ev.Reply <- true
 		case *SChangeNick:
-			if _, ok := s.Clients[ev.NewNick]; ok {
+			// A client may change the case of its own nickname.
+			if s.nickInUse(ev.Client, ev.NewNick) {
 				ev.Reply <- false
 				continue
 			}
-			delete(s.Clients, ev.Client.Info.Name)
-			s.Clients[ev.NewNick] = ev.Client
+			s.recordWhowas(ev.Client)
+			s.changeNick(ev.Client, ev.NewNick, time.Now())
 			ev.Reply <- true
 		case *SDeregisterClient:
-			delete(s.Clients, ev.Client.Info.Name)
+			if s.Clients[s.fold(ev.Client.Info.Name)] == ev.Client {
+				s.recordWhowas(ev.Client)
+			}
+			s.deregisterClient(ev.Client, ev.Reason)
+			ev.Reply <- struct{}{}
+		case *SListClients:
+			clients := make([]*Client, 0, len(s.Clients)+len(s.Unregistered))
+			for _, client := range s.Clients {
+				if client.Origin == nil {
+					clients = append(clients, client)
+				}
+			}
+			for client := range s.Unregistered {
+				clients = append(clients, client)
+			}
+			ev.Reply <- clients
+		case *SNewLink:
+			s.Links[ev.Link] = struct{}{}
+		case *SLinkEstablished:
+			ev.Reply <- s.establishLink(ev.Link, ev.ID, ev.Name)
+		case *SLinkMessage:
+			s.handleLinkMessage(ev.Link, ev.Message)
+		case *SLinkClosed:
+			s.closeLink(ev.Link)
+		case *SListLinks:
+			links := make([]*Link, 0, len(s.Links))
+			for l := range s.Links {
+				links = append(links, l)
+			}
+			ev.Reply <- links
+		case *SJoinChannel:
+			ev.Reply <- s.joinChannel(ev.Client, ev.Name, ev.Key)
+		case *SPartChannel:
+			ev.Reply <- s.partChannel(ev.Client, ev.Name, ev.Reason)
+		case *SPartAllChannels:
+			for _, channel := range ev.Client.Channels {
+				s.partChannel(ev.Client, channel.Name, ev.Client.Info.Name)
+			}
+			ev.Reply <- struct{}{}
+		case *SNames:
+			s.sendNames(ev.Client, ev.Name)
+			ev.Reply <- struct{}{}
+		case *STopic:
+			ev.Reply <- s.topic(ev.Client, ev.Name, ev.Topic, ev.Set)
+		case *SLusers:
+			s.sendLusers(ev.Client)
+			ev.Reply <- struct{}{}
+		case *SPrivmsg:
+			ev.Reply <- s.privmsg(ev.Client, ev.Command, ev.Target, ev.Text, ev.Tags)
+		case *SKick:
+			ev.Reply <- s.kick(ev.Client, ev.Name, ev.Nick, ev.Reason)
+		case *SInvite:
+			ev.Reply <- s.invite(ev.Client, ev.Nick, ev.Name)
+		case *SKnock:
+			ev.Reply <- s.knock(ev.Client, ev.Name)
+		case *SChannelMode:
+			ev.Reply <- s.channelMode(ev.Client, ev.Name, ev.Changes, ev.Set)
+		case *SList:
+			s.list(ev.Client, ev.Names)
+			ev.Reply <- struct{}{}
+		case *SWhois:
+			s.whois(ev.Client, ev.Nick)
+			ev.Reply <- struct{}{}
+		case *SWhowas:
+			s.whowas(ev.Client, ev.Nick, ev.Count)
+			ev.Reply <- struct{}{}
+		case *SWho:
+			s.who(ev.Client, ev.Mask, ev.WHOX)
+			ev.Reply <- struct{}{}
+		case *SMonitor:
+			ev.Reply <- s.monitor(ev.Client, ev.Subcommand, ev.Targets)
+		case *SChatHistory:
+			if ev.Subcommand == "TARGETS" {
+				s.chatHistoryTargets(ev.Client, ev.Query)
+			} else {
+				s.chatHistory(ev.Client, ev.Subcommand, ev.Target, ev.Query)
+			}
 			ev.Reply <- struct{}{}
 		default:
 			s.Logger.Printf("Unexpected event of type %T: %#v", ev, ev)
@@ -83,13 +246,116 @@ func (s *Server) eventLoop() {
 	}
 }
 
-// Start starts the server's event loop and all of its listeners.
-func (s *Server) Start() error {
+// changeNick changes c's nickname to nick, which it took at ts, and informs c,
+// everyone who shares a channel with it and the other servers.
+func (s *Server) changeNick(c *Client, nick string, ts time.Time) {
+	tags := c.relayTags(nil)
+	m := &irc.Message{
+		Prefix:  c.Info.Prefix,
+		Command: irc.NICK,
+		Params:  []string{nick},
+	}
+	c.writeTaggedMessage(tags, m)
+	for peer := range c.peers() {
+		peer.relay(c, tags, m)
+	}
+
+	oldNick := c.Info.Name
+	delete(s.Clients, s.fold(oldNick))
+	s.Clients[s.fold(nick)] = c
+	c.Info.Name = nick
+	c.Info.ChangeTime = ts
+	s.propagate(c.link(), linkLine(c.ID.String(), irc.NICK, nick, formatTS(ts)))
+
+	if s.fold(oldNick) != s.fold(nick) {
+		s.notifyMonitors(oldNick, nil)
+		s.notifyMonitors(nick, c)
+	}
+}
+
+// deregisterClient removes c from the server and all of its channels. Everyone
+// who shares a channel with c is sent a QUIT with the given reason, and so are
+// the other servers if they know about c.
+func (s *Server) deregisterClient(c *Client, reason string) {
+	if _, ok := s.Unregistered[c]; ok {
+		delete(s.Unregistered, c)
+		s.Logger.Printf("Unregistered connection from %s closed (%d remaining)", c.conn.RemoteAddr(), len(s.Unregistered))
+	}
+
+	// Unregistered clients may be using a nickname that belongs to someone
+	// else.
+	if s.Clients[s.fold(c.Info.Name)] == c {
+		delete(s.Clients, s.fold(c.Info.Name))
+		s.notifyMonitors(c.Info.Name, nil)
+	}
+
+	if s.ClientIDs[c.ID.String()] == c {
+		delete(s.ClientIDs, c.ID.String())
+		s.propagate(c.link(), linkLine(c.ID.String(), irc.QUIT, reason))
+	}
+
+	for _, target := range c.Monitoring {
+		s.removeMonitor(c, target)
+	}
+
+	tags := c.relayTags(nil)
+	m := &irc.Message{
+		Prefix:  c.Info.Prefix,
+		Command: irc.QUIT,
+		Params:  []string{reason},
+	}
+	for peer := range c.peers() {
+		peer.relay(c, tags, m)
+	}
+
+	for _, channel := range c.Channels {
+		s.removeMember(channel, c)
+	}
+}
+
+// sendLusers sends user statistics to c.
+func (s *Server) sendLusers(c *Client) {
+	local := 0
+	for _, client := range s.Clients {
+		if client.Origin == nil {
+			local++
+		}
+	}
+	links := 0
+	for l := range s.Links {
+		if l.Remote != nil {
+			links++
+		}
+	}
+
+	c.numeric(irc.RPL_LUSERCLIENT, fmt.Sprintf("There are %d users and 0 services on %d servers", len(s.Clients), len(s.Servers)+1))
+	if len(s.Unregistered) > 0 {
+		c.numeric(irc.RPL_LUSERUNKNOWN, strconv.Itoa(len(s.Unregistered)), "unknown connection(s)")
+	}
+	if len(s.Channels) > 0 {
+		c.numeric(irc.RPL_LUSERCHANNELS, strconv.Itoa(len(s.Channels)), "channels formed")
+	}
+	c.numeric(irc.RPL_LUSERME, fmt.Sprintf("I have %d clients and %d servers", local, links))
+}
+
+// initialize creates the state that's owned by the server's event loop.
+func (s *Server) initialize() {
 	s.Events = make(chan interface{})
-	defer close(s.Events)
+	s.quit = make(chan struct{})
 
 	s.Clients = make(map[string]*Client)
+	s.ClientIDs = make(map[string]*Client)
+	s.Unregistered = make(map[*Client]struct{})
+	s.Channels = make(map[string]*Channel)
+	s.Monitors = make(map[string]map[*Client]struct{})
+	s.Links = make(map[*Link]struct{})
+	s.Servers = make(map[string]*RemoteServer)
+}
 
+// Start starts the server's event loop, all of its listeners and its links to
+// other servers. It blocks until the listeners are closed.
+func (s *Server) Start() error {
+	s.initialize()
 	go s.eventLoop()
 
 	var listeners []*ListenPort
@@ -113,8 +379,66 @@ func (s *Server) Start() error {
 		return err
 	}
 
+	if err := config.Get("created", &s.Created); err == config.ErrDoesNotExist {
+		s.Created = time.Now()
+		if err := config.Set("created", s.Created); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	optional := map[string]interface{}{
+		"name":    &s.Name,
+		"network": &s.Network,
+		"motd":    &s.MOTD,
+		"admin":   &s.Admin,
+		"utf8":    &s.UTF8,
+		"links":   &s.LinkConfigs,
+	}
+	for key, val := range optional {
+		if err := config.Get(key, val); err != nil && err != config.ErrDoesNotExist {
+			return err
+		}
+	}
+
+	s.Casemapping = DefaultCasemapping
+	if s.UTF8 {
+		s.Casemapping = DefaultUTF8Casemapping
+	}
+	if err := config.Get("casemapping", &s.Casemapping); err != nil && err != config.ErrDoesNotExist {
+		return err
+	}
+	if _, ok := protocol.Casemappings[s.Casemapping]; !ok {
+		return fmt.Errorf("server: unknown casemapping %q", s.Casemapping)
+	}
+
+	s.Limits = DefaultLimits
+	if err := config.Get("limits", &s.Limits); err != nil && err != config.ErrDoesNotExist {
+		return err
+	}
+
+	s.Timeouts = DefaultTimeouts
+	if err := config.Get("timeouts", &s.Timeouts); err != nil && err != config.ErrDoesNotExist {
+		return err
+	}
+
+	s.HistoryConfig = DefaultHistoryConfig
+	if err := config.Get("history", &s.HistoryConfig); err != nil && err != config.ErrDoesNotExist {
+		return err
+	}
+	if err := s.openHistory(); err != nil {
+		return err
+	}
+
 	s.Logger = log.New(os.Stderr, fmt.Sprintf("Server(%s) ", s.ID), 0)
 
+	for _, link := range s.LinkConfigs {
+		if len(link.Address) > 0 {
+			go s.connectLink(link)
+		}
+	}
+
 	s.startListeners(listeners)
 
 	return nil
@@ -122,6 +446,7 @@ func (s *Server) Start() error {
 
 func (s *Server) close(reason string) error {
 	s.Logger.Printf("Shutting down: %s", reason)
+	close(s.quit)
 	for _, listener := range s.Listeners {
 		if err := listener.Close(); err != nil {
 			s.Logger.Printf("Error closing listener on %s: %s", listener.Addr(), err)
@@ -133,65 +458,100 @@ func (s *Server) close(reason string) error {
 	if len(reason) > 0 {
 		closeEvent.Reason = fmt.Sprintf("Server shutting down: %s", reason)
 	}
-	wg := new(sync.WaitGroup)
-	wg.Add(len(s.Clients))
-	for _, client := range s.Clients {
-		go func(client *Client) {
-			defer wg.Done()
-			client.Events <- closeEvent
-		}(client)
+
+	// The event loop owns the client lists, so we have to ask it for them.
+	reply := make(chan []*Client)
+	s.Events <- &SListClients{reply}
+	for _, client := range <-reply {
+		go client.sendEvent(closeEvent)
 	}
-	wg.Wait()
+
+	linksReply := make(chan []*Link)
+	s.Events <- &SListLinks{linksReply}
+	for _, l := range <-linksReply {
+		l.close(closeEvent.Reason)
+	}
+
+	// Clients and links need the event loop to deregister, so it can't be
+	// stopped until they've all finished closing.
+	s.connections.Wait()
 
 	close(s.Events)
 
 	return nil
 }
 
-func (s *Server) listen(listenSpec *ListenPort, wg *sync.WaitGroup) {
-	defer wg.Done()
-
+// listen opens a listener for listenSpec.
+func (s *Server) listen(listenSpec *ListenPort) (net.Listener, error) {
 	listenAddr := net.JoinHostPort(listenSpec.IP.String(), strconv.FormatInt(int64(listenSpec.Port), 10))
-	var listener net.Listener
 
 	if listenSpec.TLS != nil {
-		tlsListener, err := tls.Listen("tcp", listenAddr, listenSpec.TLS)
+		tlsConfig := listenSpec.TLS
+		if tlsConfig.ClientAuth == tls.NoClientCert && !listenSpec.Servers {
+			// Client certificates are needed for SASL EXTERNAL. They're
+			// only ever matched by fingerprint, so they aren't verified.
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ClientAuth = tls.RequestClientCert
+		}
+
+		listener, err := tls.Listen("tcp", listenAddr, tlsConfig)
 		if err != nil {
 			s.Logger.Printf("Failed to listen for SSL connections on %s: %s", listenAddr, err)
-			return
+			return nil, err
 		}
-		listener = tlsListener
 		s.Logger.Printf("Listening for SSL connections on %s...", listenAddr)
-	} else {
-		clearListener, err := net.Listen("tcp", listenAddr)
-		if err != nil {
-			s.Logger.Printf("Failed to listen on %s: %s", listenAddr, err)
-			return
-		}
-		listener = clearListener
-		s.Logger.Printf("Listening on %s...", listenAddr)
+		return listener, nil
+	}
+
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		s.Logger.Printf("Failed to listen on %s: %s", listenAddr, err)
+		return nil, err
 	}
+	s.Logger.Printf("Listening on %s...", listenAddr)
+	return listener, nil
+}
 
-	defer listener.Close()
+// accept accepts connections on listener until it's closed. Connections are
+// links from other servers if listenSpec says so, and clients otherwise.
+func (s *Server) accept(listener net.Listener, listenSpec *ListenPort, wg *sync.WaitGroup) {
+	defer wg.Done()
 
 	for {
 		c, err := listener.Accept()
 		if err != nil {
-			s.Logger.Printf("Error accepting connection on %s: %s", listenAddr, err)
-			continue
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				s.Logger.Printf("Error accepting connection on %s: %s", listener.Addr(), err)
+				continue
+			}
+
+			s.Logger.Printf("Stopped listening on %s: %s", listener.Addr(), err)
+			return
 		}
 
-		s.Logger.Printf("New connection to %s from %s", listenAddr, c.RemoteAddr())
-		go NewClient(c, s)
+		s.Logger.Printf("New connection to %s from %s", listener.Addr(), c.RemoteAddr())
+		if listenSpec.Servers {
+			go s.Link(c, nil)
+		} else {
+			go NewClient(c, s)
+		}
 	}
 }
 
+// startListeners opens every listener and then accepts connections on them
+// until they've all been closed.
 func (s *Server) startListeners(listeners []*ListenPort) {
 	wg := new(sync.WaitGroup)
-	wg.Add(len(listeners))
 
-	for _, listener := range listeners {
-		go s.listen(listener, wg)
+	for _, listenSpec := range listeners {
+		listener, err := s.listen(listenSpec)
+		if err != nil {
+			continue
+		}
+
+		s.Listeners = append(s.Listeners, listener)
+		wg.Add(1)
+		go s.accept(listener, listenSpec, wg)
 	}
 
 	wg.Wait()
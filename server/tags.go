@@ -0,0 +1,89 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"time"
+
+	"github.com/nightexcessive/excessiveircd/protocol"
+	"github.com/pborman/uuid"
+)
+
+const (
+	capMessageTags = "message-tags"
+	capServerTime  = "server-time"
+	capAccountTag  = "account-tag"
+)
+
+// serverTimeFormat is the format of the time tag, as defined by the
+// server-time specification.
+const serverTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// tagCapabilities maps each tag that the server sends to the capability that a
+// client must have enabled to receive it. Client-only tags are always mapped
+// to message-tags.
+var tagCapabilities = make(map[string]string)
+
+// registerTag registers a tag that the server may send to clients that have
+// enabled capability.
+func registerTag(key, capability string) {
+	if _, ok := tagCapabilities[key]; ok {
+		panic("server: tag registered twice: " + key)
+	}
+
+	tagCapabilities[key] = capability
+}
+
+func init() {
+	registerCapability(&Capability{Name: capMessageTags})
+	registerCapability(&Capability{Name: capServerTime})
+	registerCapability(&Capability{Name: capAccountTag})
+
+	registerTag("msgid", capMessageTags)
+	registerTag("time", capServerTime)
+	registerTag("account", capAccountTag)
+}
+
+// relayTags returns the tags to send with a message that's relayed from c:
+// the time, a unique message ID, c's account if it's logged in, and the given
+// client-only tags. The same tags must be sent to every recipient of the
+// message.
+func (c *Client) relayTags(clientTags protocol.Tags) protocol.Tags {
+	tags := make(protocol.Tags, len(clientTags)+3)
+	for key, value := range clientTags {
+		tags[key] = value
+	}
+
+	tags["time"] = time.Now().UTC().Format(serverTimeFormat)
+	tags["msgid"] = uuid.NewRandom().String()
+	if len(c.Info.Account) > 0 {
+		tags["account"] = c.Info.Account
+	}
+
+	return tags
+}
+
+// allowedTags returns the tags in tags that c has enabled the capabilities to
+// receive. Tags that haven't been registered are never allowed.
+func (c *Client) allowedTags(tags protocol.Tags) protocol.Tags {
+	var allowed protocol.Tags
+	for key, value := range tags {
+		capability, ok := tagCapabilities[key]
+		if protocol.IsClientOnlyTag(key) {
+			capability, ok = capMessageTags, true
+		}
+		if !ok || !c.HasCapability(capability) {
+			continue
+		}
+
+		if allowed == nil {
+			allowed = make(protocol.Tags, len(tags))
+		}
+		allowed[key] = value
+	}
+
+	return allowed
+}
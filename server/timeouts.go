@@ -0,0 +1,43 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import "time"
+
+// Timeouts holds the timeouts that a server applies to its clients. They're
+// loaded from the "timeouts" configuration key. Any timeouts that aren't set
+// there keep their default values.
+type Timeouts struct {
+	// PingInterval is how long a client may be idle before it's sent a PING.
+	PingInterval time.Duration
+
+	// PingTimeout is how long a client has to respond to a PING before it's
+	// disconnected.
+	PingTimeout time.Duration
+
+	// RegistrationTimeout is how long a client has to finish registering
+	// before it's disconnected.
+	RegistrationTimeout time.Duration
+
+	// InviteTimeout is how long an invitation lets a client join a channel
+	// past its invite-only, key and limit modes.
+	InviteTimeout time.Duration
+
+	// KnockInterval is how long a channel must wait between KNOCKs.
+	KnockInterval time.Duration
+}
+
+// DefaultTimeouts are the timeouts that are used if they aren't set in the
+// configuration.
+var DefaultTimeouts = Timeouts{
+	PingInterval: 2 * time.Minute,
+	PingTimeout:  1 * time.Minute,
+
+	RegistrationTimeout: 30 * time.Second,
+
+	InviteTimeout: 1 * time.Hour,
+	KnockInterval: 1 * time.Minute,
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+const (
+	// UserModes lists the user modes that the server supports.
+	UserModes = ""
+
+	// ChannelModes lists the channel modes that the server supports.
+	ChannelModes = "Iabehiklmnopqstv"
+)
+
+// sendWelcome sends everything a client is sent once it finishes registering.
+func (c *Client) sendWelcome() {
+	s := c.Server
+
+	c.numeric(irc.RPL_WELCOME, "Welcome to the Internet Relay Network "+c.Info.String())
+	c.numeric(irc.RPL_YOURHOST, "Your host is "+s.FriendlyName()+", running version "+SoftwareName+"-"+SoftwareVersion)
+	c.numeric(irc.RPL_CREATED, "This server was created "+s.Created.Format(time.RFC1123))
+
+	// Both lists must be sent so that clients can tell which is which, even
+	// though there are no user modes.
+	userModes := UserModes
+	if len(userModes) == 0 {
+		userModes = "*"
+	}
+	c.rawNumeric(irc.RPL_MYINFO, s.FriendlyName(), SoftwareName+"-"+SoftwareVersion, userModes, ChannelModes)
+
+	c.sendISupport()
+	c.sendLusers()
+	c.sendMOTD()
+}
+
+// sendLusers sends user statistics to c.
+func (c *Client) sendLusers() {
+	reply := make(chan struct{})
+	c.Server.Events <- &SLusers{c, reply}
+	<-reply
+}
+
+// sendMOTD sends the message of the day to c.
+func (c *Client) sendMOTD() {
+	s := c.Server
+	if len(s.MOTD) == 0 {
+		c.numeric(irc.ERR_NOMOTD, "MOTD File is missing")
+		return
+	}
+
+	c.numeric(irc.RPL_MOTDSTART, "- "+s.FriendlyName()+" Message of the day - ")
+	for _, line := range s.MOTD {
+		c.numeric(irc.RPL_MOTD, "- "+strings.TrimRight(line, "\r\n"))
+	}
+	c.numeric(irc.RPL_ENDOFMOTD, "End of MOTD command")
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/nightexcessive/excessiveircd/protocol"
+	"github.com/sorcix/irc"
+)
+
+// whoxFields holds the WHOX fields that may be requested, in the order that
+// they're sent.
+const whoxFields = "tcuihsnfdlaor"
+
+func init() {
+	registerISupport("WHOX", isupportValue(""))
+}
+
+// whoxQuery is a WHOX request for specific fields.
+type whoxQuery struct {
+	// Fields holds the requested fields, in any order.
+	Fields string
+
+	// Token is sent back in the t field so that the client can match replies
+	// to requests.
+	Token string
+}
+
+func cmdWho(c *Client, m *Message) *CommandError {
+	mask := "*"
+	if len(m.Params) > 0 && m.Params[0] != "0" {
+		mask = m.Params[0]
+	}
+
+	// WHO <mask> [%<fields>[,<token>]]
+	var whox *whoxQuery
+	if len(m.Params) > 1 {
+		if i := strings.IndexByte(m.Params[1], '%'); i >= 0 {
+			fields := strings.SplitN(m.Params[1][i+1:], ",", 2)
+			whox = &whoxQuery{Fields: fields[0], Token: "0"}
+			if len(fields) > 1 && len(fields[1]) > 0 {
+				whox.Token = fields[1]
+			}
+		}
+	}
+
+	reply := make(chan struct{})
+	c.Server.Events <- &SWho{c, mask, whox, reply}
+	<-reply
+	return nil
+}
+
+// who sends c a reply for each client that matches mask. If mask is a channel
+// name, its members are sent instead. If whox is set, WHOX replies with only
+// the requested fields are sent.
+func (s *Server) who(c *Client, mask string, whox *whoxQuery) {
+	defer c.numeric(irc.RPL_ENDOFWHO, mask, "End of WHO list")
+
+	if isChannelTarget(mask) {
+		channel, ok := s.Channels[s.fold(mask)]
+		if !ok || !channel.isVisibleTo(c) {
+			return
+		}
+
+		for member := range channel.Members {
+			s.sendWhoReply(c, member, channel, whox)
+		}
+		return
+	}
+
+	folded := s.fold(mask)
+	for _, target := range s.Clients {
+		for _, field := range []string{target.Info.Name, target.Info.User, target.Info.Host, target.Info.Real, target.serverName()} {
+			if protocol.Match(folded, s.fold(field)) {
+				s.sendWhoReply(c, target, nil, whox)
+				break
+			}
+		}
+	}
+}
+
+// sendWhoReply sends c a WHO reply about target. channel is the channel that
+// was asked about, or nil if a mask was given.
+func (s *Server) sendWhoReply(c *Client, target *Client, channel *Channel, whox *whoxQuery) {
+	channelName := "*"
+	if channel != nil {
+		channelName = channel.Name
+	}
+
+	// Away isn't supported, so everyone is here.
+	flags := "H"
+	if channel != nil {
+		flags += channel.prefixes(target, c)
+	}
+
+	if whox == nil {
+		c.numeric(irc.RPL_WHOREPLY, channelName, target.Info.User, target.Info.Host, target.serverName(), target.Info.Name, flags, "0 "+target.Info.Real)
+		return
+	}
+
+	var params []string
+	for _, field := range whoxFields {
+		if !strings.ContainsRune(whox.Fields, field) {
+			continue
+		}
+
+		var value string
+		switch field {
+		case 't':
+			value = whox.Token
+		case 'c':
+			value = channelName
+		case 'u':
+			value = target.Info.User
+		case 'i':
+			// IP addresses would give away hosts that are otherwise
+			// hidden, so clients only see their own.
+			value = "255.255.255.255"
+			if target == c && target.IP != nil {
+				value = target.IP.String()
+			}
+		case 'h':
+			value = target.Info.Host
+		case 's':
+			value = target.serverName()
+		case 'n':
+			value = target.Info.Name
+		case 'f':
+			value = flags
+		case 'd':
+			value = "0"
+		case 'l':
+			value = strconv.Itoa(int(target.IdleTime().Seconds()))
+		case 'a':
+			value = "0"
+			if len(target.Info.Account) > 0 {
+				value = target.Info.Account
+			}
+		case 'o':
+			value = "n/a"
+		case 'r':
+			value = target.Info.Real
+		}
+		params = append(params, value)
+	}
+
+	c.numeric(RPL_WHOSPCRPL, params...)
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+// whoLines runs WHO for c and returns what it's sent.
+func whoLines(c *Client, mask string, whox *whoxQuery) []string {
+	reply := make(chan struct{})
+	c.Server.Events <- &SWho{c, mask, whox, reply}
+	<-reply
+	return queued(c)
+}
+
+func TestWho(t *testing.T) {
+	alice, _ := newWhoisTestClients(t)
+
+	expected := []string{
+		":irc.test " + irc.RPL_WHOREPLY + " alice #test ~bob localhost irc.test bob H@ :0 bob",
+		":irc.test " + irc.RPL_ENDOFWHO + " alice #test :End of WHO list",
+	}
+	if lines := whoLines(alice, "#test", nil); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+
+	expected = []string{
+		":irc.test " + irc.RPL_WHOREPLY + " alice * ~bob localhost irc.test bob H :0 bob",
+		":irc.test " + irc.RPL_ENDOFWHO + " alice b*b :End of WHO list",
+	}
+	if lines := whoLines(alice, "b*b", nil); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+}
+
+func TestWho_WHOX(t *testing.T) {
+	alice, bob := newWhoisTestClients(t)
+	bob.IP = net.ParseIP("192.0.2.1")
+
+	whox := &whoxQuery{Fields: "rnahiuct", Token: "42"}
+
+	// Only bob may see bob's IP address.
+	expected := []string{
+		":irc.test " + RPL_WHOSPCRPL + " alice 42 #test ~bob 255.255.255.255 localhost bob bobacct :bob",
+		":irc.test " + irc.RPL_ENDOFWHO + " alice #test :End of WHO list",
+	}
+	if lines := whoLines(alice, "#test", whox); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+
+	expected = []string{
+		":irc.test " + RPL_WHOSPCRPL + " bob 42 #test ~bob 192.0.2.1 localhost bob bobacct :bob",
+		":irc.test " + irc.RPL_ENDOFWHO + " bob #test :End of WHO list",
+	}
+	if lines := whoLines(bob, "#test", whox); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// WhowasEntry records a nickname that a client stopped using, either by
+// changing it or by disconnecting.
+type WhowasEntry struct {
+	Nick    string
+	User    string
+	Host    string
+	Real    string
+	Account string
+
+	// The time at which the client stopped using the nickname.
+	Time time.Time
+}
+
+func cmdWhois(c *Client, m *Message) *CommandError {
+	nick := m.Params[0]
+	if len(m.Params) > 1 {
+		// WHOIS <server> <nick>. Clients also give the nickname as the server
+		// to ask the user's own server, which is always us.
+		if m.Params[0] != m.Params[1] {
+			if err := checkServerTarget(c, m, 0); err != nil {
+				return err
+			}
+		}
+		nick = m.Params[1]
+	}
+
+	// Only the first of a comma-separated list of nicknames is looked up.
+	nick = strings.SplitN(nick, ",", 2)[0]
+
+	reply := make(chan struct{})
+	c.Server.Events <- &SWhois{c, nick, reply}
+	<-reply
+	return nil
+}
+
+// whois sends c information about the client using nick.
+func (s *Server) whois(c *Client, nick string) {
+	defer c.numeric(irc.RPL_ENDOFWHOIS, nick, "End of /WHOIS list")
+
+	target, ok := s.Clients[s.fold(nick)]
+	if !ok {
+		c.numeric(irc.ERR_NOSUCHNICK, nick, "No such nick/channel")
+		return
+	}
+	nick = target.Info.Name
+
+	c.numeric(irc.RPL_WHOISUSER, nick, target.Info.User, target.Info.Host, "*", target.Info.Real)
+
+	channels := make([]string, 0, len(target.Channels))
+	for _, channel := range target.Channels {
+		if channel.isVisibleTo(c) {
+			channels = append(channels, channel.prefixes(target, c)+channel.Name)
+		}
+	}
+	sort.Strings(channels)
+	sendList(c, irc.RPL_WHOISCHANNELS, " ", channels, nick)
+
+	c.numeric(irc.RPL_WHOISSERVER, nick, target.serverName(), SoftwareName)
+	if len(target.Info.Account) > 0 {
+		c.numeric(RPL_WHOISACCOUNT, nick, target.Info.Account, "is logged in as")
+	}
+	if target.IsSecure() {
+		c.numeric(RPL_WHOISSECURE, nick, "is using a secure connection")
+	}
+	c.numeric(irc.RPL_WHOISIDLE, nick, strconv.Itoa(int(target.IdleTime().Seconds())), strconv.FormatInt(target.ConnectTime.Unix(), 10), "seconds idle, signon time")
+}
+
+func cmdWhowas(c *Client, m *Message) *CommandError {
+	count := 0
+	if len(m.Params) > 1 {
+		count, _ = strconv.Atoi(m.Params[1])
+	}
+	if err := checkServerTarget(c, m, 2); err != nil {
+		return err
+	}
+
+	nick := strings.SplitN(m.Params[0], ",", 2)[0]
+
+	reply := make(chan struct{})
+	c.Server.Events <- &SWhowas{c, nick, count, reply}
+	<-reply
+	return nil
+}
+
+// recordWhowas records that c is no longer using its current nickname. Only
+// the newest Limits.Whowas entries are kept.
+func (s *Server) recordWhowas(c *Client) {
+	if s.Limits.Whowas <= 0 {
+		s.Whowas = nil
+		return
+	}
+
+	s.Whowas = append(s.Whowas, WhowasEntry{
+		Nick:    c.Info.Name,
+		User:    c.Info.User,
+		Host:    c.Info.Host,
+		Real:    c.Info.Real,
+		Account: c.Info.Account,
+		Time:    time.Now(),
+	})
+
+	if excess := len(s.Whowas) - s.Limits.Whowas; excess > 0 {
+		s.Whowas = append(s.Whowas[:0], s.Whowas[excess:]...)
+	}
+}
+
+// whowas sends c up to count of the most recent entries for nick, or all of
+// them if count isn't positive.
+func (s *Server) whowas(c *Client, nick string, count int) {
+	defer c.numeric(irc.RPL_ENDOFWHOWAS, nick, "End of WHOWAS")
+
+	folded := s.fold(nick)
+	sent := 0
+	for i := len(s.Whowas) - 1; i >= 0 && (count <= 0 || sent < count); i-- {
+		entry := s.Whowas[i]
+		if s.fold(entry.Nick) != folded {
+			continue
+		}
+
+		c.numeric(irc.RPL_WHOWASUSER, entry.Nick, entry.User, entry.Host, "*", entry.Real)
+		if len(entry.Account) > 0 {
+			c.numeric(RPL_WHOISACCOUNT, entry.Nick, entry.Account, "was logged in as")
+		}
+		c.numeric(irc.RPL_WHOISSERVER, entry.Nick, s.FriendlyName(), entry.Time.Format(time.RFC1123))
+		sent++
+	}
+
+	if sent == 0 {
+		c.numeric(irc.ERR_WASNOSUCHNICK, nick, "There was no such nickname")
+	}
+}
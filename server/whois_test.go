@@ -0,0 +1,101 @@
+// Copyright (c) 2014 Michael Johnson. All rights reserved.
+//
+// Use of this source code is governed by the BSD license that can be found in
+// the LICENSE file.
+
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// newWhoisTestClients registers alice and bob on a new server. bob is logged
+// into an account and is the operator of #test.
+func newWhoisTestClients(t *testing.T) (alice, bob *Client) {
+	s := newLinkTestServer("irc.test")
+
+	alice = newLinkTestClient(t, s, "alice")
+	bob = newLinkTestClient(t, s, "bob")
+	bob.Info.Account = "bobacct"
+	bob.ConnectTime = time.Unix(1400000000, 0)
+	if err := linkTestCommand(bob, irc.JOIN, "#test"); err != nil {
+		t.Fatalf("Couldn't join: %s", err)
+	}
+	queued(alice)
+	queued(bob)
+
+	return alice, bob
+}
+
+func TestWhois(t *testing.T) {
+	alice, bob := newWhoisTestClients(t)
+	if err := linkTestCommand(bob, irc.JOIN, "#MixedCase"); err != nil {
+		t.Fatalf("Couldn't join: %s", err)
+	}
+	queued(alice)
+
+	reply := make(chan struct{})
+	alice.Server.Events <- &SWhois{alice, "BOB", reply}
+	<-reply
+	lines := queued(alice)
+
+	if len(lines) != 6 {
+		t.Fatalf("Expected 6 lines, got %q", lines)
+	}
+	idle := lines[4]
+	if !strings.HasPrefix(idle, ":irc.test "+irc.RPL_WHOISIDLE+" alice bob ") || !strings.HasSuffix(idle, " 1400000000 :seconds idle, signon time") {
+		t.Errorf("Unexpected idle reply %q", idle)
+	}
+
+	expected := []string{
+		":irc.test " + irc.RPL_WHOISUSER + " alice bob ~bob localhost * :bob",
+		":irc.test " + irc.RPL_WHOISCHANNELS + " alice bob :@#MixedCase @#test",
+		":irc.test " + irc.RPL_WHOISSERVER + " alice bob irc.test :" + SoftwareName,
+		":irc.test " + RPL_WHOISACCOUNT + " alice bob bobacct :is logged in as",
+		":irc.test " + irc.RPL_ENDOFWHOIS + " alice BOB :End of /WHOIS list",
+	}
+	if actual := append(lines[:4:4], lines[5]); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %q, got %q", expected, actual)
+	}
+}
+
+func TestWhowas(t *testing.T) {
+	alice, bob := newWhoisTestClients(t)
+	disconnectTestClient(bob)
+
+	whowas := func(nick string) []string {
+		reply := make(chan struct{})
+		alice.Server.Events <- &SWhowas{alice, nick, 0, reply}
+		<-reply
+		return queued(alice)
+	}
+
+	lines := whowas("bob")
+	if len(lines) != 4 {
+		t.Fatalf("Expected 4 lines, got %q", lines)
+	}
+	if !strings.HasPrefix(lines[2], ":irc.test "+irc.RPL_WHOISSERVER+" alice bob irc.test :") {
+		t.Errorf("Unexpected server reply %q", lines[2])
+	}
+	expected := []string{
+		":irc.test " + irc.RPL_WHOWASUSER + " alice bob ~bob localhost * :bob",
+		":irc.test " + RPL_WHOISACCOUNT + " alice bob bobacct :was logged in as",
+		":irc.test " + irc.RPL_ENDOFWHOWAS + " alice bob :End of WHOWAS",
+	}
+	if actual := []string{lines[0], lines[1], lines[3]}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %q, got %q", expected, actual)
+	}
+
+	expected = []string{
+		":irc.test " + irc.ERR_WASNOSUCHNICK + " alice carol :There was no such nickname",
+		":irc.test " + irc.RPL_ENDOFWHOWAS + " alice carol :End of WHOWAS",
+	}
+	if lines := whowas("carol"); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+}